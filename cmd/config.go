@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/iancoleman/strcase"
+	"github.com/isayme/go-httpproxy/httpproxy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const envPrefix = "HTTPPROXY_"
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "config file utilities",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate FILE...",
+	Short: "validate config files",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		invalid := 0
+		for _, file := range args {
+			c := httpproxy.DefaultConfig()
+			if err := httpproxy.LoadConfig(file, &c); err != nil {
+				invalid++
+				fmt.Fprintln(cmd.ErrOrStderr(), err)
+				continue
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: ok\n", file)
+		}
+
+		if invalid > 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "%d of %d config files invalid\n", invalid, len(args))
+			os.Exit(1)
+		}
+	},
+}
+
+func envName(flag string) string {
+	return envPrefix + strcase.ToScreamingSnake(flag)
+}
+
+// buildConfig config from defaults, config file, environment variables and changed flags,
+// latter ones take precedence. called on start and every reload.
+func buildConfig(cmdFlags *pflag.FlagSet) (httpproxy.Config, error) {
+	c := httpproxy.DefaultConfig()
+
+	file := configFile
+	if !cmdFlags.Changed("config") {
+		file = os.Getenv(envName("config"))
+	}
+
+	if file != "" {
+		if err := httpproxy.LoadConfig(file, &c); err != nil {
+			return c, err
+		}
+	}
+
+	flags := configFlags(&c)
+
+	var errs []error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if cmdFlags.Changed(f.Name) {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("env %s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return c, errors.Join(errs...)
+	}
+
+	cmdFlags.Visit(func(f *pflag.Flag) {
+		if flags.Lookup(f.Name) != nil {
+			flags.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if cmdFlags.Changed("timeout") && !cmdFlags.Changed("idle-timeout") {
+		c.IdleTimeout = timeout
+	}
+
+	return c, c.Validate()
+}
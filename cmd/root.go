@@ -15,38 +15,55 @@ import (
 )
 
 var showVersion bool
-var logFormat string
-var logLevel string
-var listenAddress string
-var listenPort uint16
-var username string
-var password string
-var certFile string
-var keyFile string
-var proxyAddress string
-var connectTimeout time.Duration
+var configFile string
 var timeout time.Duration
-var pretendAsWeb bool
+
+// values of command line flags, only changed ones are used, see buildConfig
+var flagConfig = httpproxy.DefaultConfig()
 
 func aliasNormalizeFunc(f *pflag.FlagSet, name string) pflag.NormalizedName {
 	name = strcase.ToKebab(name)
 	return pflag.NormalizedName(name)
 }
 
+// configFlags flags bound to c, defaults are current values of c
+func configFlags(c *httpproxy.Config) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("config", pflag.ContinueOnError)
+
+	flags.StringVarP(&c.LogFormat, "log-format", "", c.LogFormat, "log format")
+	flags.StringVarP(&c.LogLevel, "log-level", "", c.LogLevel, "log level")
+	flags.Uint16VarP(&c.ListenPort, "port", "p", c.ListenPort, "listen port, omit if --listen-address used")
+	flags.StringVarP(&c.ListenAddress, "listen-address", "", c.ListenAddress, "listen address")
+	flags.StringVarP(&c.Username, "username", "", c.Username, "proxy server auth username")
+	flags.StringVarP(&c.Password, "password", "", c.Password, "proxy server auth password")
+	flags.StringVarP(&c.CertFile, "cert-file", "", c.CertFile, "cert file")
+	flags.StringVarP(&c.KeyFile, "key-file", "", c.KeyFile, "key file")
+	flags.BoolVar(&c.HTTP3, "http3", c.HTTP3, "also listen http/3 on udp port of listen address, cert required")
+	flags.BoolVar(&c.SOCKS, "socks", c.SOCKS, "also serve socks4/4a/5 clients on listen port, not with tls")
+	flags.StringVar(&c.Proxy, "proxy", c.Proxy, "use proxy, format: 'socks5://host:port' or 'http://host:port' or 'https://host:port' or 'h2://host:port'")
+	flags.StringVar(&c.ProxyTLS.CAFile, "proxy-ca-file", c.ProxyTLS.CAFile, "ca bundle to verify https proxy, system roots by default")
+	flags.BoolVar(&c.ProxyTLS.Insecure, "proxy-insecure", c.ProxyTLS.Insecure, "skip certificate verification of https proxy")
+	flags.StringVar(&c.UpstreamStrategy, "upstream-strategy", c.UpstreamStrategy, "how to pick upstream proxy: round-robin, weighted, least-conn, random, hash-destination, hash-client")
+	flags.StringVar(&c.DefaultOutbound, "default-outbound", c.DefaultOutbound, "outbound if no route rule matched: direct, reject, upstreams or upstream name, default upstreams if any")
+	flags.DurationVar(&c.ConnectTimeout, "connect-timeout", c.ConnectTimeout, "timeout of dial proxy or remote")
+	flags.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "timeout of tls handshake and request header read")
+	flags.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "close tunnel if no bytes in either direction for this long")
+	flags.DurationVar(&c.UDPIdleTimeout, "udp-idle-timeout", c.UDPIdleTimeout, "close udp flow of connect-udp if no datagrams in either direction for this long")
+	flags.DurationVar(&c.MaxSessionDuration, "max-session-duration", c.MaxSessionDuration, "max lifetime of a tunnel, 0 means unlimited")
+	flags.IntVar(&c.RateLimit, "rate-limit", c.RateLimit, "max bytes per second of each direction of a tunnel, 0 means unlimited")
+	flags.BoolVar(&c.ForwardedHeaders, "forwarded-headers", c.ForwardedHeaders, "add client address to X-Forwarded-For and Forwarded headers of plain http requests")
+	flags.BoolVarP(&c.PretendAsWeb, "pretend-as-web", "", c.PretendAsWeb, "pretend as web if not proxy request")
+	flags.StringVar(&c.AdminAddress, "admin-address", c.AdminAddress, "admin api listen address, like '127.0.0.1:1088', empty to disable")
+
+	return flags
+}
+
 func init() {
 	rootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show version")
-	rootCmd.Flags().StringVarP(&logFormat, "log-format", "", "console", "log format")
-	rootCmd.Flags().StringVarP(&logLevel, "log-level", "", "info", "log level")
-	rootCmd.Flags().Uint16VarP(&listenPort, "port", "p", 1087, "listen port, omit if --listen-address used")
-	rootCmd.Flags().StringVarP(&listenAddress, "listen-address", "", "0.0.0.0:1087", "listen address")
-	rootCmd.Flags().StringVarP(&username, "username", "", "", "proxy server auth username")
-	rootCmd.Flags().StringVarP(&password, "password", "", "", "proxy server auth password")
-	rootCmd.Flags().StringVarP(&certFile, "cert-file", "", "", "cert file")
-	rootCmd.Flags().StringVarP(&keyFile, "key-file", "", "", "key file")
-	rootCmd.Flags().StringVar(&proxyAddress, "proxy", "", "use proxy, format: 'socks5://host:port' or 'http://host:port' or 'https://host:port'")
-	rootCmd.Flags().DurationVar(&connectTimeout, "connect-timeout", time.Second*5, "timeout of dial proxy or remote")
+	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file, yaml or toml")
+	rootCmd.Flags().AddFlagSet(configFlags(&flagConfig))
 	rootCmd.Flags().DurationVar(&timeout, "timeout", time.Second*30, "timeout of read/write")
-	rootCmd.Flags().BoolVarP(&pretendAsWeb, "pretend-as-web", "", true, "pretend as web if not proxy request")
+	rootCmd.Flags().MarkDeprecated("timeout", "use --idle-timeout instead")
 
 	rootCmd.Flags().SetNormalizeFunc(aliasNormalizeFunc)
 }
@@ -59,41 +76,75 @@ var rootCmd = &cobra.Command{
 			os.Exit(0)
 		}
 
-		logger.SetLevel(logLevel)
-		logger.SetFormat(logger.LogFormat(logFormat))
-		logger.Debugf("set log level: %s", logLevel)
-		logger.Debugf("set log format: %s", logFormat)
-
-		options := []httpproxy.ServerOption{
-			httpproxy.WithListenPort(listenPort),
-			httpproxy.WithListenAddress(listenAddress),
-			httpproxy.WithUsername(username),
-			httpproxy.WithPassword(password),
-			httpproxy.WithConnectTimeout(connectTimeout),
-			httpproxy.WithTimeout(timeout),
-			httpproxy.WithProxy(proxyAddress),
-			httpproxy.WithCertFile(certFile),
-			httpproxy.WithKeyFile(keyFile),
-			httpproxy.WithPretendAsWeb(pretendAsWeb),
+		config, err := buildConfig(cmd.Flags())
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+
+		logger.SetLevel(config.LogLevel)
+		logger.SetFormat(logger.LogFormat(config.LogFormat))
+		logger.Debugf("set log level: %s", config.LogLevel)
+		logger.Debugf("set log format: %s", config.LogFormat)
+
+		options, err := config.ServerOptions()
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
 		}
 
-		logger.Debugw("option", "listen-port", listenPort)
-		logger.Debugw("option", "listen-address", listenAddress)
+		logger.Debugw("option", "config", configFile)
+		logger.Debugw("option", "listen-port", config.ListenPort)
+		logger.Debugw("option", "listen-address", config.ListenAddress)
+		logger.Debugw("option", "admin-address", config.AdminAddress)
 
-		maskPassword := password
+		maskPassword := config.Password
 		if len(maskPassword) > 1 {
-			maskPassword = password[:1] + "***" + password[len(password)-1:]
+			maskPassword = maskPassword[:1] + "***" + maskPassword[len(maskPassword)-1:]
 		}
-		logger.Debugw("option", "username", username, "password", maskPassword)
+		logger.Debugw("option", "username", config.Username, "password", maskPassword)
+		logger.Debugw("option", "users", len(config.Users))
+
+		logger.Debugw("option", "connect-timeout", config.ConnectTimeout.String())
+		logger.Debugw("option", "handshake-timeout", config.HandshakeTimeout.String())
+		logger.Debugw("option", "idle-timeout", config.IdleTimeout.String())
+		logger.Debugw("option", "udp-idle-timeout", config.UDPIdleTimeout.String())
+		logger.Debugw("option", "max-session-duration", config.MaxSessionDuration.String())
+		logger.Debugw("option", "rate-limit", config.RateLimit)
+		logger.Debugw("option", "pretend-as-web", config.PretendAsWeb)
+		logger.Debugw("option", "socks", config.SOCKS)
+		logger.Debugw("option", "forwarded-headers", config.ForwardedHeaders)
+		logger.Debugw("option", "listeners", len(config.Listeners))
+
+		logger.Debugw("option", "proxy", config.Proxy)
+		logger.Debugw("option", "upstreams", len(config.Upstreams), "upstream-strategy", config.UpstreamStrategy)
+		logger.Debugw("option", "dns-servers", config.DNS.Servers, "dns-rules", len(config.DNS.Rules), "dns-hosts", len(config.DNS.Hosts))
+		logger.Debugw("option", "cert-file", config.CertFile, "key-file", config.KeyFile, "cert-dir", config.TLS.CertDir, "acme-domains", config.ACME.Domains, "http3", config.HTTP3)
+
+		var server *httpproxy.Server
+
+		// reload re-read config file, old config kept if fail
+		reload := func() error {
+			config, err := buildConfig(cmd.Flags())
+			if err != nil {
+				return err
+			}
 
-		logger.Debugw("option", "connect-timeout", connectTimeout.String())
-		logger.Debugw("option", "timeout", timeout.String())
-		logger.Debugw("option", "pretend-as-web", pretendAsWeb)
+			options, err := config.ServerOptions()
+			if err != nil {
+				return err
+			}
 
-		logger.Debugw("option", "proxy", proxyAddress)
-		logger.Debugw("option", "cert-file", certFile, "key-file", keyFile)
+			if err := server.Reload(options...); err != nil {
+				return err
+			}
 
-		server, err := httpproxy.NewServer(options...)
+			logger.SetLevel(config.LogLevel)
+			return nil
+		}
+		options = append(options, httpproxy.WithReloadFunc(reload))
+
+		server, err = httpproxy.NewServer(options...)
 		if err != nil {
 			logger.Error(err)
 			os.Exit(1)
@@ -103,6 +154,39 @@ var rootCmd = &cobra.Command{
 		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer stop()
 
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		go func() {
+			for range hup {
+				logger.Info("receive SIGHUP, reload config")
+				if err := reload(); err != nil {
+					logger.Warnw("reload fail, keep old config", "err", err)
+				}
+			}
+		}()
+
+		// on upgrade signal, hand sockets to new process, then drain as shutdown
+		upgraded := make(chan struct{})
+		if len(upgradeSignals) > 0 {
+			usr2 := make(chan os.Signal, 1)
+			signal.Notify(usr2, upgradeSignals...)
+			defer signal.Stop(usr2)
+
+			go func() {
+				for range usr2 {
+					logger.Info("receive upgrade signal, start new process")
+					if err := server.Upgrade(); err != nil {
+						logger.Warnw("upgrade fail, keep serving", "err", err)
+						continue
+					}
+					close(upgraded)
+					return
+				}
+			}()
+		}
+
 		go func() {
 			err := server.ListenAndServe()
 			if err != nil {
@@ -110,12 +194,17 @@ var rootCmd = &cobra.Command{
 			}
 		}()
 
-		<-ctx.Done()
+		select {
+		case <-ctx.Done():
+		case <-upgraded:
+		}
 
 		logger.Info("shutting down start")
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
-		server.Shutdown(ctx)
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warnw("shutting down fail", "err", err)
+		}
 		logger.Info("shutting down end")
 	},
 }
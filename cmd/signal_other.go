@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// no SIGUSR2, upgrade not supported
+var upgradeSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals to upgrade binary without downtime
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,131 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// ACL access control of clients and destination ports
+type ACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	ports map[uint16]struct{}
+}
+
+// NewACL create acl. empty allow allows all clients, empty ports allows all ports
+func NewACL(allow, deny []string, ports []uint16) (*ACL, error) {
+	acl := &ACL{}
+
+	var err error
+	acl.allow, err = parsePrefixes(allow)
+	if err != nil {
+		return nil, fmt.Errorf("NewACL: parse allow fail: %w", err)
+	}
+
+	acl.deny, err = parsePrefixes(deny)
+	if err != nil {
+		return nil, fmt.Errorf("NewACL: parse deny fail: %w", err)
+	}
+
+	if len(ports) > 0 {
+		acl.ports = map[uint16]struct{}{}
+		for _, port := range ports {
+			acl.ports[port] = struct{}{}
+		}
+	}
+
+	return acl, nil
+}
+
+// AllowClient whether client with remote address addr is allowed
+func (acl *ACL) AllowClient(addr string) bool {
+	if acl == nil {
+		return true
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return len(acl.allow) == 0 && len(acl.deny) == 0
+	}
+
+	for _, prefix := range acl.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(acl.allow) == 0 {
+		return true
+	}
+
+	for _, prefix := range acl.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowDestination whether destination host:port is allowed
+func (acl *ACL) AllowDestination(hostport string) bool {
+	if acl == nil || acl.ports == nil {
+		return true
+	}
+
+	_, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+
+	_, ok := acl.ports[uint16(port)]
+	return ok
+}
+
+// parsePrefixes parse cidrs or single ips
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(cidr); err == nil {
+		return netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return prefix, err
+	}
+
+	return prefix.Masked(), nil
+}
+
+// addrIP ip of host:port or ip
+func addrIP(addr string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ip, false
+	}
+
+	return ip.Unmap(), true
+}
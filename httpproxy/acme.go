@@ -0,0 +1,143 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// path prefix of http-01 challenges
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEConfig certificates of domains provisioned by acme (RFC 8555), like let's encrypt.
+// challenges are http-01 on port 80 and tls-alpn-01 on port 443 of listeners.
+type ACMEConfig struct {
+	// enabled if not empty
+	Domains []string `yaml:"domains" toml:"domains"`
+	Email   string   `yaml:"email" toml:"email"`
+	// account key and certificates kept here, required
+	CacheDir string `yaml:"cache-dir" toml:"cache-dir"`
+	// default let's encrypt
+	DirectoryURL string `yaml:"directory-url" toml:"directory-url"`
+	// pem ca bundle verifying https of directory url, system roots by default
+	CAFile string `yaml:"ca-file" toml:"ca-file"`
+	// renew before expiry, default 30 days or 1/3 of lifetime
+	RenewBefore time.Duration `yaml:"renew-before" toml:"renew-before"`
+}
+
+func (c ACMEConfig) enabled() bool {
+	return len(c.Domains) > 0
+}
+
+func (c ACMEConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+
+	for _, domain := range c.Domains {
+		if domain == "" || strings.ContainsAny(domain, "*:/") {
+			return fmt.Errorf("domain '%s' invalid", domain)
+		}
+	}
+	if c.CacheDir == "" {
+		return errors.New("cache-dir required")
+	}
+	if c.DirectoryURL != "" {
+		u, err := url.Parse(c.DirectoryURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("directory-url '%s' invalid", c.DirectoryURL)
+		}
+	}
+	if c.RenewBefore < 0 {
+		return errors.New("renew-before must not be negative")
+	}
+
+	return nil
+}
+
+// acmeManager autocert manager of domains
+type acmeManager struct {
+	*autocert.Manager
+	domains []string
+
+	// serves http-01 challenges
+	httpHandler http.Handler
+}
+
+func newACMEManager(c ACMEConfig) (*acmeManager, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in ca file '%s'", c.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	domains := make([]string, 0, len(c.Domains))
+	for _, domain := range c.Domains {
+		domains = append(domains, strings.ToLower(strings.TrimSuffix(domain, ".")))
+	}
+
+	m := &acmeManager{
+		Manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(c.CacheDir),
+			HostPolicy:  autocert.HostWhitelist(domains...),
+			RenewBefore: c.RenewBefore,
+			Client:      client,
+			Email:       c.Email,
+		},
+		domains: domains,
+	}
+	// also enables http-01, tried after tls-alpn-01
+	m.httpHandler = m.HTTPHandler(http.NotFoundHandler())
+
+	return m, nil
+}
+
+// hasDomain whether certificate of name provisioned by acme
+func (m *acmeManager) hasDomain(name string) bool {
+	return slices.Contains(m.domains, strings.ToLower(strings.TrimSuffix(name, ".")))
+}
+
+// getCertificate certificate of sni if one of domains, of first domain otherwise,
+// like clients connecting by ip
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !m.hasDomain(hello.ServerName) {
+		h := *hello
+		h.ServerName = m.domains[0]
+		hello = &h
+	}
+	return m.GetCertificate(hello)
+}
+
+// isACMEChallenge whether hello is tls-alpn-01 challenge of ca
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// isACMEChallengePath whether request is http-01 challenge of ca
+func isACMEChallengePath(path string) bool {
+	return strings.HasPrefix(path, acmeChallengePath)
+}
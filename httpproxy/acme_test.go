@@ -0,0 +1,100 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMEConfig(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(ACMEConfig{}.validate())
+	require.Nil(ACMEConfig{Domains: []string{"example.com"}, CacheDir: "/tmp", DirectoryURL: "https://localhost:14000/dir"}.validate())
+	require.ErrorContains(ACMEConfig{Domains: []string{"example.com"}}.validate(), "cache-dir")
+	require.ErrorContains(ACMEConfig{Domains: []string{"*.example.com"}, CacheDir: "/tmp"}.validate(), "domain")
+	require.ErrorContains(ACMEConfig{Domains: []string{"example.com"}, CacheDir: "/tmp", DirectoryURL: "localhost"}.validate(), "directory-url")
+
+	_, err := newListenerPolicy(ListenerConfig{Name: "web", Address: ":8443", TLS: ServerTLSConfig{ACME: true}}, nil)
+	require.ErrorContains(err, "acme")
+}
+
+func TestACMECertificate(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	a := writeCertPair(require, dir, "a", "a.example.com")
+	acm, err := newACMEManager(ACMEConfig{Domains: []string{"b.example.com"}, CacheDir: t.TempDir()})
+	require.Nil(err)
+	pol, err := newListenerPolicy(ListenerConfig{
+		Name:    "web",
+		Address: ":8443",
+		TLS:     ServerTLSConfig{CertDir: dir, ACME: true},
+	}, acm)
+	require.Nil(err)
+
+	// certificate files first, fallback of them if not an acme domain
+	for _, name := range []string{"a.example.com", "other.example.com"} {
+		cert, err := pol.getCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.Nil(err)
+		require.Equal(a.SerialNumber, cert.Leaf.SerialNumber)
+	}
+
+	// tls-alpn-01 answered by acme
+	require.True(isACMEChallenge(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}}))
+	require.False(isACMEChallenge(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", acme.ALPNProto}}))
+	require.True(slices.Contains(pol.acme.TLSConfig().NextProtos, acme.ALPNProto))
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	require := require.New(t)
+
+	// key authorization of a pending token, as kept by autocert
+	cacheDir := t.TempDir()
+	require.Nil(os.WriteFile(filepath.Join(cacheDir, "token+http-01"), []byte("token.key"), 0600))
+
+	server := startProxy(require, WithListenAddress(":8080"), WithListeners([]ListenerConfig{
+		{Name: "http", Address: "127.0.0.1:8081"},
+		// ca neither authenticated nor allowed
+		{
+			Name:         "private",
+			Address:      "127.0.0.1:8082",
+			Users:        []UserConfig{{Username: "foo", Password: "bar"}},
+			ACL:          ACLConfig{Allow: []string{"10.0.0.0/8"}},
+			PretendAsWeb: true,
+		},
+	}), WithACME(ACMEConfig{Domains: []string{"example.com"}, CacheDir: cacheDir}))
+	defer server.Shutdown(context.Background())
+
+	get := func(addr, path string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		require.Nil(err)
+		req.Host = "example.com"
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(err)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, addr := range []string{"127.0.0.1:8081", "127.0.0.1:8082"} {
+		code, body := get(addr, "/.well-known/acme-challenge/token")
+		require.Equal(http.StatusOK, code, addr)
+		require.Equal("token.key", body, addr)
+
+		// unknown token answered by challenge handler, not the version page
+		code, _ = get(addr, "/.well-known/acme-challenge/unknown")
+		require.Equal(http.StatusNotFound, code, addr)
+	}
+	code, _ := get("127.0.0.1:8081", "/")
+	require.Equal(http.StatusOK, code)
+}
@@ -0,0 +1,45 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/isayme/go-logger"
+)
+
+func (s *Server) newAdminServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /upstreams", s.handleUpstreams)
+
+	return &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: s.options.handshakeTimeout,
+	}
+}
+
+// handleReload reload config by reload func
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	reloadFunc := s.options.reloadFunc
+	if reloadFunc == nil {
+		http.Error(w, "reload not supported\n", http.StatusNotImplemented)
+		return
+	}
+
+	if err := reloadFunc(); err != nil {
+		logger.Warnw("admin reload fail, keep old config", "err", err)
+		http.Error(w, fmt.Sprintf("reload fail: %s\n", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+// handleUpstreams health state of upstreams
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.upstreamStatuses())
+}
@@ -0,0 +1,287 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isayme/go-logger"
+)
+
+// default interval of checking certificate files change
+const defaultCertInterval = time.Minute
+
+// ServerTLSConfig certificates and tls policy of a tls listener
+type ServerTLSConfig struct {
+	// certificates selected by sni, pairs of 'name.crt' or 'name.pem' and 'name.key'
+	CertDir string `yaml:"cert-dir" toml:"cert-dir"`
+	// interval of checking certificate files change, default 1m
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+
+	// 1.0, 1.1, 1.2 or 1.3, default 1.2
+	MinVersion string `yaml:"min-version" toml:"min-version"`
+	// tls 1.2 cipher suites like 'TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256', go defaults if empty.
+	// suites of tls 1.3 are not configurable.
+	CipherSuites []string `yaml:"cipher-suites" toml:"cipher-suites"`
+	// key exchanges in preference order, X25519MLKEM768, X25519, P-256, P-384, P-521, go defaults if empty
+	Curves []string `yaml:"curves" toml:"curves"`
+
+	// certificates of top level acme too, always for listen address if acme set
+	ACME bool `yaml:"acme" toml:"acme"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+func (c ServerTLSConfig) validate() error {
+	_, err := c.policy()
+	return err
+}
+
+// policy tls config of policy knobs, without certificates
+func (c ServerTLSConfig) policy() (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// http/2 negotiated
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("min-version '%s' invalid, must be 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+		conf.MinVersion = version
+	}
+
+	for _, name := range c.CipherSuites {
+		i := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool { return cs.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("cipher suite '%s' unknown or insecure", name)
+		}
+		conf.CipherSuites = append(conf.CipherSuites, tls.CipherSuites()[i].ID)
+	}
+
+	for _, name := range c.Curves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("curve '%s' unknown", name)
+		}
+		conf.CurvePreferences = append(conf.CurvePreferences, curve)
+	}
+
+	return conf, nil
+}
+
+// certSet certificates loaded, by names in them
+type certSet struct {
+	// no sni or no name matched
+	fallback *tls.Certificate
+	// lower case dns name, or wildcard like '*.example.com'
+	names map[string]*tls.Certificate
+}
+
+// certManager certificates of a listener, cert file and cert dir, reloaded on files change
+type certManager struct {
+	certFile string
+	keyFile  string
+	dir      string
+	interval time.Duration
+
+	certs atomic.Pointer[certSet]
+	// modify time and size of files loaded
+	stamp string
+
+	stop chan struct{}
+}
+
+// newCertManager load cert file pair if set, and pairs in dir if set
+func newCertManager(certFile, keyFile string, c ServerTLSConfig) (*certManager, error) {
+	m := &certManager{
+		certFile: certFile,
+		keyFile:  keyFile,
+		dir:      c.CertDir,
+		interval: c.Interval,
+	}
+	if m.interval <= 0 {
+		m.interval = defaultCertInterval
+	}
+
+	pairs, err := m.pairs()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := loadCertSet(pairs)
+	if err != nil {
+		return nil, err
+	}
+	m.stamp = filesStamp(pairs)
+	m.certs.Store(certs)
+	logger.Infow("certificates loaded", "file", certFile, "dir", m.dir, "count", len(pairs))
+
+	return m, nil
+}
+
+// pairs cert and key files, cert file first, then dir in name order
+func (m *certManager) pairs() ([][2]string, error) {
+	var pairs [][2]string
+	if m.certFile != "" {
+		pairs = append(pairs, [2]string{m.certFile, m.keyFile})
+	}
+
+	if m.dir != "" {
+		entries, err := os.ReadDir(m.dir)
+		if err != nil {
+			return nil, fmt.Errorf("read cert dir fail: %w", err)
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+				continue
+			}
+			// no key, like a ca bundle
+			keyFile := filepath.Join(m.dir, strings.TrimSuffix(entry.Name(), ext)+".key")
+			if _, err := os.Stat(keyFile); err != nil {
+				continue
+			}
+			pairs = append(pairs, [2]string{filepath.Join(m.dir, entry.Name()), keyFile})
+		}
+	}
+
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return pairs, nil
+}
+
+func loadCertSet(pairs [][2]string) (*certSet, error) {
+	certs := &certSet{names: map[string]*tls.Certificate{}}
+
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("load certificate '%s' fail: %w", pair[0], err)
+		}
+
+		if certs.fallback == nil {
+			certs.fallback = &cert
+		}
+		// first loaded wins, so cert file over dir
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if _, ok := certs.names[name]; !ok {
+				certs.names[name] = &cert
+			}
+		}
+	}
+
+	return certs, nil
+}
+
+// filesStamp modify time and size of files, changes if any file changed, added or removed
+func filesStamp(pairs [][2]string) string {
+	var b strings.Builder
+	for _, pair := range pairs {
+		for _, file := range pair {
+			info, err := os.Stat(file)
+			if err != nil {
+				fmt.Fprintf(&b, "%s:-;", file)
+				continue
+			}
+			fmt.Fprintf(&b, "%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return b.String()
+}
+
+// getCertificate certificate of sni, fallback if no name matched
+func (m *certManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := m.match(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return m.certs.Load().fallback, nil
+}
+
+// match certificate of exact name first, then wildcard, nil if none
+func (m *certManager) match(serverName string) *tls.Certificate {
+	certs := m.certs.Load()
+
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := certs.names[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := certs.names["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// start checking files change until stop
+func (m *certManager) start() {
+	m.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+
+			m.reloadIfChanged()
+		}
+	}()
+}
+
+func (m *certManager) stopWatch() {
+	if m.stop != nil {
+		close(m.stop)
+	}
+}
+
+// reloadIfChanged reload if any file changed, keep old certificates if fail
+func (m *certManager) reloadIfChanged() {
+	pairs, err := m.pairs()
+	if err != nil {
+		logger.Warnw("certificates reload fail, keep old ones", "file", m.certFile, "dir", m.dir, "err", err)
+		return
+	}
+	stamp := filesStamp(pairs)
+	if stamp == m.stamp {
+		return
+	}
+
+	// retried on next check, like key file not yet written
+	certs, err := loadCertSet(pairs)
+	if err != nil {
+		logger.Warnw("certificates reload fail, keep old ones", "file", m.certFile, "dir", m.dir, "err", err)
+		return
+	}
+
+	m.stamp = stamp
+	m.certs.Store(certs)
+	logger.Infow("certificates reloaded", "file", m.certFile, "dir", m.dir, "count", len(pairs))
+}
@@ -0,0 +1,122 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertPair write self signed certificate of names to dir as 'file.crt' and 'file.key'
+func writeCertPair(require *require.Assertions, dir string, file string, names ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(err)
+
+	require.Nil(os.WriteFile(filepath.Join(dir, file+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(os.WriteFile(filepath.Join(dir, file+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(err)
+	return cert
+}
+
+func TestCertManager(t *testing.T) {
+	require := require.New(t)
+
+	fileDir := t.TempDir()
+	fallback := writeCertPair(require, fileDir, "default", "default.example.com")
+
+	dir := t.TempDir()
+	a := writeCertPair(require, dir, "a", "a.example.com")
+	b := writeCertPair(require, dir, "b", "*.b.example.com")
+	// no key, skipped
+	require.Nil(os.WriteFile(filepath.Join(dir, "ca.pem"), nil, 0600))
+
+	m, err := newCertManager(filepath.Join(fileDir, "default.crt"), filepath.Join(fileDir, "default.key"), ServerTLSConfig{CertDir: dir})
+	require.Nil(err)
+
+	serial := func(name string) *big.Int {
+		cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.Nil(err)
+		return cert.Leaf.SerialNumber
+	}
+	require.Equal(a.SerialNumber, serial("A.example.com"))
+	require.Equal(b.SerialNumber, serial("x.b.example.com"))
+	require.Equal(fallback.SerialNumber, serial("x.y.b.example.com"))
+	require.Equal(fallback.SerialNumber, serial(""))
+
+	// rotated, and a new one added
+	a = writeCertPair(require, dir, "a", "a.example.com")
+	future := time.Now().Add(time.Minute)
+	require.Nil(os.Chtimes(filepath.Join(dir, "a.crt"), future, future))
+	c := writeCertPair(require, dir, "c", "c.example.com")
+	m.reloadIfChanged()
+	require.Equal(a.SerialNumber, serial("a.example.com"))
+	require.Equal(c.SerialNumber, serial("c.example.com"))
+
+	// broken key kept old ones
+	require.Nil(os.WriteFile(filepath.Join(dir, "c.key"), []byte("broken"), 0600))
+	m.reloadIfChanged()
+	require.Equal(c.SerialNumber, serial("c.example.com"))
+
+	_, err = newCertManager("", "", ServerTLSConfig{CertDir: t.TempDir()})
+	require.ErrorContains(err, "no certificate found")
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	require := require.New(t)
+
+	conf, err := ServerTLSConfig{
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"X25519", "P-256"},
+	}.policy()
+	require.Nil(err)
+	require.Equal(uint16(tls.VersionTLS13), conf.MinVersion)
+	require.Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, conf.CipherSuites)
+	require.Equal([]tls.CurveID{tls.X25519, tls.CurveP256}, conf.CurvePreferences)
+
+	require.ErrorContains(ServerTLSConfig{MinVersion: "1.4"}.validate(), "min-version")
+	require.ErrorContains(ServerTLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}.validate(), "insecure")
+	require.ErrorContains(ServerTLSConfig{Curves: []string{"P-224"}}.validate(), "curve")
+
+	// proxy serves certificate of sni
+	dir := t.TempDir()
+	a := writeCertPair(require, dir, "a", "a.example.com")
+	b := writeCertPair(require, dir, "b", "b.example.com")
+	server := startProxy(require, WithListenAddress(":8080"), WithTLS(ServerTLSConfig{CertDir: dir, MinVersion: "1.3"}))
+	defer server.Shutdown(context.Background())
+
+	for _, cert := range []*x509.Certificate{a, b} {
+		conn, err := tls.Dial("tcp", "127.0.0.1:8080", &tls.Config{ServerName: cert.DNSNames[0], InsecureSkipVerify: true})
+		require.Nil(err)
+		state := conn.ConnectionState()
+		require.Equal(cert.SerialNumber, state.PeerCertificates[0].SerialNumber)
+		require.Equal(uint16(tls.VersionTLS13), state.Version)
+		conn.Close()
+	}
+
+	_, err = tls.Dial("tcp", "127.0.0.1:8080", &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	require.NotNil(err)
+}
@@ -0,0 +1,562 @@
+package httpproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/isayme/go-logger"
+	"gopkg.in/yaml.v3"
+)
+
+// Config config file content, keys same as command line flags
+type Config struct {
+	LogFormat string `yaml:"log-format" toml:"log-format"`
+	LogLevel  string `yaml:"log-level" toml:"log-level"`
+
+	ListenPort    uint16 `yaml:"port" toml:"port"`
+	ListenAddress string `yaml:"listen-address" toml:"listen-address"`
+
+	Username string       `yaml:"username" toml:"username"`
+	Password string       `yaml:"password" toml:"password"`
+	Users    []UserConfig `yaml:"users" toml:"users"`
+	ACL      ACLConfig    `yaml:"acl" toml:"acl"`
+
+	CertFile string          `yaml:"cert-file" toml:"cert-file"`
+	KeyFile  string          `yaml:"key-file" toml:"key-file"`
+	TLS      ServerTLSConfig `yaml:"tls" toml:"tls"`
+	ACME     ACMEConfig      `yaml:"acme" toml:"acme"`
+	HTTP3    bool            `yaml:"http3" toml:"http3"`
+
+	SOCKS            bool                `yaml:"socks" toml:"socks"`
+	ProxyProtocol    ProxyProtocolConfig `yaml:"proxy-protocol" toml:"proxy-protocol"`
+	ForwardedHeaders bool                `yaml:"forwarded-headers" toml:"forwarded-headers"`
+
+	Proxy              string            `yaml:"proxy" toml:"proxy"`
+	ProxyTLS           UpstreamTLSConfig `yaml:"proxy-tls" toml:"proxy-tls"`
+	Upstreams          []UpstreamConfig  `yaml:"upstreams" toml:"upstreams"`
+	UpstreamStrategy   string            `yaml:"upstream-strategy" toml:"upstream-strategy"`
+	HealthCheck        HealthCheckConfig `yaml:"health-check" toml:"health-check"`
+	ConnectTimeout     time.Duration     `yaml:"connect-timeout" toml:"connect-timeout"`
+	HandshakeTimeout   time.Duration     `yaml:"handshake-timeout" toml:"handshake-timeout"`
+	IdleTimeout        time.Duration     `yaml:"idle-timeout" toml:"idle-timeout"`
+	UDPIdleTimeout     time.Duration     `yaml:"udp-idle-timeout" toml:"udp-idle-timeout"`
+	MaxSessionDuration time.Duration     `yaml:"max-session-duration" toml:"max-session-duration"`
+	RateLimit          int               `yaml:"rate-limit" toml:"rate-limit"`
+
+	Rules           []RuleConfig    `yaml:"rules" toml:"rules"`
+	RuleSets        []RuleSetConfig `yaml:"rule-sets" toml:"rule-sets"`
+	DefaultOutbound string          `yaml:"default-outbound" toml:"default-outbound"`
+
+	DNS DNSConfig `yaml:"dns" toml:"dns"`
+
+	PretendAsWeb bool      `yaml:"pretend-as-web" toml:"pretend-as-web"`
+	PAC          PACConfig `yaml:"pac" toml:"pac"`
+
+	Listeners []ListenerConfig `yaml:"listeners" toml:"listeners"`
+
+	AdminAddress string `yaml:"admin-address" toml:"admin-address"`
+}
+
+type UserConfig struct {
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+type ACLConfig struct {
+	// client cidrs allowed, empty allows all
+	Allow []string `yaml:"allow" toml:"allow"`
+	// client cidrs denied, checked before allow
+	Deny []string `yaml:"deny" toml:"deny"`
+	// destination ports allowed, empty allows all
+	Ports []uint16 `yaml:"ports" toml:"ports"`
+}
+
+// DefaultConfig config with default values
+func DefaultConfig() Config {
+	return Config{
+		LogFormat:        "console",
+		LogLevel:         "info",
+		ListenPort:       1087,
+		ListenAddress:    "0.0.0.0:1087",
+		ConnectTimeout:   time.Second * 5,
+		HandshakeTimeout: time.Second * 10,
+		IdleTimeout:      time.Second * 30,
+		UDPIdleTimeout:   time.Minute * 2,
+		UpstreamStrategy: StrategyRoundRobin,
+		HealthCheck:      DefaultHealthCheckConfig(),
+		PretendAsWeb:     true,
+	}
+}
+
+// ConfigError invalid config, Line is 0 if unknown
+type ConfigError struct {
+	File string
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&b, ":%d", e.Line)
+		}
+		b.WriteString(": ")
+	}
+	if e.Key != "" {
+		fmt.Fprintf(&b, "%s: ", e.Key)
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// LoadConfig decode file onto c, keys absent in file keep their value.
+// format by extension, '.toml' for toml, yaml otherwise.
+func LoadConfig(file string, c *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("LoadConfig: %w", err)
+	}
+
+	var loaded Config = *c
+	var root *yaml.Node
+
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		err = decodeTOML(file, data, &loaded)
+	} else {
+		root, err = decodeYAML(file, data, &loaded)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := loaded.Validate(); err != nil {
+		var errs []error
+		for _, err := range unwrapErrors(err) {
+			var configErr *ConfigError
+			if errors.As(err, &configErr) {
+				configErr.File = file
+				configErr.Line = yamlLine(root, configErr.Key)
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	}
+
+	*c = loaded
+	return nil
+}
+
+func decodeYAML(file string, data []byte, c *Config) (*yaml.Node, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	// empty file
+	if len(root.Content) == 0 {
+		return &root, nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return &root, nil
+}
+
+func decodeTOML(file string, data []byte, c *Config) error {
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return &ConfigError{File: file, Line: parseErr.Position.Line, Err: errors.New(parseErr.Message)}
+		}
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	var errs []error
+	for _, key := range md.Undecoded() {
+		errs = append(errs, &ConfigError{File: file, Key: key.String(), Err: errors.New("unknown key")})
+	}
+	return errors.Join(errs...)
+}
+
+// yamlLine line of key path like 'users.0.username', 0 if not found
+func yamlLine(root *yaml.Node, key string) int {
+	if root == nil || len(root.Content) == 0 || key == "" {
+		return 0
+	}
+
+	node := root.Content[0]
+	line := node.Line
+	for _, part := range strings.Split(key, ".") {
+		var next *yaml.Node
+
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(part)
+			if err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+				line = next.Line
+			}
+		}
+
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+
+	return line
+}
+
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic", "disabled"}
+
+// Validate check values, return joined *ConfigError
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(key string, format string, args ...any) {
+		errs = append(errs, &ConfigError{Key: key, Err: fmt.Errorf(format, args...)})
+	}
+
+	switch logger.LogFormat(c.LogFormat) {
+	case logger.FORMAT_CONSOLE, logger.FORMAT_JSON:
+	default:
+		invalid("log-format", "must be one of console, json")
+	}
+
+	if !containsFold(logLevels, c.LogLevel) {
+		invalid("log-level", "must be one of %s", strings.Join(logLevels, ", "))
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		invalid("cert-file", "cert-file and key-file must be set together")
+	}
+	if c.HTTP3 && c.CertFile == "" && c.TLS.CertDir == "" && !c.ACME.enabled() {
+		invalid("http3", "cert-file and key-file, tls.cert-dir or acme required")
+	}
+
+	if c.Proxy != "" {
+		if err := validateProxyURL(c.Proxy); err != nil {
+			invalid("proxy", "%s", err)
+		}
+	}
+
+	if err := c.ProxyTLS.validate(); err != nil {
+		invalid("proxy-tls", "%s", err)
+	}
+
+	if !containsFold(upstreamStrategies, c.UpstreamStrategy) {
+		invalid("upstream-strategy", "must be one of %s", strings.Join(upstreamStrategies, ", "))
+	}
+
+	names := map[string]bool{}
+	for i, up := range c.Upstreams {
+		key := fmt.Sprintf("upstreams.%d", i)
+		if err := validateProxyURL(up.URL); err != nil {
+			invalid(key+".url", "%s", err)
+		}
+		if up.Name != "" && names[up.Name] {
+			invalid(key+".name", "duplicate upstream '%s'", up.Name)
+		}
+		names[up.Name] = true
+		if up.Weight < 0 {
+			invalid(key+".weight", "must not be negative")
+		}
+		if up.ConnectTimeout < 0 {
+			invalid(key+".connect-timeout", "must not be negative")
+		}
+		if err := up.TLS.validate(); err != nil {
+			invalid(key+".tls", "%s", err)
+		}
+	}
+
+	outbounds := []string{OutboundDirect, OutboundReject}
+	if c.Proxy != "" || len(c.Upstreams) > 0 {
+		outbounds = append(outbounds, OutboundUpstreams)
+	}
+	if c.Proxy != "" {
+		outbounds = append(outbounds, "proxy")
+	}
+	for i, up := range c.Upstreams {
+		name := up.Name
+		if name == "" {
+			// same as index in upstream pool, where proxy comes first
+			index := i
+			if c.Proxy != "" {
+				index++
+			}
+			name = "upstream-" + strconv.Itoa(index)
+		}
+		outbounds = append(outbounds, name)
+	}
+	if c.DefaultOutbound != "" && !slices.Contains(outbounds, c.DefaultOutbound) {
+		invalid("default-outbound", "unknown outbound '%s'", c.DefaultOutbound)
+	}
+	ruleSets := map[string]bool{}
+	for i, rs := range c.RuleSets {
+		key := fmt.Sprintf("rule-sets.%d", i)
+		if rs.Name == "" {
+			invalid(key+".name", "required")
+		} else if ruleSets[rs.Name] {
+			invalid(key+".name", "duplicate rule set '%s'", rs.Name)
+		}
+		ruleSets[rs.Name] = true
+		if rs.File == "" {
+			invalid(key+".file", "required")
+		}
+		if rs.Format != "" && !containsFold(ruleSetFormats, rs.Format) {
+			invalid(key+".format", "must be one of %s", strings.Join(ruleSetFormats, ", "))
+		}
+		if rs.Interval < 0 {
+			invalid(key+".interval", "must not be negative")
+		}
+	}
+
+	for i, rule := range c.Rules {
+		key := fmt.Sprintf("rules.%d", i)
+		for j, name := range rule.RuleSet {
+			if !ruleSets[name] {
+				invalid(fmt.Sprintf("%s.rule-set.%d", key, j), "unknown rule set '%s'", name)
+			}
+		}
+		if _, err := newRule(i, rule); err != nil {
+			invalid(key, "%s", err)
+		}
+		if rule.Outbound == "" {
+			invalid(key+".outbound", "required")
+		} else if !slices.Contains(outbounds, rule.Outbound) {
+			invalid(key+".outbound", "unknown outbound '%s'", rule.Outbound)
+		}
+	}
+
+	for i, cidr := range c.ProxyProtocol.Trusted {
+		if _, err := parsePrefix(cidr); err != nil {
+			invalid(fmt.Sprintf("proxy-protocol.trusted.%d", i), "invalid cidr '%s'", cidr)
+		}
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		invalid("tls", "%s", err)
+	}
+	if err := c.ACME.validate(); err != nil {
+		invalid("acme", "%s", err)
+	}
+
+	listeners := map[string]bool{}
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("listeners.%d", i)
+		if l.Name != "" && listeners[l.Name] {
+			invalid(key+".name", "duplicate listener '%s'", l.Name)
+		}
+		listeners[l.Name] = true
+		if err := l.validate(); err != nil {
+			invalid(key, "%s", err)
+		}
+	}
+
+	if c.PAC.ProxyAddress != "" {
+		if _, _, err := net.SplitHostPort(c.PAC.ProxyAddress); err != nil {
+			invalid("pac.proxy-address", "must be host:port")
+		}
+	}
+	for i, tc := range c.PAC.Templates {
+		key := fmt.Sprintf("pac.templates.%d", i)
+		if tc.File == "" {
+			invalid(key+".file", "required")
+		}
+		for j, cidr := range tc.ClientCIDR {
+			if _, err := parsePrefix(cidr); err != nil {
+				invalid(fmt.Sprintf("%s.client-cidr.%d", key, j), "invalid cidr '%s'", cidr)
+			}
+		}
+	}
+
+	if err := c.DNS.validate(); err != nil {
+		invalid("dns", "%s", err)
+	}
+
+	if c.HealthCheck.Interval > 0 && c.HealthCheck.Target == "" {
+		invalid("health-check.target", "required if interval set")
+	}
+	if c.HealthCheck.Target != "" {
+		if _, _, err := net.SplitHostPort(c.HealthCheck.Target); err != nil {
+			invalid("health-check.target", "must be host:port")
+		}
+	}
+	if c.HealthCheck.MaxFails < 0 {
+		invalid("health-check.max-fails", "must not be negative")
+	}
+
+	if (c.Username == "") != (c.Password == "") {
+		invalid("username", "username and password must be set together")
+	}
+
+	seen := map[string]bool{}
+	for i, user := range c.Users {
+		key := fmt.Sprintf("users.%d", i)
+		if user.Username == "" {
+			invalid(key+".username", "required")
+		} else if seen[user.Username] {
+			invalid(key+".username", "duplicate user '%s'", user.Username)
+		}
+		if user.Password == "" {
+			invalid(key+".password", "required")
+		}
+		seen[user.Username] = true
+	}
+
+	for i, cidr := range c.ACL.Allow {
+		if _, err := parsePrefix(cidr); err != nil {
+			invalid(fmt.Sprintf("acl.allow.%d", i), "invalid cidr '%s'", cidr)
+		}
+	}
+	for i, cidr := range c.ACL.Deny {
+		if _, err := parsePrefix(cidr); err != nil {
+			invalid(fmt.Sprintf("acl.deny.%d", i), "invalid cidr '%s'", cidr)
+		}
+	}
+	for i, port := range c.ACL.Ports {
+		if port == 0 {
+			invalid(fmt.Sprintf("acl.ports.%d", i), "invalid port 0")
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"connect-timeout", c.ConnectTimeout},
+		{"handshake-timeout", c.HandshakeTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"udp-idle-timeout", c.UDPIdleTimeout},
+		{"max-session-duration", c.MaxSessionDuration},
+		{"health-check.interval", c.HealthCheck.Interval},
+		{"health-check.timeout", c.HealthCheck.Timeout},
+		{"health-check.backoff", c.HealthCheck.Backoff},
+		{"health-check.max-backoff", c.HealthCheck.MaxBackoff},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			invalid(d.key, "must not be negative")
+		}
+	}
+
+	if c.RateLimit < 0 {
+		invalid("rate-limit", "must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// ServerOptions options of server from config
+func (c *Config) ServerOptions() ([]ServerOption, error) {
+	acl, err := NewACL(c.ACL.Allow, c.ACL.Deny, c.ACL.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]string{}
+	for _, user := range c.Users {
+		users[user.Username] = user.Password
+	}
+
+	return []ServerOption{
+		WithListenPort(c.ListenPort),
+		WithListenAddress(c.ListenAddress),
+		WithUsername(c.Username),
+		WithPassword(c.Password),
+		WithUsers(users),
+		WithACL(acl),
+		WithConnectTimeout(c.ConnectTimeout),
+		WithHandshakeTimeout(c.HandshakeTimeout),
+		WithIdleTimeout(c.IdleTimeout),
+		WithUDPIdleTimeout(c.UDPIdleTimeout),
+		WithMaxSessionDuration(c.MaxSessionDuration),
+		WithRateLimit(c.RateLimit),
+		WithProxy(c.Proxy),
+		WithProxyTLS(c.ProxyTLS),
+		WithUpstreams(c.Upstreams),
+		WithUpstreamStrategy(c.UpstreamStrategy),
+		WithHealthCheck(c.HealthCheck),
+		WithRules(c.Rules),
+		WithRuleSets(c.RuleSets),
+		WithDefaultOutbound(c.DefaultOutbound),
+		WithDNS(c.DNS),
+		WithCertFile(c.CertFile),
+		WithKeyFile(c.KeyFile),
+		WithTLS(c.TLS),
+		WithACME(c.ACME),
+		WithHTTP3(c.HTTP3),
+		WithSOCKS(c.SOCKS),
+		WithProxyProtocol(c.ProxyProtocol),
+		WithForwardedHeaders(c.ForwardedHeaders),
+		WithPretendAsWeb(c.PretendAsWeb),
+		WithPAC(c.PAC),
+		WithListeners(c.Listeners),
+		WithAdminAddress(c.AdminAddress),
+	}, nil
+}
+
+func validateProxyURL(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "h2", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("scheme '%s' not supported", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return errors.New("host required")
+	}
+
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapErrors errors of errors.Join
+func unwrapErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,120 @@
+package httpproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(require *require.Assertions, name string, content string) string {
+	file := filepath.Join(os.TempDir(), name)
+	require.Nil(os.WriteFile(file, []byte(content), 0644))
+	return file
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	require := require.New(t)
+
+	file := writeConfig(require, "httpproxy-test.yaml", `
+listen-address: 127.0.0.1:8080
+idle-timeout: 1m
+users:
+  - username: foo
+    password: bar
+acl:
+  deny: [10.0.0.0/8]
+  ports: [443]
+`)
+	defer os.Remove(file)
+
+	c := DefaultConfig()
+	require.Nil(LoadConfig(file, &c))
+	require.Equal("127.0.0.1:8080", c.ListenAddress)
+	require.Equal(time.Minute, c.IdleTimeout)
+	require.Equal(time.Second*5, c.ConnectTimeout)
+	require.Equal([]UserConfig{{Username: "foo", Password: "bar"}}, c.Users)
+	require.Equal([]uint16{443}, c.ACL.Ports)
+	require.False(c.SOCKS)
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	require := require.New(t)
+
+	file := writeConfig(require, "httpproxy-test.toml", `
+listen-address = "127.0.0.1:8080"
+idle-timeout = "1m"
+
+[[users]]
+username = "foo"
+password = "bar"
+`)
+	defer os.Remove(file)
+
+	c := DefaultConfig()
+	require.Nil(LoadConfig(file, &c))
+	require.Equal("127.0.0.1:8080", c.ListenAddress)
+	require.Equal(time.Minute, c.IdleTimeout)
+	require.Equal([]UserConfig{{Username: "foo", Password: "bar"}}, c.Users)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	require := require.New(t)
+
+	file := writeConfig(require, "httpproxy-test.yaml", `
+log-level: info
+unknown-key: 1
+`)
+	defer os.Remove(file)
+
+	c := DefaultConfig()
+	err := LoadConfig(file, &c)
+	require.ErrorContains(err, "line 3: field unknown-key not found")
+
+	file = writeConfig(require, "httpproxy-test.yaml", `
+log-level: info
+acl:
+  allow:
+    - 10.0.0.0/8
+    - not-a-cidr
+proxy: ftp://127.0.0.1
+`)
+
+	c = DefaultConfig()
+	err = LoadConfig(file, &c)
+	require.ErrorContains(err, file+":6: acl.allow.1: invalid cidr 'not-a-cidr'")
+	require.ErrorContains(err, file+":7: proxy: scheme 'ftp' not supported")
+	require.Equal(DefaultConfig().LogLevel, c.LogLevel)
+
+	file = writeConfig(require, "httpproxy-test.yaml", `
+upstreams:
+  - url: socks5://127.0.0.1:1080
+rules:
+  - port: ['80', 'x']
+    outbound: upstream-0
+  - domain-suffix: [a.com]
+    outbound: unknown
+`)
+
+	c = DefaultConfig()
+	err = LoadConfig(file, &c)
+	require.ErrorContains(err, file+":5: rules.0: port 'x' invalid")
+	require.ErrorContains(err, file+":8: rules.1.outbound: unknown outbound 'unknown'")
+}
+
+func TestACL(t *testing.T) {
+	require := require.New(t)
+
+	acl, err := NewACL([]string{"127.0.0.0/8", "::1"}, []string{"127.0.0.2"}, []uint16{443})
+	require.Nil(err)
+
+	require.True(acl.AllowClient("127.0.0.1:1234"))
+	require.True(acl.AllowClient("[::1]:1234"))
+	require.False(acl.AllowClient("127.0.0.2:1234"))
+	require.False(acl.AllowClient("10.0.0.1:1234"))
+
+	require.True(acl.AllowDestination("example.com:443"))
+	require.False(acl.AllowDestination("example.com:80"))
+}
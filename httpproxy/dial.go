@@ -0,0 +1,158 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/isayme/go-logger"
+)
+
+var errRouteRejected = errors.New("rejected by route rule")
+var errUDPNotSupported = errors.New("udp only supported by direct outbound")
+
+// tunnelRequest what a tunnel is for
+type tunnelRequest struct {
+	seqId string
+	// destination host:port
+	dest string
+	// client remote address
+	client string
+	// authenticated username, empty if no auth
+	user string
+}
+
+// dial destination of tunnel, by outbound of route rules. release must be called when conn done.
+func (s *Server) dial(st *serverState, req *tunnelRequest) (net.Conn, func(), error) {
+	ctx := context.Background()
+	if st.options.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.options.connectTimeout)
+		defer cancel()
+	}
+
+	outbound, r := st.router.routeRule(req)
+
+	var conn net.Conn
+	var release func()
+	var err error
+	switch outbound {
+	case OutboundReject:
+		return nil, nil, errRouteRejected
+	case OutboundDirect:
+		conn, err = st.resolver.DialContext(ctx, "tcp", req.dest)
+		release = func() {}
+	case OutboundUpstreams:
+		conn, release, err = s.dialUpstreams(ctx, st.upstreams, req)
+	default:
+		conn, release, err = s.dialUpstream(ctx, st.upstreams, st.upstreams.get(outbound), req)
+	}
+	if err != nil || r == nil || r.proxyProtocol == 0 {
+		return conn, release, err
+	}
+
+	// client address to remote, before any tunnel bytes
+	var tlvs []ProxyTLV
+	if r.proxyProtocolUserTLV != 0 && req.user != "" {
+		tlvs = append(tlvs, ProxyTLV{Type: r.proxyProtocolUserTLV, Value: []byte(req.user)})
+	}
+	src, dst := proxyHeaderAddrs(req, conn, outbound == OutboundDirect)
+	if _, err := conn.Write(encodeProxyHeader(r.proxyProtocol, src, dst, tlvs)); err != nil {
+		conn.Close()
+		release()
+		return nil, nil, fmt.Errorf("write PROXY protocol header fail: %w", err)
+	}
+	logger.Debugw("PROXY protocol header sent", "version", r.proxyProtocol, "addr", req.dest, "seqId", req.seqId)
+
+	return conn, release, nil
+}
+
+// dialUDP udp flow to destination, by outbound of route rules, upstreams not supported
+func (s *Server) dialUDP(st *serverState, req *tunnelRequest) (net.Conn, error) {
+	ctx := context.Background()
+	if st.options.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.options.connectTimeout)
+		defer cancel()
+	}
+
+	if err := s.routeUDP(st, req); err != nil {
+		return nil, err
+	}
+
+	return st.resolver.DialContext(ctx, "udp", req.dest)
+}
+
+// routeUDP nil if udp destination routed to direct, the only outbound supporting udp
+func (s *Server) routeUDP(st *serverState, req *tunnelRequest) error {
+	switch st.router.route(req) {
+	case OutboundReject:
+		return errRouteRejected
+	case OutboundDirect:
+		return nil
+	default:
+		return errUDPNotSupported
+	}
+}
+
+// dialUpstreams dial by upstream strategy, try next upstream if fail
+func (s *Server) dialUpstreams(ctx context.Context, pool *upstreamPool, req *tunnelRequest) (net.Conn, func(), error) {
+	var tried []*upstream
+	var lastErr error
+	for {
+		up := pool.pick(req.dest, req.client, tried)
+		if up == nil {
+			return nil, nil, lastErr
+		}
+		tried = append(tried, up)
+
+		conn, release, err := s.dialUpstream(ctx, pool, up, req)
+		if err == nil {
+			return conn, release, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, nil, lastErr
+		}
+	}
+}
+
+func (s *Server) dialUpstream(ctx context.Context, pool *upstreamPool, up *upstream, req *tunnelRequest) (net.Conn, func(), error) {
+	logger.Debugw("dial via upstream", "addr", req.dest, "upstream", up.name, "url", up.address, "strategy", pool.strategy, "seqId", req.seqId)
+
+	up.dials.Add(1)
+	up.active.Add(1)
+	conn, err := up.dial(ctx, "tcp", req.dest)
+	if err != nil {
+		up.active.Add(-1)
+		if upstreamFailed(ctx, err) {
+			up.reportFailure(pool.healthCheck)
+		}
+		logger.Warnw("dial via upstream fail", "addr", req.dest, "upstream", up.name, "err", err, "seqId", req.seqId)
+		return nil, nil, err
+	}
+
+	up.reportSuccess()
+	return conn, func() { up.active.Add(-1) }, nil
+}
+
+// upstreamFailed err of dial is upstream's fault, like connect, tls or auth.
+// destination refused by upstream or client gone not counted, or one bad
+// destination would eject healthy upstreams.
+func upstreamFailed(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var statusErr *ConnectStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusProxyAuthRequired
+	}
+
+	// reply of socks5 upstream, only known by text of x/net/proxy
+	return !strings.Contains(err.Error(), "unknown error ")
+}
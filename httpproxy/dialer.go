@@ -21,6 +21,11 @@ func NewProxyContextDialer(d proxy.Dialer) ProxyContextDialer {
  * from golang.org/x/net/proxy.dialContext
  */
 func (d ProxyContextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// native, no goroutine left running after ctx done
+	if cd, ok := d.d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+
 	var (
 		conn net.Conn
 		done = make(chan struct{}, 1)
@@ -0,0 +1,349 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udp payload size advertised by edns0, avoids fragmentation
+const dnsUDPSize = 1232
+
+// max size of dns message over tcp, tls and https
+const dnsMaxSize = 65535
+
+// dnsServer a dns server queried by exchanging messages
+type dnsServer interface {
+	exchange(ctx context.Context, msg []byte) ([]byte, error)
+	String() string
+}
+
+// newDNSServer server of address:
+// '1.1.1.1' or 'udp://1.1.1.1:53' plain dns, falls back to tcp if truncated,
+// 'tcp://1.1.1.1:53' plain dns over tcp,
+// 'tls://1.1.1.1:853' dns over tls (RFC 7858),
+// 'https://1.1.1.1/dns-query' dns over https (RFC 8484).
+// conf verifies certificates of tls and https servers, nil for system roots.
+func newDNSServer(address string, conf *tls.Config) (dnsServer, error) {
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("dns server '%s' invalid: %w", address, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("dns server '%s' invalid: no host", address)
+	}
+
+	hostport := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = u.Hostname()
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &streamDNSServer{network: "udp", address: hostport("53")}, nil
+	case "tcp":
+		return &streamDNSServer{network: "tcp", address: hostport("53")}, nil
+	case "tls":
+		return &streamDNSServer{network: "tcp", address: hostport("853"), tlsConfig: conf}, nil
+	case "https":
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = conf
+		return &httpsDNSServer{url: u.String(), client: &http.Client{Transport: transport}}, nil
+	default:
+		return nil, fmt.Errorf("dns server '%s' invalid: scheme must be udp, tcp, tls or https", address)
+	}
+}
+
+// streamDNSServer plain dns over udp or tcp, or dns over tls
+type streamDNSServer struct {
+	network string
+	address string
+	// nil if not tls
+	tlsConfig *tls.Config
+}
+
+func (s *streamDNSServer) String() string {
+	if s.tlsConfig != nil {
+		return "tls://" + s.address
+	}
+	return s.network + "://" + s.address
+}
+
+// exchange a new connection each query
+func (s *streamDNSServer) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if s.tlsConfig != nil {
+		tlsConn := tls.Client(conn, s.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if s.network == "udp" {
+		resp, err := exchangeUDP(conn, msg)
+		if err != nil || !dnsTruncated(resp) {
+			return resp, err
+		}
+		// retry by tcp if truncated
+		tcp := &streamDNSServer{network: "tcp", address: s.address}
+		return tcp.exchange(ctx, msg)
+	}
+
+	return exchangeStream(conn, msg)
+}
+
+// exchangeUDP responses of other ids ignored, like late ones of previous queries
+func exchangeUDP(conn net.Conn, msg []byte) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && bytes.Equal(buf[:2], msg[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream message prefixed with 2 bytes length
+func exchangeStream(conn net.Conn, msg []byte) ([]byte, error) {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// httpsDNSServer dns over https, POST of 'application/dns-message'
+type httpsDNSServer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpsDNSServer) String() string {
+	return s.url
+}
+
+func (s *httpsDNSServer) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxSize))
+}
+
+// newDNSQuery query of name and type, recursion desired, with edns0
+func newDNSQuery(name string, qtype dnsmessage.Type) ([]byte, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:               uint16(rand.Uint32()),
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
+
+// dnsTruncated whether TC bit set
+func dnsTruncated(msg []byte) bool {
+	return len(msg) >= 3 && msg[2]&0x02 != 0
+}
+
+// dnsAnswer addresses of response, and how long they can be cached
+type dnsAnswer struct {
+	ips []netip.Addr
+	ttl time.Duration
+	// NXDOMAIN, name not exists at all
+	notFound bool
+}
+
+// parseDNSResponse answer of query. ttl is min ttl of answer records, or of soa if no data.
+// error if response not of query, or server failed.
+func parseDNSResponse(query, msg []byte, qtype dnsmessage.Type) (*dnsAnswer, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !h.Response || h.ID != binary.BigEndian.Uint16(query) {
+		return nil, errors.New("response id mismatch")
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	var qp dnsmessage.Parser
+	if _, err := qp.Start(query); err != nil {
+		return nil, err
+	}
+	want, err := qp.Question()
+	if err != nil {
+		return nil, err
+	}
+	if q.Type != want.Type || !strings.EqualFold(q.Name.String(), want.Name.String()) {
+		return nil, errors.New("response question mismatch")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return &dnsAnswer{notFound: true, ttl: negativeTTL(&p)}, nil
+	default:
+		return nil, fmt.Errorf("server responded %s", h.RCode)
+	}
+
+	answer := &dnsAnswer{}
+	minTTL := uint32(0)
+	for i := 0; ; i++ {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case rh.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			answer.ips = append(answer.ips, netip.AddrFrom4(r.A))
+		case rh.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			answer.ips = append(answer.ips, netip.AddrFrom16(r.AAAA).Unmap())
+		default:
+			// like cnames of chain, their ttl also counts
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+		if i == 0 || rh.TTL < minTTL {
+			minTTL = rh.TTL
+		}
+	}
+
+	if len(answer.ips) == 0 {
+		answer.ttl = negativeTTL(&p)
+		return answer, nil
+	}
+	answer.ttl = time.Duration(minTTL) * time.Second
+	return answer, nil
+}
+
+// negativeTTL ttl of soa in authorities (RFC 2308), -1 if none. parser after answers.
+func negativeTTL(p *dnsmessage.Parser) time.Duration {
+	if err := p.SkipAllAnswers(); err != nil {
+		return -1
+	}
+	for {
+		rh, err := p.AuthorityHeader()
+		if err != nil {
+			return -1
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return -1
+			}
+			continue
+		}
+
+		soa, err := p.SOAResource()
+		if err != nil {
+			return -1
+		}
+		return time.Duration(min(rh.TTL, soa.MinTTL)) * time.Second
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,40 +20,35 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func createProxy(require *require.Assertions, opts ...ServerOption) (chan struct{}, func()) {
+// startProxy start proxy server, listening when returned
+func startProxy(require *require.Assertions, opts ...ServerOption) *Server {
 	proxy, err := NewServer(opts...)
 	require.Nil(err)
 
-	address := proxy.options.listenAddress
-	if address == "" {
-		address = fmt.Sprintf(":%d", proxy.options.listenPort)
-	}
+	ln, err := net.Listen("tcp", proxy.listenAddress())
+	require.Nil(err)
 
-	proxy.httpServer = &http.Server{
-		Addr:    address,
-		Handler: proxy,
+	errs := make(chan error, 1)
+	go func() { errs <- proxy.Serve(ln) }()
+	select {
+	case <-proxy.listening:
+	case err := <-errs:
+		require.Nil(err)
 	}
 
-	ch := make(chan struct{}, 1)
-	ln, err := net.Listen("tcp", address)
-	require.Nil(err)
+	return proxy
+}
 
-	ch <- struct{}{}
+func createProxy(require *require.Assertions, opts ...ServerOption) (chan struct{}, func() error) {
+	proxy := startProxy(require, opts...)
 
-	certFile := proxy.options.certFile
-	keyFile := proxy.options.keyFile
-	if certFile != "" && keyFile != "" {
-		logger.Infow("start listen with tls ...", "addr", address)
-		go proxy.httpServer.ServeTLS(ln, certFile, keyFile)
-	} else {
-		logger.Infow("start listen ...", "addr", address)
-		go proxy.httpServer.Serve(ln)
-	}
+	ch := make(chan struct{}, 1)
+	ch <- struct{}{}
 
-	return ch, func() {
+	return ch, func() error {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
-		proxy.Shutdown(ctx)
+		return proxy.Shutdown(ctx)
 	}
 }
 
@@ -231,3 +229,337 @@ func TestMock2(t *testing.T) {
 	require.Equal(404, resp.StatusCode)
 	require.Equal("404 page not found\n", string(body))
 }
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	require := require.New(t)
+
+	// upstream server only reads, never writes
+	sinkLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer sinkLn.Close()
+
+	go func() {
+		for {
+			conn, err := sinkLn.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	ch, stop := createProxy(require, WithListenAddress(":8080"), WithIdleTimeout(time.Millisecond*200))
+	defer stop()
+	<-ch
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", sinkLn.Addr().String(), sinkLn.Addr().String())
+	_, err = conn.Write([]byte(req))
+	require.Nil(err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{})
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	// remote -> client stalled, client -> remote active, tunnel must keep alive
+	for i := 0; i < 6; i++ {
+		time.Sleep(time.Millisecond * 100)
+		_, err = conn.Write([]byte("ping"))
+		require.Nil(err)
+	}
+
+	// no bytes in either direction, tunnel closed
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+}
+
+func TestTunnelMaxSessionDuration(t *testing.T) {
+	require := require.New(t)
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer echoLn.Close()
+
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	ch, stop := createProxy(require, WithListenAddress(":8080"), WithMaxSessionDuration(time.Millisecond*300))
+	defer stop()
+	<-ch
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoLn.Addr().String(), echoLn.Addr().String())
+	_, err = conn.Write([]byte(req))
+	require.Nil(err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{})
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	start := time.Now()
+	buf := make([]byte, 4)
+	for {
+		_, err = conn.Write([]byte("ping"))
+		if err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	require.Less(time.Since(start), time.Second)
+}
+
+func startEchoServer(require *require.Assertions) net.Listener {
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return echoLn
+}
+
+// startHalfCloseServer server writing "bye" and half closing first, then sending data of client got until eof
+func startHalfCloseServer(require *require.Assertions) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("bye"))
+				conn.(*net.TCPConn).CloseWrite()
+				data, _ := io.ReadAll(conn)
+				received <- string(data)
+			}()
+		}
+	}()
+
+	return ln, received
+}
+
+func dialTunnel(require *require.Assertions, proxyAddr string, addr string) net.Conn {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.Nil(err)
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	_, err = conn.Write([]byte(req))
+	require.Nil(err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{})
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	return conn
+}
+
+func TestShutdownDrainTunnels(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	ch, stop := createProxy(require, WithListenAddress(":8080"))
+	<-ch
+
+	conn := dialTunnel(require, "127.0.0.1:8080", echoLn.Addr().String())
+
+	go func() {
+		time.Sleep(time.Millisecond * 300)
+		conn.Close()
+	}()
+
+	start := time.Now()
+	require.Nil(stop())
+	require.GreaterOrEqual(time.Since(start), time.Millisecond*300)
+}
+
+func TestShutdownDropTunnels(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	proxy := startProxy(require, WithListenAddress(":8080"))
+
+	conn := dialTunnel(require, "127.0.0.1:8080", echoLn.Addr().String())
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	err := proxy.Shutdown(ctx)
+	require.ErrorIs(err, context.DeadlineExceeded)
+	require.Contains(err.Error(), "drop 1 tunnels")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+}
+
+func TestReload(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello upstream"))
+	}))
+	defer upstream.Close()
+
+	proxy := startProxy(require, WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "bar"}))
+	defer proxy.Shutdown(context.Background())
+
+	get := func(user string, password string) int {
+		client := &http.Client{
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: "127.0.0.1:8080", User: url.UserPassword(user, password)}),
+			},
+		}
+
+		resp, err := client.Get(upstream.URL)
+		require.Nil(err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(200, get("foo", "bar"))
+
+	// tunnel established before reload keeps running
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+	auth := base64.StdEncoding.EncodeToString([]byte("foo:bar"))
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", echoLn.Addr(), echoLn.Addr(), auth)
+	_, err = conn.Write([]byte(req))
+	require.Nil(err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{})
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	// invalid options rejected, old ones kept
+	err = proxy.Reload(WithListenAddress(":8080"), WithProxy("ftp://127.0.0.1:21"))
+	require.NotNil(err)
+	require.Equal(200, get("foo", "bar"))
+
+	// tls or listeners of bound sockets can not change
+	certDir := t.TempDir()
+	writeCertPair(require, certDir, "a", "a.example.com")
+	err = proxy.Reload(WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "bar"}), WithTLS(ServerTLSConfig{CertDir: certDir}))
+	require.ErrorContains(err, "tls of listener 'main' enabled or disabled")
+	err = proxy.Reload(WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "bar"}), WithListeners([]ListenerConfig{{Name: "other", Address: "127.0.0.1:8081"}}))
+	require.ErrorContains(err, "restart required")
+	require.Equal(200, get("foo", "bar"))
+
+	// listen or admin address can not change, rejected not ignored
+	err = proxy.Reload(WithListenAddress(":8081"), WithUsers(map[string]string{"foo": "baz"}))
+	require.ErrorContains(err, "listen address changed, restart required")
+	err = proxy.Reload(WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "baz"}), WithAdminAddress("127.0.0.1:1088"))
+	require.ErrorContains(err, "admin address changed, restart required")
+	require.Equal(200, get("foo", "bar"))
+
+	err = proxy.Reload(WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "baz"}))
+	require.Nil(err)
+	require.Equal(407, get("foo", "bar"))
+	require.Equal(200, get("foo", "baz"))
+
+	// by SIGHUP and admin api at the same time
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for range 4 {
+		wg.Go(func() {
+			errs <- proxy.Reload(WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "baz"}))
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(err)
+	}
+	require.Equal(200, get("foo", "baz"))
+
+	_, err = conn.Write([]byte("ping"))
+	require.Nil(err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.Nil(err)
+	require.Equal("ping", string(buf))
+}
+
+func TestAdminReload(t *testing.T) {
+	require := require.New(t)
+
+	reloaded := 0
+	proxy := startProxy(require, WithListenAddress(":8080"), WithReloadFunc(func() error {
+		reloaded++
+		if reloaded > 1 {
+			return errors.New("bad config")
+		}
+		return nil
+	}))
+	defer proxy.Shutdown(context.Background())
+
+	admin := httptest.NewServer(proxy.newAdminServer("").Handler)
+	defer admin.Close()
+
+	resp, err := http.Post(admin.URL+"/reload", "", nil)
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(200, resp.StatusCode)
+
+	resp, err = http.Post(admin.URL+"/reload", "", nil)
+	require.Nil(err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(400, resp.StatusCode)
+	require.Contains(string(body), "bad config")
+	require.Equal(2, reloaded)
+}
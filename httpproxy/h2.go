@@ -0,0 +1,240 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// idle time of h2 conn to upstream before closed
+const h2IdleTimeout = time.Minute * 5
+
+func init() {
+	proxy.RegisterDialerType("h2", func(u *url.URL, d proxy.Dialer) (proxy.Dialer, error) {
+		return NewH2Proxy(u, d, nil)
+	})
+}
+
+// H2Proxy dial through https proxy by CONNECT streams of a few long-lived http/2 conns.
+// a new conn is opened only if existing ones are at stream limit or going away.
+type H2Proxy struct {
+	u         *url.URL
+	d         proxy.ContextDialer
+	tlsConfig *tls.Config
+	transport *http2.Transport
+
+	mu    sync.Mutex
+	conns []*http2.ClientConn
+	// closed when dial of new conn done, nil if not dialing
+	dialing chan struct{}
+}
+
+// NewH2Proxy dialer of url like 'h2://host:port', conf nil for default
+func NewH2Proxy(u *url.URL, d proxy.Dialer, conf *tls.Config) (*H2Proxy, error) {
+	if u.Scheme != "h2" {
+		return nil, fmt.Errorf("schema '%s' invalid", u.Scheme)
+	}
+
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	conf = conf.Clone()
+	if conf.ServerName == "" {
+		conf.ServerName = u.Hostname()
+	}
+	conf.NextProtos = []string{http2.NextProtoTLS}
+
+	transport, err := http2.ConfigureTransports(&http.Transport{})
+	if err != nil {
+		return nil, err
+	}
+	// ping to detect dead conns
+	transport.ReadIdleTimeout = time.Second * 30
+	transport.PingTimeout = time.Second * 15
+	transport.IdleConnTimeout = h2IdleTimeout
+
+	hp := &H2Proxy{
+		u:         u,
+		tlsConfig: conf,
+		transport: transport,
+	}
+
+	if d == nil {
+		d = proxy.Direct
+	}
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		hp.d = cd
+	} else {
+		hp.d = NewProxyContextDialer(d)
+	}
+
+	return hp, nil
+}
+
+func (hp *H2Proxy) Dial(network, addr string) (net.Conn, error) {
+	return hp.DialContext(context.Background(), network, addr)
+}
+
+// DialContext open CONNECT stream to addr, ctx covers getting conn and CONNECT response
+func (hp *H2Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	cc, err := hp.clientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// stream lives after ctx done, so canceled by its own ctx
+	streamCtx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodConnect, "https://"+addr, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Host = addr
+	req.ContentLength = -1
+	if hp.u.User != nil {
+		password, _ := hp.u.User.Password()
+		auth := fmt.Sprintf("%s:%s", hp.u.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := cc.RoundTrip(req)
+	if !stop() && err == nil {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, contextErr(ctx, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, &ConnectStatusError{StatusCode: resp.StatusCode}
+	}
+
+	return newStreamConn(resp.Body, pw, cancel, nil, nil), nil
+}
+
+// clientConn usable conn with a stream reserved, dial new one if none.
+// one conn dialed at a time, outside of lock, others wait for it.
+func (hp *H2Proxy) clientConn(ctx context.Context) (*http2.ClientConn, error) {
+	for {
+		hp.mu.Lock()
+		cc, idle := hp.reserveConn()
+		dialing := hp.dialing
+		dial := cc == nil && dialing == nil
+		if dial {
+			dialing = make(chan struct{})
+			hp.dialing = dialing
+		}
+		hp.mu.Unlock()
+		// outside of lock, shutdown may block on write of conn
+		shutdownConns(ctx, idle)
+
+		if cc != nil {
+			return cc, nil
+		}
+		if !dial {
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		cc, err := hp.dialConn(ctx)
+
+		hp.mu.Lock()
+		if err == nil {
+			hp.conns = append(hp.conns, cc)
+		}
+		hp.dialing = nil
+		close(dialing)
+		hp.mu.Unlock()
+
+		return cc, err
+	}
+}
+
+// reserveConn existing conn with a stream reserved, nil if none, hp.mu held.
+// idle conns removed, to be shut down by caller after unlock.
+func (hp *H2Proxy) reserveConn() (*http2.ClientConn, []*http2.ClientConn) {
+	// drop conns closed or going away, their running streams not affected.
+	// close idle conns too, in case transport does not
+	var idle []*http2.ClientConn
+	now := time.Now()
+	hp.conns = slices.DeleteFunc(hp.conns, func(cc *http2.ClientConn) bool {
+		if !cc.CanTakeNewRequest() {
+			return true
+		}
+		if state := cc.State(); state.StreamsActive == 0 && !state.LastIdle.IsZero() && now.Sub(state.LastIdle) > h2IdleTimeout {
+			idle = append(idle, cc)
+			return true
+		}
+		return false
+	})
+
+	for _, cc := range hp.conns {
+		if cc.ReserveNewRequest() {
+			return cc, idle
+		}
+	}
+
+	return nil, idle
+}
+
+// shutdownConns graceful close of conns, no streams running on idle ones
+func shutdownConns(ctx context.Context, conns []*http2.ClientConn) {
+	for _, cc := range conns {
+		cc.Shutdown(ctx)
+	}
+}
+
+// dialConn new conn with a stream reserved
+func (hp *H2Proxy) dialConn(ctx context.Context) (*http2.ClientConn, error) {
+	conn, err := hp.d.DialContext(ctx, "tcp", hp.u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, hp.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("upstream '%s' not support h2, negotiated '%s'", hp.u.Host, proto)
+	}
+
+	cc, err := hp.transport.NewClientConn(tlsConn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !cc.ReserveNewRequest() {
+		cc.Close()
+		return nil, errors.New("new h2 conn can not take request")
+	}
+
+	return cc, nil
+}
@@ -0,0 +1,290 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// startH2Upstream https server handling CONNECT streams over h2, counting conns
+func startH2Upstream(require *require.Assertions, maxStreams int) (*httptest.Server, *atomic.Int64) {
+	var conns atomic.Int64
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.ProtoMajor != 2 {
+			w.WriteHeader(400)
+			return
+		}
+
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(502)
+			return
+		}
+		defer remote.Close()
+
+		w.WriteHeader(200)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+
+		go func() {
+			io.Copy(remote, r.Body)
+			closeWrite(remote)
+		}()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := remote.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.Config.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: maxStreams}
+	upstream.Config.IdleTimeout = time.Millisecond * 200
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.StartTLS()
+
+	return upstream, &conns
+}
+
+func echo(require *require.Assertions, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	require.Nil(err)
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(err)
+	require.Equal(msg, string(buf))
+}
+
+func TestH2Proxy(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	upstream, conns := startH2Upstream(require, 2)
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.Nil(err)
+	u.Scheme = "h2"
+
+	hp, err := NewH2Proxy(u, nil, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(err)
+
+	// streams multiplexed, new conn only if at stream limit
+	var tunnels []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := hp.Dial("tcp", echoLn.Addr().String())
+		require.Nil(err)
+		echo(require, conn, "hello")
+		tunnels = append(tunnels, conn)
+	}
+	require.Equal(int64(2), conns.Load())
+
+	// read deadline
+	tunnels[0].SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err = tunnels[0].Read(make([]byte, 1))
+	require.True(isTimeout(err))
+	tunnels[0].SetReadDeadline(time.Time{})
+	echo(require, tunnels[0], "again")
+
+	// half close, echo server closes after eof
+	require.Nil(closeWrite(tunnels[1]))
+	_, err = tunnels[1].Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+
+	for _, conn := range tunnels {
+		conn.Close()
+	}
+
+	// idle conns get GOAWAY, new conn dialed
+	time.Sleep(time.Millisecond * 500)
+	conn, err := hp.Dial("tcp", echoLn.Addr().String())
+	require.Nil(err)
+	echo(require, conn, "after goaway")
+	conn.Close()
+	require.Equal(int64(3), conns.Load())
+}
+
+func TestH2ProxyUpstream(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	upstream, _ := startH2Upstream(require, 100)
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.Nil(err)
+	u.Scheme = "h2"
+
+	up, err := newUpstream(0, UpstreamConfig{URL: u.String(), TLS: UpstreamTLSConfig{Insecure: true}}, proxy.Direct)
+	require.Nil(err)
+
+	conn, err := up.dialer.DialContext(t.Context(), "tcp", echoLn.Addr().String())
+	require.Nil(err)
+	defer conn.Close()
+	echo(require, conn, "hello")
+
+	// https upstream without h2 fails
+	server, err := NewServer()
+	require.Nil(err)
+	https := httptest.NewTLSServer(server)
+	defer https.Close()
+
+	u, err = url.Parse(https.URL)
+	require.Nil(err)
+	u.Scheme = "h2"
+	up, err = newUpstream(0, UpstreamConfig{URL: u.String(), TLS: UpstreamTLSConfig{Insecure: true}}, proxy.Direct)
+	require.Nil(err)
+	_, err = up.dialer.DialContext(t.Context(), "tcp", echoLn.Addr().String())
+	require.NotNil(err)
+}
+
+func TestH2Connect(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	proxy := startTLSProxy(require)
+	defer proxy.Shutdown(context.Background())
+
+	u, err := url.Parse("h2://127.0.0.1:8080")
+	require.Nil(err)
+	hp, err := NewH2Proxy(u, nil, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(err)
+
+	// many tunnels on one conn
+	var tunnels []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := hp.Dial("tcp", echoLn.Addr().String())
+		require.Nil(err)
+		echo(require, conn, "hello")
+		tunnels = append(tunnels, conn)
+	}
+	require.Len(hp.conns, 1)
+	require.Equal(3, proxy.sessionCount())
+
+	// half close, echo server closes after eof
+	require.Nil(closeWrite(tunnels[0]))
+	_, err = tunnels[0].Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+
+	// remote half closes first, stream can not be half closed by handler, so ended
+	halfLn, _ := startHalfCloseServer(require)
+	defer halfLn.Close()
+	halfConn, err := hp.Dial("tcp", halfLn.Addr().String())
+	require.Nil(err)
+	halfConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := io.ReadAll(halfConn)
+	require.Nil(err)
+	require.Equal("bye", string(data))
+	tunnels = append(tunnels, halfConn)
+
+	for _, conn := range tunnels {
+		conn.Close()
+	}
+	require.Eventually(func() bool {
+		return proxy.sessionCount() == 0
+	}, time.Second, time.Millisecond*10)
+
+	// http/1.1 CONNECT on same tls listener still works
+	conn, err := NewHttpProxyWithTLS(&url.URL{Scheme: "https", Host: "127.0.0.1:8080"}, nil, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(err)
+	c, err := conn.Dial("tcp", echoLn.Addr().String())
+	require.Nil(err)
+	echo(require, c, "http/1.1")
+	c.Close()
+}
+
+// blockedDialer dial blocked until released
+type blockedDialer struct {
+	released chan struct{}
+	dials    atomic.Int64
+}
+
+func (d *blockedDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *blockedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	select {
+	case <-d.released:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return proxy.Direct.DialContext(ctx, network, addr)
+}
+
+// conn dialed once while others wait, lock not held by dial
+func TestH2ProxyDialing(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	upstream, conns := startH2Upstream(require, 100)
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.Nil(err)
+	u.Scheme = "h2"
+	d := &blockedDialer{released: make(chan struct{})}
+	hp, err := NewH2Proxy(u, d, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(err)
+
+	dialed := make(chan net.Conn)
+	go func() {
+		conn, err := hp.Dial("tcp", echoLn.Addr().String())
+		require.Nil(err)
+		dialed <- conn
+	}()
+	require.Eventually(func() bool {
+		return d.dials.Load() == 1
+	}, time.Second, time.Millisecond*10)
+
+	// waiting for dialing conn, not blocked by lock
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = hp.DialContext(ctx, "tcp", echoLn.Addr().String())
+	require.ErrorIs(err, context.DeadlineExceeded)
+
+	go func() {
+		conn, err := hp.Dial("tcp", echoLn.Addr().String())
+		require.Nil(err)
+		dialed <- conn
+	}()
+	close(d.released)
+	for range 2 {
+		conn := <-dialed
+		echo(require, conn, "hello")
+		conn.Close()
+	}
+	require.Equal(int64(1), d.dials.Load())
+	require.Equal(int64(1), conns.Load())
+}
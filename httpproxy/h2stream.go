@@ -0,0 +1,437 @@
+//go:build go1.27 && !http2legacy
+
+package httpproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// id of the only stream of h2Stream
+const h2StreamID = 1
+
+// initial flow control window of h2, ours never changed
+const h2InitialWindow = 65535
+
+// h2Stream client of one extended CONNECT stream (RFC 8441) on its own h2 conn.
+// built by go1.27, x/net http2 wraps the h2 client of net/http, whose ClientConn
+// rejects header ':protocol', whatever go of go.mod is, so frames are handled here.
+// built by older go or with tag http2legacy, ClientConn of x/net is used, see h2stream_xnet.go.
+type h2Stream struct {
+	conn   net.Conn
+	framer *http2.Framer
+	// write of framer
+	wmu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// send windows of stream and conn
+	window        int32
+	connWindow    int32
+	initialWindow int32
+	maxFrameSize  uint32
+	err           error
+
+	// data received not read yet, bounded by our window, so read loop never blocks on it
+	rbuf bytes.Buffer
+	rerr error
+
+	respOnce sync.Once
+	resp     chan *http.Response
+
+	endOnce sync.Once
+}
+
+// dialH2Stream send extended CONNECT request r over conn, conn negotiated h2 already.
+// interrupt by conn deadline.
+func dialH2Stream(conn net.Conn, r *http.Request) (*h2Stream, *http.Response, error) {
+	s := &h2Stream{
+		conn:          conn,
+		framer:        http2.NewFramer(conn, conn),
+		window:        h2InitialWindow,
+		connWindow:    h2InitialWindow,
+		initialWindow: h2InitialWindow,
+		maxFrameSize:  16384,
+		resp:          make(chan *http.Response, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, nil, err
+	}
+	if err := s.framer.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0}); err != nil {
+		return nil, nil, err
+	}
+
+	// server support shown in its first settings
+	frame, err := s.framer.ReadFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok || settings.IsAck() {
+		return nil, nil, errors.New("h2 server preface invalid")
+	}
+	if v, ok := settings.Value(http2.SettingEnableConnectProtocol); !ok || v != 1 {
+		return nil, nil, errExtendedConnectNotSupported
+	}
+	if err := s.handleSettings(settings); err != nil {
+		return nil, nil, err
+	}
+
+	block, err := h2ExtendedConnectHeaders(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(block)) > s.maxFrameSize {
+		return nil, nil, errors.New("h2 request headers too large")
+	}
+	err = s.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2StreamID,
+		BlockFragment: block,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go s.readLoop()
+
+	resp := <-s.resp
+	if resp == nil {
+		return nil, nil, s.error()
+	}
+	return s, resp, nil
+}
+
+// h2ExtendedConnectHeaders hpack encoded headers of request, hop-by-hop ones dropped
+func h2ExtendedConnectHeaders(r *http.Request) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+
+	write := func(name, value string) error {
+		return enc.WriteField(hpack.HeaderField{Name: name, Value: value})
+	}
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	fields := [][2]string{
+		{":method", http.MethodConnect},
+		{":protocol", r.Header.Get(":protocol")},
+		{":scheme", scheme},
+		{":authority", r.Host},
+		{":path", r.URL.RequestURI()},
+	}
+	for _, f := range fields {
+		if err := write(f[0], f[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	header := r.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	header.Del(":protocol")
+	header.Del("Host")
+	for k, values := range header {
+		for _, v := range values {
+			if err := write(strings.ToLower(k), v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *h2Stream) readLoop() {
+	for {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		if err := s.handleFrame(frame); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *h2Stream) handleFrame(frame http2.Frame) error {
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		return s.handleSettings(f)
+	case *http2.MetaHeadersFrame:
+		if f.StreamID != h2StreamID {
+			return nil
+		}
+		if err := s.handleHeaders(f); err != nil {
+			return err
+		}
+		if f.StreamEnded() {
+			s.endRead(io.EOF)
+		}
+	case *http2.DataFrame:
+		if f.StreamID != h2StreamID {
+			return nil
+		}
+		data := f.Data()
+		s.mu.Lock()
+		if s.rbuf.Len()+len(data) > h2InitialWindow {
+			s.mu.Unlock()
+			return errors.New("h2 flow control window exceeded")
+		}
+		// dropped if body closed, window still given back
+		discard := s.rerr != nil
+		if !discard {
+			s.rbuf.Write(data)
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+
+		// window of padding given back now, of data after read
+		update := f.Length - uint32(len(data))
+		if discard {
+			update = f.Length
+		}
+		if err := s.writeWindowUpdate(update); err != nil {
+			return err
+		}
+		if f.StreamEnded() {
+			s.endRead(io.EOF)
+		}
+	case *http2.WindowUpdateFrame:
+		s.mu.Lock()
+		if f.StreamID == 0 {
+			s.connWindow += int32(f.Increment)
+		} else if f.StreamID == h2StreamID {
+			s.window += int32(f.Increment)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case *http2.PingFrame:
+		if !f.IsAck() {
+			s.wmu.Lock()
+			defer s.wmu.Unlock()
+			return s.framer.WritePing(true, f.Data)
+		}
+	case *http2.RSTStreamFrame:
+		if f.StreamID == h2StreamID {
+			return fmt.Errorf("h2 stream reset: %v", f.ErrCode)
+		}
+	case *http2.GoAwayFrame:
+		if f.LastStreamID < h2StreamID {
+			return fmt.Errorf("h2 conn go away: %v", f.ErrCode)
+		}
+	}
+
+	return nil
+}
+
+func (s *h2Stream) handleSettings(f *http2.SettingsFrame) error {
+	s.mu.Lock()
+	err := f.ForeachSetting(func(setting http2.Setting) error {
+		switch setting.ID {
+		case http2.SettingInitialWindowSize:
+			// change of initial window applies to open streams
+			s.window += int32(setting.Val) - s.initialWindow
+			s.initialWindow = int32(setting.Val)
+		case http2.SettingMaxFrameSize:
+			s.maxFrameSize = setting.Val
+		}
+		return nil
+	})
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.framer.WriteSettingsAck()
+}
+
+// handleHeaders response of stream, later ones are trailers and ignored
+func (s *h2Stream) handleHeaders(f *http2.MetaHeadersFrame) error {
+	status, err := strconv.Atoi(f.PseudoValue("status"))
+	if err != nil {
+		return fmt.Errorf("h2 response status '%s' invalid", f.PseudoValue("status"))
+	}
+	// informational
+	if status < 200 {
+		return nil
+	}
+
+	s.respOnce.Do(func() {
+		header := http.Header{}
+		for _, hf := range f.RegularFields() {
+			header.Add(hf.Name, hf.Value)
+		}
+		s.resp <- &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Proto:      "HTTP/2.0",
+			ProtoMajor: 2,
+			Header:     header,
+			Body:       &h2StreamBody{s: s},
+		}
+	})
+	return nil
+}
+
+// fail stop stream with err, response nil if not got yet
+func (s *h2Stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	if s.rerr == nil {
+		s.rerr = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.respOnce.Do(func() {
+		close(s.resp)
+	})
+}
+
+// endRead end read side with err after buffered data, kept if ended already
+func (s *h2Stream) endRead(err error) {
+	s.mu.Lock()
+	if s.rerr == nil {
+		s.rerr = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// writeWindowUpdate give back n of both conn and stream windows
+func (s *h2Stream) writeWindowUpdate(n uint32) error {
+	if n == 0 {
+		return nil
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.framer.WriteWindowUpdate(0, n); err != nil {
+		return err
+	}
+	return s.framer.WriteWindowUpdate(h2StreamID, n)
+}
+
+func (s *h2Stream) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Write send data as flow control allows
+func (s *h2Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.err == nil && (s.window <= 0 || s.connWindow <= 0) {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		n := min(int32(len(p)), s.window, s.connWindow, int32(s.maxFrameSize))
+		s.window -= n
+		s.connWindow -= n
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		err := s.framer.WriteData(h2StreamID, false, p[:n])
+		s.wmu.Unlock()
+		if err != nil {
+			return written, err
+		}
+
+		written += int(n)
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close end stream of write side
+func (s *h2Stream) Close() error {
+	var err error
+	s.endOnce.Do(func() {
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		err = s.framer.WriteData(h2StreamID, true, nil)
+	})
+	return err
+}
+
+// h2StreamBody response body of h2Stream, window given back as data read
+type h2StreamBody struct {
+	s *h2Stream
+}
+
+func (b *h2StreamBody) Read(p []byte) (int, error) {
+	s := b.s
+	s.mu.Lock()
+	for s.rbuf.Len() == 0 && s.rerr == nil {
+		s.cond.Wait()
+	}
+	if s.rbuf.Len() == 0 {
+		err := s.rerr
+		s.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.rbuf.Read(p)
+	// no more data if ended, window not needed
+	ended := s.rerr != nil
+	s.mu.Unlock()
+
+	if ended {
+		return n, nil
+	}
+	return n, s.writeWindowUpdate(uint32(n))
+}
+
+// Close drop data not read, later reads fail
+func (b *h2StreamBody) Close() error {
+	s := b.s
+	s.mu.Lock()
+	n := s.rbuf.Len()
+	s.rbuf.Reset()
+	ended := s.rerr != nil
+	if !ended || s.rerr == io.EOF {
+		s.rerr = io.ErrClosedPipe
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if ended {
+		return nil
+	}
+	return s.writeWindowUpdate(uint32(n))
+}
@@ -0,0 +1,35 @@
+//go:build go1.27 && !http2legacy
+
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestH2StreamInitialWindow(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	writer := http2.NewFramer(&buf, nil)
+	writer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 100000})
+	writer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 200000})
+
+	s := &h2Stream{
+		framer:        http2.NewFramer(io.Discard, &buf),
+		window:        h2InitialWindow,
+		initialWindow: h2InitialWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for range 2 {
+		frame, err := s.framer.ReadFrame()
+		require.Nil(err)
+		require.Nil(s.handleSettings(frame.(*http2.SettingsFrame)))
+	}
+	require.Equal(int32(200000), s.window)
+}
@@ -0,0 +1,56 @@
+//go:build !go1.27 || http2legacy
+
+package httpproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// dialH2Stream send extended CONNECT request r over conn, conn negotiated h2 already.
+// ClientConn of x/net sends ':protocol' when built by its own transport, see h2stream.go for go1.27.
+// interrupt by conn deadline.
+func dialH2Stream(conn net.Conn, r *http.Request) (io.WriteCloser, *http.Response, error) {
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := r.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	header.Del("Host")
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+		Body:       pr,
+		Host:       r.Host,
+	}
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		// error of x/net not exported
+		if strings.Contains(err.Error(), "extended connect not supported") {
+			return nil, nil, errExtendedConnectNotSupported
+		}
+		return nil, nil, err
+	}
+
+	return pw, resp, nil
+}
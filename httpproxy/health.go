@@ -0,0 +1,146 @@
+package httpproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/isayme/go-logger"
+)
+
+// HealthCheckConfig health check of upstreams
+type HealthCheckConfig struct {
+	// interval of active probes, 0 disables them
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+	// host:port probed through each upstream, by CONNECT for http upstreams
+	Target string `yaml:"target" toml:"target"`
+	// timeout of a probe
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// consecutive failures before ejecting upstream, 0 disables ejection
+	MaxFails int `yaml:"max-fails" toml:"max-fails"`
+	// ejection duration, doubled on each consecutive ejection
+	Backoff    time.Duration `yaml:"backoff" toml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max-backoff" toml:"max-backoff"`
+}
+
+// DefaultHealthCheckConfig passive ejection enabled, active probes disabled
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Timeout:    time.Second * 5,
+		MaxFails:   3,
+		Backoff:    time.Second * 10,
+		MaxBackoff: time.Minute * 5,
+	}
+}
+
+// upstreamHealth health state of an upstream
+type upstreamHealth struct {
+	mu sync.Mutex
+	// consecutive failures
+	failures int
+	// consecutive ejections without success in between
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// available whether upstream can be picked
+func (up *upstream) available(now time.Time) bool {
+	up.health.mu.Lock()
+	defer up.health.mu.Unlock()
+
+	return !now.Before(up.health.ejectedUntil)
+}
+
+func (up *upstream) reportSuccess() {
+	up.health.mu.Lock()
+	defer up.health.mu.Unlock()
+
+	up.health.failures = 0
+	if up.health.ejections > 0 && !time.Now().Before(up.health.ejectedUntil) {
+		up.health.ejections = 0
+		logger.Infow("upstream readmitted", "upstream", up.name)
+	}
+}
+
+func (up *upstream) reportFailure(hc HealthCheckConfig) {
+	up.dialFailures.Add(1)
+
+	up.health.mu.Lock()
+	defer up.health.mu.Unlock()
+
+	up.health.failures++
+	if hc.MaxFails <= 0 || up.health.failures < hc.MaxFails {
+		return
+	}
+
+	backoff := hc.Backoff
+	for i := 0; i < up.health.ejections && (hc.MaxBackoff <= 0 || backoff < hc.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if hc.MaxBackoff > 0 && backoff > hc.MaxBackoff {
+		backoff = hc.MaxBackoff
+	}
+
+	up.health.failures = 0
+	up.health.ejections++
+	up.health.ejectedUntil = time.Now().Add(backoff)
+	logger.Warnw("upstream ejected", "upstream", up.name, "backoff", backoff.String(), "ejections", up.health.ejections)
+}
+
+// probe dial target through upstream
+func (up *upstream) probe(hc HealthCheckConfig) {
+	ctx := context.Background()
+	if hc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hc.Timeout)
+		defer cancel()
+	}
+
+	conn, err := up.dialer.DialContext(ctx, "tcp", hc.Target)
+	if err != nil {
+		logger.Debugw("upstream probe fail", "upstream", up.name, "target", hc.Target, "err", err)
+		up.reportFailure(hc)
+		return
+	}
+	conn.Close()
+
+	up.reportSuccess()
+}
+
+// startHealthCheck probe upstreams periodically until stopHealthCheck
+func (pool *upstreamPool) startHealthCheck() {
+	hc := pool.healthCheck
+	if hc.Interval <= 0 || hc.Target == "" {
+		return
+	}
+
+	pool.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-pool.stop:
+				return
+			case <-ticker.C:
+			}
+
+			wg := sync.WaitGroup{}
+			for _, up := range pool.upstreams {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					up.probe(hc)
+				}()
+			}
+			wg.Wait()
+		}
+	}()
+}
+
+func (pool *upstreamPool) stopHealthCheck() {
+	if pool.stop != nil {
+		close(pool.stop)
+	}
+}
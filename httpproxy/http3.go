@@ -0,0 +1,58 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/isayme/go-logger"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listenHTTP3 serve http/3 on conn, udp of listener address, tls same as its tcp listener.
+// tunnels are CONNECT streams, handled as http/2 ones.
+func (s *Server) listenHTTP3(l *listener, conn net.PacketConn) {
+	quicConfig := &quic.Config{}
+	if s.options.handshakeTimeout > 0 {
+		quicConfig.HandshakeIdleTimeout = s.options.handshakeTimeout
+	}
+
+	l.http3Conn = conn
+	l.http3Server = &http3.Server{
+		Handler:    s,
+		TLSConfig:  http3.ConfigureTLSConfig(&tls.Config{GetConfigForClient: s.getConfigForClient(l)}),
+		QUICConfig: quicConfig,
+		// for connect-udp
+		EnableDatagrams: true,
+		ConnContext: func(ctx context.Context, _ *quic.Conn) context.Context {
+			return context.WithValue(ctx, listenerContextKey{}, l)
+		},
+	}
+
+	go func() {
+		logger.Infow("start listen http3 ...", "name", l.name, "addr", conn.LocalAddr().String())
+		if err := l.http3Server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("http3 listen fail", "err", err)
+		}
+	}()
+}
+
+// shutdownHTTP3 stop http/3 of listener, running streams wait until ctx done.
+// return channel closed when finished.
+func (s *Server) shutdownHTTP3(ctx context.Context, l *listener) <-chan struct{} {
+	done := make(chan struct{})
+	if l.http3Server == nil {
+		close(done)
+		return done
+	}
+
+	go func() {
+		defer close(done)
+		l.http3Server.Shutdown(ctx)
+		l.http3Conn.Close()
+	}()
+
+	return done
+}
@@ -0,0 +1,108 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP3Connect(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	proxy := startTLSProxy(require, WithHTTP3(true))
+	defer proxy.Shutdown(context.Background())
+
+	// alt-svc on tcp listener
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://127.0.0.1:8080/")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Contains(resp.Header.Get("Alt-Svc"), `h3=":8080"`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, "127.0.0.1:8080", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	require.Nil(err)
+	defer conn.CloseWithError(0, "")
+
+	cc := (&http3.Transport{}).NewClientConn(conn)
+
+	// many tunnels on one conn
+	for _, msg := range []string{"hello", "world"} {
+		str, err := cc.OpenRequestStream(ctx)
+		require.Nil(err)
+
+		addr := echoLn.Addr().String()
+		err = str.SendRequestHeader(&http.Request{
+			Method: http.MethodConnect,
+			Host:   addr,
+			URL:    &url.URL{Host: addr},
+			Header: http.Header{},
+		})
+		require.Nil(err)
+
+		resp, err := str.ReadResponse()
+		require.Nil(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+
+		_, err = str.Write([]byte(msg))
+		require.Nil(err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(str, buf)
+		require.Nil(err)
+		require.Equal(msg, string(buf))
+
+		// half close, echo server closes after eof
+		require.Nil(str.Close())
+		_, err = str.Read(buf)
+		require.Equal(io.EOF, err)
+	}
+
+	// remote half closes first, stream of response ends, request still relayed
+	halfLn, received := startHalfCloseServer(require)
+	defer halfLn.Close()
+
+	str, err := cc.OpenRequestStream(ctx)
+	require.Nil(err)
+	addr := halfLn.Addr().String()
+	err = str.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Host:   addr,
+		URL:    &url.URL{Host: addr},
+		Header: http.Header{},
+	})
+	require.Nil(err)
+	resp, err = str.ReadResponse()
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	str.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := io.ReadAll(str)
+	require.Nil(err)
+	require.Equal("bye", string(data))
+	_, err = str.Write([]byte("after"))
+	require.Nil(err)
+	require.Nil(str.Close())
+	select {
+	case data := <-received:
+		require.Equal("after", data)
+	case <-time.After(time.Second * 5):
+		require.Fail("request not relayed after response ended")
+	}
+
+	require.Eventually(func() bool {
+		return proxy.sessionCount() == 0
+	}, time.Second, time.Millisecond*10)
+}
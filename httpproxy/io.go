@@ -1,7 +1,6 @@
 package httpproxy
 
 import (
-	"crypto/tls"
 	"net"
 )
 
@@ -9,14 +8,11 @@ type CloseWriter interface {
 	CloseWrite() error
 }
 
-func mustGetWriteCloser(conn net.Conn) CloseWriter {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		return tcpConn
+// closeWrite half close conn if supported, otherwise close it
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(CloseWriter); ok {
+		return cw.CloseWrite()
 	}
 
-	if tlsConn, ok := conn.(*tls.Conn); ok {
-		return tlsConn
-	}
-
-	panic("conn not convert to WriteCloser")
+	return conn.Close()
 }
@@ -0,0 +1,391 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/isayme/go-logger"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// protocols a listener serves
+const (
+	// http/1.1, and http/2 with tls
+	ProtocolHTTP = "http"
+	// socks4, socks4a and socks5, sniffed on the same port as http
+	ProtocolSOCKS = "socks"
+	// http/3 on udp port of address, tls required
+	ProtocolHTTP3 = "http3"
+)
+
+var protocols = []string{ProtocolHTTP, ProtocolSOCKS, ProtocolHTTP3}
+
+// prefix of unix socket address, like 'unix:/run/httpproxy.sock'
+const unixAddressPrefix = "unix:"
+
+// ListenerConfig another address to listen on, with its own policy.
+// route rules and upstreams are shared by all listeners.
+type ListenerConfig struct {
+	Name string `yaml:"name" toml:"name"`
+	// host:port, or 'unix:/path/to.sock' for unix socket
+	Address string `yaml:"address" toml:"address"`
+
+	// tls if set
+	CertFile string `yaml:"cert-file" toml:"cert-file"`
+	KeyFile  string `yaml:"key-file" toml:"key-file"`
+	// pem ca bundle, client certificates required and verified by it if set
+	ClientCAFile string `yaml:"client-ca-file" toml:"client-ca-file"`
+	// sni certificates and tls policy
+	TLS ServerTLSConfig `yaml:"tls" toml:"tls"`
+
+	// auth users, empty for no auth
+	Users        []UserConfig `yaml:"users" toml:"users"`
+	ACL          ACLConfig    `yaml:"acl" toml:"acl"`
+	PretendAsWeb bool         `yaml:"pretend-as-web" toml:"pretend-as-web"`
+	// http, socks, http3, default http. socks not with tls
+	Protocols []string `yaml:"protocols" toml:"protocols"`
+}
+
+func (c ListenerConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("name required")
+	}
+	if c.Name == mainFDName || c.Name == adminFDName {
+		return fmt.Errorf("name '%s' reserved", c.Name)
+	}
+
+	network, address := splitListenAddress(c.Address)
+	if address == "" {
+		return errors.New("address required")
+	}
+	if network == "tcp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("address '%s' invalid, must be host:port or unix:/path", c.Address)
+		}
+	}
+
+	for _, user := range c.Users {
+		if user.Username == "" || user.Password == "" {
+			return errors.New("username and password of users required")
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert-file and key-file must be set together")
+	}
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	tlsEnabled := c.CertFile != "" || c.TLS.CertDir != "" || c.TLS.ACME
+	if c.ClientCAFile != "" && !tlsEnabled {
+		return errors.New("client-ca-file requires cert-file and key-file, or tls.cert-dir")
+	}
+
+	for _, protocol := range c.Protocols {
+		if !slices.Contains(protocols, protocol) {
+			return fmt.Errorf("protocol '%s' invalid, must be one of %s", protocol, strings.Join(protocols, ", "))
+		}
+	}
+	// sniffed before tls handshake, socks would skip tls and client certificate check
+	if slices.Contains(c.Protocols, ProtocolSOCKS) && (tlsEnabled || c.ClientCAFile != "") {
+		return errors.New("protocol socks not supported with tls or client-ca-file")
+	}
+	if slices.Contains(c.Protocols, ProtocolHTTP3) && (!tlsEnabled || network != "tcp") {
+		return errors.New("protocol http3 requires cert-file and key-file or tls.cert-dir, and not unix socket")
+	}
+
+	if _, err := NewACL(c.ACL.Allow, c.ACL.Deny, c.ACL.Ports); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// splitListenAddress network and address of listen address
+func splitListenAddress(address string) (string, string) {
+	if path, ok := strings.CutPrefix(address, unixAddressPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+// listenerPolicy who a listener serves and what, reloaded with state
+type listenerPolicy struct {
+	// username to password, empty if no auth
+	users        map[string]string
+	acl          *ACL
+	pretendAsWeb bool
+
+	http  bool
+	socks bool
+	http3 bool
+
+	// nil if not tls
+	tlsConfig *tls.Config
+	// nil if no cert file or cert dir
+	certs *certManager
+	// nil if not using acme
+	acme *acmeManager
+}
+
+// newListenerPolicy policy of listener config, acm nil if acme not set
+func newListenerPolicy(c ListenerConfig, acm *acmeManager) (*listenerPolicy, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	pol := &listenerPolicy{
+		users:        map[string]string{},
+		pretendAsWeb: c.PretendAsWeb,
+	}
+	for _, user := range c.Users {
+		pol.users[user.Username] = user.Password
+	}
+
+	acl, err := NewACL(c.ACL.Allow, c.ACL.Deny, c.ACL.Ports)
+	if err != nil {
+		return nil, err
+	}
+	pol.acl = acl
+
+	protocols := c.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{ProtocolHTTP}
+	}
+	pol.http = slices.Contains(protocols, ProtocolHTTP)
+	pol.socks = slices.Contains(protocols, ProtocolSOCKS)
+	pol.http3 = slices.Contains(protocols, ProtocolHTTP3)
+
+	if c.TLS.ACME {
+		if acm == nil {
+			return nil, errors.New("tls.acme requires acme domains")
+		}
+		pol.acme = acm
+	}
+
+	if c.CertFile != "" || c.TLS.CertDir != "" || pol.acme != nil {
+		if err := pol.setTLS(c.CertFile, c.KeyFile, c.TLS); err != nil {
+			return nil, err
+		}
+
+		if c.ClientCAFile != "" {
+			data, err := os.ReadFile(c.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in client ca file '%s'", c.ClientCAFile)
+			}
+			pol.tlsConfig.ClientCAs = pool
+			pol.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return pol, nil
+}
+
+// setTLS serve tls with certificates of cert file, cert dir and acme, by tls policy
+func (pol *listenerPolicy) setTLS(certFile, keyFile string, c ServerTLSConfig) error {
+	conf, err := c.policy()
+	if err != nil {
+		return err
+	}
+
+	if certFile != "" || c.CertDir != "" {
+		certs, err := newCertManager(certFile, keyFile, c)
+		if err != nil {
+			return err
+		}
+		pol.certs = certs
+	}
+	conf.GetCertificate = pol.getCertificate
+
+	pol.tlsConfig = conf
+	return nil
+}
+
+// getCertificate certificate of files matching sni first, then of acme domains, then fallback of files
+func (pol *listenerPolicy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if pol.certs != nil {
+		if cert := pol.certs.match(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+		if pol.acme == nil || !pol.acme.hasDomain(hello.ServerName) {
+			return pol.certs.getCertificate(hello)
+		}
+	}
+	return pol.acme.getCertificate(hello)
+}
+
+// authRequired whether users of listener must auth
+func (pol *listenerPolicy) authRequired() bool {
+	return len(pol.users) > 0
+}
+
+// checkUser whether password of user matches, shared by http and socks
+func (pol *listenerPolicy) checkUser(username, password string) bool {
+	expected, ok := pol.users[username]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// listener an address server listens on, main one of listen address has empty name
+type listener struct {
+	name    string
+	network string
+	address string
+
+	// bound or inherited
+	ln         net.Listener
+	httpServer *http.Server
+	// nil if http3 disabled
+	http3Server *http3.Server
+	http3Conn   net.PacketConn
+}
+
+type listenerContextKey struct{}
+
+// listenerFromContext listener conn of ctx accepted by, nil if unknown
+func listenerFromContext(ctx context.Context) *listener {
+	l, _ := ctx.Value(listenerContextKey{}).(*listener)
+	return l
+}
+
+// policy of listener in state, main one if l nil.
+// nil if listener not in state, like removed by reload.
+func (st *serverState) policy(l *listener) *listenerPolicy {
+	if l == nil {
+		return st.listeners[""]
+	}
+	return st.listeners[l.name]
+}
+
+// newListener listener of address, protocols and tls by its policy in state
+func (s *Server) newListener(name string, address string) *listener {
+	network, address := splitListenAddress(address)
+	l := &listener{
+		name:    name,
+		network: network,
+		address: address,
+	}
+
+	// http/2 only with tls, tunnels are CONNECT streams
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+
+	l.httpServer = &http.Server{
+		Addr:              address,
+		Handler:           s,
+		Protocols:         protocols,
+		ReadHeaderTimeout: s.options.handshakeTimeout,
+		TLSConfig:         &tls.Config{GetConfigForClient: s.getConfigForClient(l)},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return proxyConnContext(context.WithValue(ctx, listenerContextKey{}, l), conn)
+		},
+	}
+
+	return l
+}
+
+// getConfigForClient tls config of listener in current state, certificates and client cas change on reload
+func (s *Server) getConfigForClient(l *listener) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		pol := s.state.Load().policy(l)
+		if pol == nil || pol.tlsConfig == nil {
+			return nil, errors.New("no certificate")
+		}
+		// tls-alpn-01 of ca, without client certificate
+		if pol.acme != nil && isACMEChallenge(hello) {
+			return pol.acme.TLSConfig(), nil
+		}
+		return pol.tlsConfig, nil
+	}
+}
+
+// listen bind address of listener, and udp of http3 if enabled.
+// sockets inherited of its name used instead if any.
+func (s *Server) listen(l *listener, inherited *inheritedSockets) error {
+	name := l.name
+	if name == "" {
+		name = mainFDName
+	}
+
+	if l.ln == nil {
+		l.ln = inherited.listener(name)
+	}
+	if l.ln == nil {
+		if l.network == "unix" {
+			// stale socket of last run
+			if err := os.Remove(l.address); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+
+		ln, err := net.Listen(l.network, l.address)
+		if err != nil {
+			return err
+		}
+		l.ln = ln
+	}
+
+	if pol := s.state.Load().policy(l); pol.tlsConfig != nil && pol.http3 {
+		conn := inherited.packetConn(name)
+		if conn == nil {
+			var err error
+			if conn, err = net.ListenPacket("udp", l.address); err != nil {
+				return err
+			}
+		}
+		s.listenHTTP3(l, conn)
+	}
+
+	return nil
+}
+
+// serve accept conns of listener, socks handshakes go to socks server, others to http server
+func (s *Server) serve(l *listener) error {
+	ln := newSniffListener(l.ln, s, l)
+
+	if s.state.Load().policy(l).tlsConfig != nil {
+		logger.Infow("start listen with tls ...", "name", l.name, "addr", ln.Addr().String())
+		return l.httpServer.ServeTLS(ln, "", "")
+	} else {
+		logger.Infow("start listen ...", "name", l.name, "addr", ln.Addr().String())
+		return l.httpServer.Serve(ln)
+	}
+}
+
+// listenersChanged error if listeners of st differ from old in what reload can not apply.
+// sockets, and whether they serve tls or http3, are fixed once bound.
+func (st *serverState) listenersChanged(old *serverState) error {
+	if !slices.EqualFunc(old.options.listeners, st.options.listeners, func(a, b ListenerConfig) bool {
+		return a.Name == b.Name && a.Address == b.Address
+	}) {
+		return errors.New("listeners added, removed or their address changed")
+	}
+
+	for name, pol := range st.listeners {
+		oldPol := old.listeners[name]
+		if name == "" {
+			name = mainFDName
+		}
+		if (pol.tlsConfig == nil) != (oldPol.tlsConfig == nil) {
+			return fmt.Errorf("tls of listener '%s' enabled or disabled", name)
+		}
+		if pol.http3 != oldPol.http3 {
+			return fmt.Errorf("http3 of listener '%s' enabled or disabled", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newSelfSignedCert certificate of 127.0.0.1 for both server and client auth, its own ca
+func newSelfSignedCert(require *require.Assertions) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestListeners(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	cert := newSelfSignedCert(require)
+	certFile, keyFile := writeCertFiles(require, cert)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	socketFile := filepath.Join(t.TempDir(), "httpproxy.sock")
+	server := startProxy(require, WithListenAddress(":8080"), WithSOCKS(true), WithUsers(map[string]string{"foo": "bar"}), WithListeners([]ListenerConfig{
+		{Name: "local", Address: "unix:" + socketFile, Protocols: []string{ProtocolHTTP}},
+		{Name: "mtls", Address: "127.0.0.1:8081", CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile},
+	}))
+	defer server.Shutdown(context.Background())
+
+	connect := func(conn net.Conn) int {
+		_, err := conn.Write([]byte("CONNECT " + echoLn.Addr().String() + " HTTP/1.1\r\n\r\n"))
+		require.Nil(err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.Nil(err)
+		return resp.StatusCode
+	}
+
+	// main listener requires auth
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+	require.Equal(http.StatusProxyAuthRequired, connect(conn))
+
+	// unix socket without auth
+	conn, err = net.Dial("unix", socketFile)
+	require.Nil(err)
+	defer conn.Close()
+	require.Equal(http.StatusOK, connect(conn))
+	echo(require, conn, "hello")
+
+	// socks disabled, handshake taken as http
+	conn, err = net.Dial("unix", socketFile)
+	require.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{socks5Version, 1, socks5MethodNoAuth, '\r', '\n'})
+	require.Nil(err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(err)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// mtls without auth, socks not served without client certificate
+	conn, err = net.Dial("tcp", "127.0.0.1:8081")
+	require.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+	require.Nil(err)
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NotNil(err)
+
+	// mtls without auth, client certificate required
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(readFile(require, certFile)))
+	tlsConn, err := tls.Dial("tcp", "127.0.0.1:8081", &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})
+	require.Nil(err)
+	defer tlsConn.Close()
+	require.Equal(http.StatusOK, connect(tlsConn))
+	echo(require, tlsConn, "hello")
+
+	tlsConn, err = tls.Dial("tcp", "127.0.0.1:8081", &tls.Config{RootCAs: pool})
+	if err == nil {
+		// tls 1.3 client sees alert of server on first read
+		defer tlsConn.Close()
+		_, err = tlsConn.Write([]byte("CONNECT " + echoLn.Addr().String() + " HTTP/1.1\r\n\r\n"))
+		if err == nil {
+			_, err = tlsConn.Read(make([]byte, 1))
+		}
+	}
+	require.NotNil(err)
+
+	// listener invalid
+	_, err = NewServer(WithListeners([]ListenerConfig{{Name: "bad", Address: "127.0.0.1:8082", Protocols: []string{ProtocolHTTP3}}}))
+	require.ErrorContains(err, "http3 requires cert-file")
+	_, err = NewServer(WithListeners([]ListenerConfig{{Name: "a", Address: ":8082"}, {Name: "a", Address: ":8083"}}))
+	require.ErrorContains(err, "duplicated")
+	_, err = NewServer(WithListeners([]ListenerConfig{{Name: "bad", Address: "127.0.0.1:8082", CertFile: certFile, KeyFile: keyFile,
+		ClientCAFile: certFile, Protocols: []string{ProtocolHTTP, ProtocolSOCKS}}}))
+	require.ErrorContains(err, "protocol socks not supported")
+}
+
+func readFile(require *require.Assertions, name string) string {
+	data, err := os.ReadFile(name)
+	require.Nil(err)
+	return string(data)
+}
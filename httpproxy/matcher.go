@@ -0,0 +1,174 @@
+package httpproxy
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// domainTrie match domains by labels from tld, like com -> example -> www
+type domainTrie struct {
+	root *domainNode
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	// match domain of this node
+	exact bool
+	// match sub domains of this node
+	subdomains bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &domainNode{}}
+}
+
+// insert domain pattern:
+// 'example.com' only example.com,
+// '+.example.com' example.com and its sub domains,
+// '.example.com' only sub domains,
+// '*.example.com' sub domains of one level, '*' matches a label anywhere
+func (trie *domainTrie) insert(pattern string) {
+	pattern = strings.ToLower(pattern)
+
+	exact, subdomains := true, false
+	switch {
+	case strings.HasPrefix(pattern, "+."):
+		pattern = pattern[2:]
+		subdomains = true
+	case strings.HasPrefix(pattern, "."):
+		pattern = pattern[1:]
+		exact, subdomains = false, true
+	}
+
+	pattern = strings.Trim(pattern, ".")
+	if pattern == "" {
+		return
+	}
+
+	node := trie.root
+	labels := strings.Split(pattern, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*domainNode{}
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	node.exact = node.exact || exact
+	node.subdomains = node.subdomains || subdomains
+}
+
+// match normalized domain
+func (trie *domainTrie) match(domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	return trie.root.match(strings.Split(domain, "."))
+}
+
+// match labels, last label first
+func (node *domainNode) match(labels []string) bool {
+	if len(labels) == 0 {
+		return node.exact
+	}
+	if node.subdomains {
+		return true
+	}
+
+	last := labels[len(labels)-1]
+	if child, ok := node.children[last]; ok && child.match(labels[:len(labels)-1]) {
+		return true
+	}
+	if child, ok := node.children["*"]; ok && child.match(labels[:len(labels)-1]) {
+		return true
+	}
+
+	return false
+}
+
+// ipRange ips from start to end, both included
+type ipRange struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+// ipSet match ips by sorted, merged ranges
+type ipSet struct {
+	ranges []ipRange
+}
+
+func newIPSet(prefixes []netip.Prefix) *ipSet {
+	ranges := make([]ipRange, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ranges = append(ranges, ipRange{start: prefix.Addr(), end: lastAddr(prefix)})
+	}
+
+	slices.SortFunc(ranges, func(a, b ipRange) int {
+		return a.start.Compare(b.start)
+	})
+
+	set := &ipSet{}
+	for _, r := range ranges {
+		n := len(set.ranges)
+		// merge overlapping or adjacent ranges of same family
+		if n > 0 && set.ranges[n-1].start.Is4() == r.start.Is4() {
+			last := &set.ranges[n-1]
+			next := last.end.Next()
+			if r.start.Compare(last.end) <= 0 || (next.IsValid() && r.start == next) {
+				if r.end.Compare(last.end) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		set.ranges = append(set.ranges, r)
+	}
+
+	return set
+}
+
+func (set *ipSet) contains(ip netip.Addr) bool {
+	if !ip.IsValid() || len(set.ranges) == 0 {
+		return false
+	}
+
+	// last range starting before or at ip
+	i, found := slices.BinarySearchFunc(set.ranges, ip, func(r ipRange, ip netip.Addr) int {
+		return r.start.Compare(ip)
+	})
+	if found {
+		return true
+	}
+	if i == 0 {
+		return false
+	}
+
+	r := set.ranges[i-1]
+	return r.start.Is4() == ip.Is4() && ip.Compare(r.end) <= 0
+}
+
+// lastAddr last ip of masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().As16()
+	offset := 0
+	if prefix.Addr().Is4() {
+		offset = 96
+	}
+
+	for bit := prefix.Bits() + offset; bit < 128; bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+
+	ip := netip.AddrFrom16(bytes)
+	if prefix.Addr().Is4() {
+		return ip.Unmap()
+	}
+	return ip
+}
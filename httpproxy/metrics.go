@@ -0,0 +1,119 @@
+package httpproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// upstreamStatus health and stats of upstream, for admin api
+type upstreamStatus struct {
+	Name         string     `json:"name"`
+	URL          string     `json:"url"`
+	Healthy      bool       `json:"healthy"`
+	Failures     int        `json:"failures"`
+	Ejections    int        `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	Active       int64      `json:"active"`
+	Dials        int64      `json:"dials"`
+	DialFailures int64      `json:"dialFailures"`
+}
+
+func (up *upstream) status(now time.Time) upstreamStatus {
+	up.health.mu.Lock()
+	defer up.health.mu.Unlock()
+
+	status := upstreamStatus{
+		Name:         up.name,
+		URL:          up.address,
+		Healthy:      !now.Before(up.health.ejectedUntil),
+		Failures:     up.health.failures,
+		Ejections:    up.health.ejections,
+		Active:       up.active.Load(),
+		Dials:        up.dials.Load(),
+		DialFailures: up.dialFailures.Load(),
+	}
+	if !status.Healthy {
+		ejectedUntil := up.health.ejectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+
+	return status
+}
+
+func (s *Server) upstreamStatuses() []upstreamStatus {
+	statuses := []upstreamStatus{}
+
+	pool := s.state.Load().upstreams
+	if pool == nil {
+		return statuses
+	}
+
+	now := time.Now()
+	for _, up := range pool.upstreams {
+		statuses = append(statuses, up.status(now))
+	}
+
+	return statuses
+}
+
+// writeMetrics write metrics in prometheus text format
+func (s *Server) writeMetrics(w io.Writer) {
+	metric := func(name string, typ string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("httpproxy_tunnels_active", "gauge", "Tunnels currently open.")
+	fmt.Fprintf(w, "httpproxy_tunnels_active %d\n", s.sessionCount())
+	metric("httpproxy_tunnels_total", "counter", "Tunnels opened.")
+	fmt.Fprintf(w, "httpproxy_tunnels_total %d\n", s.tunnelsTotal.Load())
+	metric("httpproxy_tunnel_bytes_total", "counter", "Bytes relayed by tunnels.")
+	fmt.Fprintf(w, "httpproxy_tunnel_bytes_total{direction=\"up\"} %d\n", s.bytesUp.Load())
+	fmt.Fprintf(w, "httpproxy_tunnel_bytes_total{direction=\"down\"} %d\n", s.bytesDown.Load())
+
+	statuses := s.upstreamStatuses()
+	if len(statuses) == 0 {
+		return
+	}
+
+	type upstreamMetric struct {
+		name  string
+		typ   string
+		help  string
+		value func(upstreamStatus) int64
+	}
+	metrics := []upstreamMetric{
+		{"httpproxy_upstream_healthy", "gauge", "Whether upstream is healthy, 0 if ejected.", func(status upstreamStatus) int64 {
+			if status.Healthy {
+				return 1
+			}
+			return 0
+		}},
+		{"httpproxy_upstream_active_tunnels", "gauge", "Tunnels currently open via upstream.", func(status upstreamStatus) int64 {
+			return status.Active
+		}},
+		{"httpproxy_upstream_ejections", "gauge", "Consecutive ejections of upstream.", func(status upstreamStatus) int64 {
+			return int64(status.Ejections)
+		}},
+		{"httpproxy_upstream_dials_total", "counter", "Dials via upstream.", func(status upstreamStatus) int64 {
+			return status.Dials
+		}},
+		{"httpproxy_upstream_dial_failures_total", "counter", "Failed dials and probes via upstream.", func(status upstreamStatus) int64 {
+			return status.DialFailures
+		}},
+	}
+
+	for _, m := range metrics {
+		metric(m.name, m.typ, m.help)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s{upstream=%s} %d\n", m.name, strconv.Quote(status.Name), m.value(status))
+		}
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
@@ -8,15 +8,43 @@ type serverOptions struct {
 
 	username string
 	password string
+	users    map[string]string
 
-	proxy          string
-	connectTimeout time.Duration
-	timeout        time.Duration
+	acl *ACL
+
+	proxy              string
+	proxyTLS           UpstreamTLSConfig
+	upstreams          []UpstreamConfig
+	upstreamStrategy   string
+	healthCheck        HealthCheckConfig
+	rules              []RuleConfig
+	ruleSets           []RuleSetConfig
+	defaultOutbound    string
+	pac                PACConfig
+	dns                DNSConfig
+	connectTimeout     time.Duration
+	handshakeTimeout   time.Duration
+	idleTimeout        time.Duration
+	udpIdleTimeout     time.Duration
+	maxSessionDuration time.Duration
+	rateLimit          int
 
 	certFile string
 	keyFile  string
+	tls      ServerTLSConfig
+	acme     ACMEConfig
+	http3    bool
+
+	socks            bool
+	proxyProtocol    ProxyProtocolConfig
+	forwardedHeaders bool
 
 	pretendAsWeb bool
+
+	listeners []ListenerConfig
+
+	adminAddress string
+	reloadFunc   func() error
 }
 
 type ServerOption interface {
@@ -61,21 +89,134 @@ func WithPassword(password string) ServerOption {
 	})
 }
 
+// WithUsers set auth users, map of username to password
+func WithUsers(users map[string]string) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.users = users
+	})
+}
+
+// WithACL set access control of clients and destination ports
+func WithACL(acl *ACL) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.acl = acl
+	})
+}
+
 func WithProxy(addr string) ServerOption {
 	return newFuncServerOption(func(o *serverOptions) {
 		o.proxy = addr
 	})
 }
 
+// WithProxyTLS set tls of https proxy
+func WithProxyTLS(c UpstreamTLSConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.proxyTLS = c
+	})
+}
+
+// WithUpstreams set upstream proxies, together with the one of WithProxy
+func WithUpstreams(upstreams []UpstreamConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.upstreams = upstreams
+	})
+}
+
+// WithUpstreamStrategy set how to pick upstream, see Strategy* constants
+func WithUpstreamStrategy(strategy string) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.upstreamStrategy = strategy
+	})
+}
+
+// WithHealthCheck set health check of upstreams
+func WithHealthCheck(hc HealthCheckConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.healthCheck = hc
+	})
+}
+
+// WithRules set route rules, first matched rule decides outbound of tunnel
+func WithRules(rules []RuleConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.rules = rules
+	})
+}
+
+// WithRuleSets set rule sets, referred by name in rules
+func WithRuleSets(ruleSets []RuleSetConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.ruleSets = ruleSets
+	})
+}
+
+// WithDefaultOutbound set outbound if no rule matched, default upstreams if any, otherwise direct
+func WithDefaultOutbound(outbound string) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.defaultOutbound = outbound
+	})
+}
+
+// WithPAC serve pac file at /proxy.pac and /wpad.dat
+func WithPAC(pac PACConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.pac = pac
+	})
+}
+
+// WithDNS resolve domains by dns servers and static hosts instead of system resolver
+func WithDNS(c DNSConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.dns = c
+	})
+}
+
 func WithConnectTimeout(timeout time.Duration) ServerOption {
 	return newFuncServerOption(func(o *serverOptions) {
 		o.connectTimeout = timeout
 	})
 }
 
+// WithTimeout set idle timeout of tunnel.
+//
+// Deprecated: use WithIdleTimeout instead.
 func WithTimeout(timeout time.Duration) ServerOption {
+	return WithIdleTimeout(timeout)
+}
+
+// WithHandshakeTimeout set timeout of reading request header (and tls handshake) from client
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.handshakeTimeout = timeout
+	})
+}
+
+// WithIdleTimeout set max time a tunnel may have no bytes in either direction
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.idleTimeout = timeout
+	})
+}
+
+// WithUDPIdleTimeout set max time a udp flow may have no datagrams in either direction
+func WithUDPIdleTimeout(timeout time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.udpIdleTimeout = timeout
+	})
+}
+
+// WithMaxSessionDuration set max lifetime of a tunnel, 0 means unlimited
+func WithMaxSessionDuration(duration time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.maxSessionDuration = duration
+	})
+}
+
+// WithRateLimit set max bytes per second of each direction of a tunnel, 0 means unlimited
+func WithRateLimit(bytesPerSecond int) ServerOption {
 	return newFuncServerOption(func(o *serverOptions) {
-		o.timeout = timeout
+		o.rateLimit = bytesPerSecond
 	})
 }
 
@@ -91,8 +232,72 @@ func WithKeyFile(keyFile string) ServerOption {
 	})
 }
 
+// WithTLS set sni certificates and tls policy of listen address
+func WithTLS(c ServerTLSConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.tls = c
+	})
+}
+
+// WithACME provision certificates of domains by acme
+func WithACME(c ACMEConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.acme = c
+	})
+}
+
+// WithHTTP3 also listen http/3 on udp of listen address, tls required
+func WithHTTP3(http3 bool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.http3 = http3
+	})
+}
+
+// WithSOCKS serve socks4, socks4a and socks5 clients on listen port too, sniffed by first byte.
+// off by default, not allowed with tls
+func WithSOCKS(socks bool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.socks = socks
+	})
+}
+
+// WithProxyProtocol read PROXY protocol header of conns from trusted load balancers
+func WithProxyProtocol(c ProxyProtocolConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.proxyProtocol = c
+	})
+}
+
+// WithForwardedHeaders add client address to X-Forwarded-For and Forwarded of plain http requests
+func WithForwardedHeaders(forwardedHeaders bool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.forwardedHeaders = forwardedHeaders
+	})
+}
+
 func WithPretendAsWeb(pretendAsWeb bool) ServerOption {
 	return newFuncServerOption(func(o *serverOptions) {
 		o.pretendAsWeb = pretendAsWeb
 	})
 }
+
+// WithListeners listen more addresses, each with its own auth, acl and protocols
+func WithListeners(listeners []ListenerConfig) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.listeners = listeners
+	})
+}
+
+// WithAdminAddress set listen address of admin api, empty to disable
+func WithAdminAddress(adminAddress string) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.adminAddress = adminAddress
+	})
+}
+
+// WithReloadFunc set func called by admin api to reload config
+func WithReloadFunc(f func() error) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.reloadFunc = f
+	})
+}
@@ -0,0 +1,219 @@
+package httpproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/isayme/go-logger"
+)
+
+// paths of pac file, served on non-proxy requests
+var pacPaths = []string{"/proxy.pac", "/wpad.dat"}
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// PACConfig proxy auto-config file
+type PACConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// host:port of proxy in pac file, default host of pac request
+	ProxyAddress string `yaml:"proxy-address" toml:"proxy-address"`
+	// domains and their sub domains, and cidrs, dialed directly by browser
+	Bypass []string `yaml:"bypass" toml:"bypass"`
+	// first template whose client cidrs match is used, builtin one otherwise
+	Templates []PACTemplateConfig `yaml:"templates" toml:"templates"`
+}
+
+// PACTemplateConfig pac template for clients, see pacData for data of template
+type PACTemplateConfig struct {
+	ClientCIDR []string `yaml:"client-cidr" toml:"client-cidr"`
+	// go text/template file
+	File string `yaml:"file" toml:"file"`
+}
+
+// pacData data of pac template
+type pacData struct {
+	// like 'PROXY 10.0.0.1:1087' or 'HTTPS 10.0.0.1:1087'
+	Proxy string
+	// host:port of proxy
+	ProxyAddress string
+	// domains bypassed
+	BypassDomains []string
+	// ipv4 cidrs bypassed
+	BypassNets []pacNet
+	// ipv6 cidrs bypassed
+	BypassNets6 []string
+}
+
+type pacNet struct {
+	// like '10.0.0.0'
+	IP string
+	// like '255.0.0.0'
+	Mask string
+}
+
+const builtinPACTemplate = `function FindProxyForURL(url, host) {
+  if (isPlainHostName(host)) {
+    return "DIRECT";
+  }
+{{- range .BypassDomains}}
+  if (dnsDomainIs(host, "{{js .}}") || dnsDomainIs(host, ".{{js .}}")) {
+    return "DIRECT";
+  }
+{{- end}}
+{{- if .BypassNets}}
+  if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+{{- range .BypassNets}}
+    if (isInNet(host, "{{.IP}}", "{{.Mask}}")) {
+      return "DIRECT";
+    }
+{{- end}}
+  }
+{{- end}}
+{{- if .BypassNets6}}
+  if (typeof isInNetEx == "function" && host.indexOf(":") >= 0) {
+{{- range .BypassNets6}}
+    if (isInNetEx(host, "{{.}}")) {
+      return "DIRECT";
+    }
+{{- end}}
+  }
+{{- end}}
+  return "{{js .Proxy}}";
+}
+`
+
+type pacTemplate struct {
+	clientCIDRs []netip.Prefix
+	tmpl        *template.Template
+}
+
+// pacGenerator render pac file for clients
+type pacGenerator struct {
+	proxyAddress string
+	// scheme of proxyAddress, by tls of main listener
+	scheme    string
+	data      pacData
+	templates []*pacTemplate
+	builtin   *template.Template
+}
+
+// newPACGenerator tls of main listener, scheme of proxy-address if set
+func newPACGenerator(c PACConfig, tls bool) (*pacGenerator, error) {
+	g := &pacGenerator{
+		proxyAddress: c.ProxyAddress,
+		scheme:       "PROXY",
+		builtin:      template.Must(template.New("builtin").Parse(builtinPACTemplate)),
+	}
+	if tls {
+		g.scheme = "HTTPS"
+	}
+
+	for _, bypass := range c.Bypass {
+		prefix, err := parsePrefix(bypass)
+		if err != nil {
+			g.data.BypassDomains = append(g.data.BypassDomains, normalizeDomain(bypass))
+			continue
+		}
+
+		if prefix.Addr().Is4() {
+			mask := net.CIDRMask(prefix.Bits(), 32)
+			g.data.BypassNets = append(g.data.BypassNets, pacNet{
+				IP:   prefix.Addr().String(),
+				Mask: net.IP(mask).String(),
+			})
+		} else {
+			g.data.BypassNets6 = append(g.data.BypassNets6, prefix.String())
+		}
+	}
+
+	for i, tc := range c.Templates {
+		clientCIDRs, err := parsePrefixes(tc.ClientCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("pac template %d: client-cidr invalid: %w", i, err)
+		}
+
+		content, err := os.ReadFile(tc.File)
+		if err != nil {
+			return nil, fmt.Errorf("pac template %d: %w", i, err)
+		}
+
+		tmpl, err := template.New(tc.File).Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("pac template %d: %w", i, err)
+		}
+
+		g.templates = append(g.templates, &pacTemplate{clientCIDRs: clientCIDRs, tmpl: tmpl})
+	}
+
+	return g, nil
+}
+
+// render pac file for client, proxy address from host of pac request if not set,
+// with scheme by tls of listener serving the request.
+func (g *pacGenerator) render(client string, host string, tls bool) ([]byte, error) {
+	data := g.data
+	data.ProxyAddress = g.proxyAddress
+	scheme := g.scheme
+	if data.ProxyAddress == "" {
+		data.ProxyAddress = host
+		scheme = "PROXY"
+		if tls {
+			scheme = "HTTPS"
+		}
+	}
+	data.Proxy = scheme + " " + data.ProxyAddress
+
+	tmpl := g.builtin
+	clientIP, _ := addrIP(client)
+	for _, t := range g.templates {
+		if len(t.clientCIDRs) == 0 || matchPrefixes(t.clientCIDRs, clientIP) {
+			tmpl = t.tmpl
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func isPACPath(path string) bool {
+	for _, p := range pacPaths {
+		if strings.EqualFold(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) servePAC(st *serverState, w http.ResponseWriter, r *http.Request, seqId string) {
+	host := r.Host
+	if host == "" {
+		host = s.listenAddress()
+	} else if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+
+	content, err := st.pac.render(r.RemoteAddr, host, r.TLS != nil)
+	if err != nil {
+		logger.Warnw("render pac fail", "client", r.RemoteAddr, "err", err, "seqId", seqId)
+		w.WriteHeader(500)
+		return
+	}
+
+	logger.Infow("serve pac", "client", r.RemoteAddr, "path", r.URL.Path, "seqId", seqId)
+	w.Header().Set("Content-Type", pacContentType)
+	w.Write(content)
+}
@@ -0,0 +1,88 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPACRender(t *testing.T) {
+	require := require.New(t)
+
+	g, err := newPACGenerator(PACConfig{
+		Bypass: []string{"Intranet.Example.com", "10.0.0.0/8", "fd00::/8"},
+	}, false)
+	require.Nil(err)
+
+	content, err := g.render("192.168.1.2:5000", "proxy.lan:1087", false)
+	require.Nil(err)
+	require.Contains(string(content), `dnsDomainIs(host, ".intranet.example.com")`)
+	require.Contains(string(content), `isInNet(host, "10.0.0.0", "255.0.0.0")`)
+	require.Contains(string(content), `isInNetEx(host, "fd00::/8")`)
+	require.Contains(string(content), `return "PROXY proxy.lan:1087";`)
+
+	g, err = newPACGenerator(PACConfig{ProxyAddress: "proxy.example.com:443"}, true)
+	require.Nil(err)
+	content, err = g.render("192.168.1.2:5000", "proxy.lan:1087", false)
+	require.Nil(err)
+	require.Contains(string(content), `return "HTTPS proxy.example.com:443";`)
+
+	// no proxy address, scheme by tls of request
+	g, err = newPACGenerator(PACConfig{}, false)
+	require.Nil(err)
+	content, err = g.render("192.168.1.2:5000", "proxy.lan:1087", true)
+	require.Nil(err)
+	require.Contains(string(content), `return "HTTPS proxy.lan:1087";`)
+}
+
+func TestPACServe(t *testing.T) {
+	require := require.New(t)
+
+	other := writeTempFile(require, `function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	defer os.Remove(other)
+	file := writeTempFile(require, `function FindProxyForURL(url, host) { return "{{.Proxy}}; DIRECT"; }`)
+	defer os.Remove(file)
+
+	certFile, keyFile := writeCertFiles(require, newSelfSignedCert(require))
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	proxy := startProxy(require, WithListenAddress(":8080"), WithPretendAsWeb(true), WithListeners([]ListenerConfig{
+		{Name: "tls", Address: "127.0.0.1:8081", CertFile: certFile, KeyFile: keyFile},
+	}), WithPAC(PACConfig{
+		Enabled: true,
+		Templates: []PACTemplateConfig{
+			{ClientCIDR: []string{"10.0.0.0/8"}, File: other},
+			{ClientCIDR: []string{"127.0.0.0/8"}, File: file},
+		},
+	}))
+	defer proxy.Shutdown(context.Background())
+
+	for _, path := range []string{"/proxy.pac", "/wpad.dat"} {
+		resp, err := http.Get("http://127.0.0.1:8080" + path)
+		require.Nil(err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(200, resp.StatusCode)
+		require.Equal(pacContentType, resp.Header.Get("Content-Type"))
+		require.Equal(`function FindProxyForURL(url, host) { return "PROXY 127.0.0.1:8080; DIRECT"; }`, string(body))
+	}
+
+	// tls listener of plain main one
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://127.0.0.1:8081/proxy.pac")
+	require.Nil(err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(`function FindProxyForURL(url, host) { return "HTTPS 127.0.0.1:8081; DIRECT"; }`, string(body))
+
+	resp, err = http.Get("http://127.0.0.1:8080/other")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(404, resp.StatusCode)
+}
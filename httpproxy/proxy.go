@@ -2,12 +2,15 @@ package httpproxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -23,52 +26,88 @@ func init() {
 
 type HttpProxy struct {
 	u *url.URL
-	d proxy.Dialer
+	// dial proxy server
+	d proxy.ContextDialer
+	// nil if http
+	tlsConfig *tls.Config
 }
 
-type httpDialer struct {
-}
-
-func (d httpDialer) Dial(network, addr string) (net.Conn, error) {
-	return net.Dial(network, addr)
-}
-
-type httpsDialer struct {
+// NewHttpProxy http proxy dialer, certificate of https proxy verified by system roots
+func NewHttpProxy(u *url.URL, d proxy.Dialer) (*HttpProxy, error) {
+	return NewHttpProxyWithTLS(u, d, nil)
 }
 
-func (d httpsDialer) Dial(network, addr string) (net.Conn, error) {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
+// NewHttpProxyWithTLS http proxy dialer, conf used for https proxy, nil for default
+func NewHttpProxyWithTLS(u *url.URL, d proxy.Dialer, conf *tls.Config) (*HttpProxy, error) {
+	hp := &HttpProxy{
+		u: u,
 	}
-	return tls.Dial(network, addr, conf)
-}
 
-func NewHttpProxy(u *url.URL, d proxy.Dialer) (*HttpProxy, error) {
 	switch u.Scheme {
 	case "http":
-		d = httpDialer{}
 	case "https":
-		d = httpsDialer{}
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" {
+			conf = conf.Clone()
+			conf.ServerName = u.Hostname()
+		}
+		hp.tlsConfig = conf
 	default:
 		return nil, fmt.Errorf("schema '%s' invalid", u.Scheme)
 	}
 
-	return &HttpProxy{
-		u: u,
-		d: d,
-	}, nil
+	if d == nil {
+		d = proxy.Direct
+	}
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		hp.d = cd
+	} else {
+		hp.d = NewProxyContextDialer(d)
+	}
+
+	return hp, nil
+}
+
+func (hp *HttpProxy) Dial(network, addr string) (net.Conn, error) {
+	return hp.DialContext(context.Background(), network, addr)
 }
 
-func (hp *HttpProxy) Dial(network, addr string) (c net.Conn, err error) {
+// DialContext dial addr through proxy by CONNECT, ctx covers dial, tls handshake and CONNECT
+func (hp *HttpProxy) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	c, err = hp.d.DialContext(ctx, "tcp", hp.u.Host)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
-		if err != nil && c != nil {
+		if err != nil {
 			c.Close()
 		}
 	}()
 
-	c, err = hp.d.Dial("tcp", hp.u.Host)
-	if err != nil {
-		return nil, err
+	// interrupt blocking io when ctx done
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			c.SetDeadline(time.Time{})
+		}
+	}()
+
+	if hp.tlsConfig != nil {
+		tlsConn := tls.Client(c, hp.tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return c, contextErr(ctx, err)
+		}
+		c = tlsConn
 	}
 
 	req := http.Request{
@@ -88,19 +127,70 @@ func (hp *HttpProxy) Dial(network, addr string) (c net.Conn, err error) {
 
 	err = req.Write(c)
 	if err != nil {
-		return nil, err
+		return c, contextErr(ctx, err)
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &req)
 	if err != nil {
-		return nil, err
+		return c, contextErr(ctx, err)
 	}
-	resp.Body.Close()
 
 	statusCode := resp.StatusCode
 	if statusCode != 200 {
-		return nil, fmt.Errorf("connect get stausCode %d", statusCode)
+		resp.Body.Close()
+		return c, &ConnectStatusError{StatusCode: statusCode}
+	}
+
+	// bytes of tunnel read together with response
+	if br.Buffered() > 0 {
+		buffered, _ := br.Peek(br.Buffered())
+		c = &prefixConn{Conn: c, prefix: bytes.Clone(buffered)}
+	}
+
+	return c, nil
+}
+
+// ConnectStatusError CONNECT to upstream proxy not answered by 200
+type ConnectStatusError struct {
+	StatusCode int
+}
+
+func (e *ConnectStatusError) Error() string {
+	return fmt.Sprintf("connect get stausCode %d", e.StatusCode)
+}
+
+// contextErr ctx error instead of deadline error if ctx done
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// conn deadline may fire a bit earlier than ctx
+	if deadline, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// a past time to interrupt blocking io
+var aLongTimeAgo = time.Unix(1, 0)
+
+// prefixConn conn read prefix first.
+// only used if there are buffered bytes, so raw conns keep splice.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
 	}
+	return c.Conn.Read(p)
+}
 
-	return
+func (c *prefixConn) CloseWrite() error {
+	return closeWrite(c.Conn)
 }
@@ -0,0 +1,89 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeProxy accept one conn and handle it
+func startFakeProxy(require *require.Assertions, handle func(conn net.Conn)) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		handle(conn)
+	}()
+
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func TestHttpProxyBufferedBytes(t *testing.T) {
+	require := require.New(t)
+
+	u := startFakeProxy(require, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		conn.Read(buf)
+		// response and first bytes of tunnel in one write
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+		io.Copy(conn, conn)
+	})
+
+	hp, err := NewHttpProxy(u, nil)
+	require.Nil(err)
+
+	conn, err := hp.DialContext(context.Background(), "tcp", "example.com:80")
+	require.Nil(err)
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(err)
+	require.Equal("hello", string(buf))
+
+	conn.Write([]byte("world"))
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(err)
+	require.Equal("world", string(buf))
+}
+
+func TestHttpProxyContextTimeout(t *testing.T) {
+	require := require.New(t)
+
+	closed := make(chan struct{})
+	u := startFakeProxy(require, func(conn net.Conn) {
+		defer conn.Close()
+		// never response
+		io.Copy(io.Discard, conn)
+		close(closed)
+	})
+
+	hp, err := NewHttpProxy(u, nil)
+	require.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	_, err = hp.DialContext(ctx, "tcp", "example.com:80")
+	require.ErrorIs(err, context.DeadlineExceeded)
+	require.Less(time.Since(start), time.Second)
+
+	// conn to proxy closed, not leaked
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		require.Fail("conn to proxy not closed")
+	}
+}
@@ -0,0 +1,431 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolConfig PROXY protocol of inbound conns
+type ProxyProtocolConfig struct {
+	// cidrs of load balancers, header parsed if conns of them send one, never for others
+	Trusted []string `yaml:"trusted" toml:"trusted"`
+}
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyHeader = errors.New("PROXY protocol header invalid")
+)
+
+const (
+	// max length of v1 header line, including CRLF
+	proxyV1MaxLen = 107
+
+	proxyV2CmdLocal = 0x00
+	proxyV2CmdProxy = 0x01
+)
+
+// type of PROXY protocol v2 TLVs
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+
+	// sub TLVs of ssl
+	ProxyTLVSSLVersion = 0x21
+	ProxyTLVSSLCN      = 0x22
+	ProxyTLVSSLCipher  = 0x23
+	ProxyTLVSSLSigAlg  = 0x24
+	ProxyTLVSSLKeyAlg  = 0x25
+)
+
+// ProxyHeader PROXY protocol header sent by load balancer before client data
+type ProxyHeader struct {
+	Version int
+	// nil if LOCAL command or protocol unknown, addresses of conn kept then
+	Source      net.Addr
+	Destination net.Addr
+	// v2 only
+	TLVs []ProxyTLV
+}
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxySSL ssl TLV, client connected to load balancer with tls
+type ProxySSL struct {
+	// bit field of client, 0x01 ssl, 0x02 cert of conn, 0x04 cert of session
+	Client byte
+	// 0 if client certificate verified
+	Verify uint32
+	TLVs   []ProxyTLV
+}
+
+// TLV value of first tlv of type
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	return findTLV(h.TLVs, typ)
+}
+
+// Authority host name client sent, like sni of tls terminated by load balancer
+func (h *ProxyHeader) Authority() string {
+	v, _ := h.TLV(ProxyTLVAuthority)
+	return string(v)
+}
+
+// ALPN protocol negotiated by client and load balancer
+func (h *ProxyHeader) ALPN() string {
+	v, _ := h.TLV(ProxyTLVALPN)
+	return string(v)
+}
+
+// SSL ssl TLV, false if absent or invalid
+func (h *ProxyHeader) SSL() (*ProxySSL, bool) {
+	v, ok := h.TLV(ProxyTLVSSL)
+	if !ok || len(v) < 5 {
+		return nil, false
+	}
+
+	tlvs, err := parseProxyTLVs(v[5:])
+	if err != nil {
+		return nil, false
+	}
+
+	return &ProxySSL{
+		Client: v[0],
+		Verify: binary.BigEndian.Uint32(v[1:5]),
+		TLVs:   tlvs,
+	}, true
+}
+
+// TLV value of first sub tlv of type
+func (s *ProxySSL) TLV(typ byte) ([]byte, bool) {
+	return findTLV(s.TLVs, typ)
+}
+
+func findTLV(tlvs []ProxyTLV, typ byte) ([]byte, bool) {
+	for _, tlv := range tlvs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+type proxyHeaderContextKey struct{}
+
+// ProxyHeaderFromContext PROXY protocol header of conn of request, nil if none
+func ProxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	h, _ := ctx.Value(proxyHeaderContextKey{}).(*ProxyHeader)
+	return h
+}
+
+// proxyConnContext context of http server conn, with PROXY protocol header if any
+func proxyConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if pc, ok := conn.(*prefixConn); ok {
+		conn = pc.Conn
+	}
+	if pc, ok := conn.(*proxyProtoConn); ok {
+		return context.WithValue(ctx, proxyHeaderContextKey{}, pc.header)
+	}
+	return ctx
+}
+
+// proxyProtoConn conn with addresses of PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+	header *ProxyHeader
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// socketLocalAddr local address of socket, not the one of PROXY protocol header
+func socketLocalAddr(conn net.Conn) net.Addr {
+	if pc, ok := conn.(*prefixConn); ok {
+		conn = pc.Conn
+	}
+	if pc, ok := conn.(*proxyProtoConn); ok {
+		conn = pc.Conn
+	}
+	return conn.LocalAddr()
+}
+
+// trustProxyHeader whether PROXY protocol header of conn from addr parsed
+func (st *serverState) trustProxyHeader(addr net.Addr) bool {
+	if len(st.proxyProtocolTrusted) == 0 {
+		return false
+	}
+
+	ip, ok := addrIP(addr.String())
+	return ok && matchPrefixes(st.proxyProtocolTrusted, ip)
+}
+
+// readProxyHeader PROXY protocol v1 or v2 header if conn starts with one, nil otherwise.
+// bytes after header are left in br.
+func readProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case proxyV1Prefix[0]:
+		if b, err := br.Peek(len(proxyV1Prefix)); err != nil || !bytes.Equal(b, proxyV1Prefix) {
+			return nil, nil
+		}
+		return readProxyHeaderV1(br)
+	case proxyV2Sig[0]:
+		if b, err := br.Peek(len(proxyV2Sig)); err != nil || !bytes.Equal(b, proxyV2Sig) {
+			return nil, nil
+		}
+		return readProxyHeaderV2(br)
+	default:
+		return nil, nil
+	}
+}
+
+// readProxyHeaderV1 like 'PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n'
+func readProxyHeaderV1(br *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: v1 line too long", errProxyHeader)
+		}
+	}
+
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: v1 line not end with CRLF", errProxyHeader)
+	}
+
+	fields := strings.Split(s, " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: v1 '%s'", errProxyHeader, s)
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+
+	header.Source = net.TCPAddrFromAddrPort(src)
+	header.Destination = net.TCPAddrFromAddrPort(dst)
+	return header, nil
+}
+
+func parseProxyV1Addr(host, port string, ipv4 bool) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil || ip.Is4() != ipv4 {
+		return netip.AddrPort{}, fmt.Errorf("%w: v1 address '%s'", errProxyHeader, host)
+	}
+	// no leading zeros
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || strconv.FormatUint(n, 10) != port {
+		return netip.AddrPort{}, fmt.Errorf("%w: v1 port '%s'", errProxyHeader, port)
+	}
+
+	return netip.AddrPortFrom(ip, uint16(n)), nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (*ProxyHeader, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, err
+	}
+
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 version %d", errProxyHeader, head[12]>>4)
+	}
+	cmd := head[12] & 0x0f
+	family, proto := head[13]>>4, head[13]&0x0f
+
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+
+	var addrLen int
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("%w: v2 address too short", errProxyHeader)
+	}
+
+	tlvs, err := parseProxyTLVs(body[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+
+	switch cmd {
+	case proxyV2CmdLocal:
+		// health check of load balancer itself
+		return header, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: v2 command %d", errProxyHeader, cmd)
+	}
+
+	// only tcp and udp over ip carry addresses of use
+	if (family != 0x1 && family != 0x2) || (proto != 0x1 && proto != 0x2) {
+		return header, nil
+	}
+
+	ipLen := (addrLen - 4) / 2
+	src, _ := netip.AddrFromSlice(body[:ipLen])
+	dst, _ := netip.AddrFromSlice(body[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(body[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(body[2*ipLen+2:])
+
+	if proto == 0x1 {
+		header.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort))
+		header.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort))
+	} else {
+		header.Source = net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort))
+		header.Destination = net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort))
+	}
+	return header, nil
+}
+
+func parseProxyTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("%w: tlv too short", errProxyHeader)
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("%w: tlv too short", errProxyHeader)
+		}
+
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+
+	return tlvs, nil
+}
+
+// proxyHeaderAddrs client and destination of tunnel for PROXY protocol header. destination is
+// remote address of conn if dialed directly, unspecified if not an ip otherwise.
+func proxyHeaderAddrs(req *tunnelRequest, conn net.Conn, direct bool) (src, dst netip.AddrPort) {
+	src, _ = netip.ParseAddrPort(req.client)
+
+	dst, err := netip.ParseAddrPort(req.dest)
+	if err == nil {
+		return src, dst
+	}
+	if direct {
+		return src, addrPort(conn.RemoteAddr())
+	}
+
+	_, port, _ := net.SplitHostPort(req.dest)
+	n, _ := strconv.ParseUint(port, 10, 16)
+	ip := netip.IPv4Unspecified()
+	if src.Addr().Unmap().Is6() {
+		ip = netip.IPv6Unspecified()
+	}
+	return src, netip.AddrPortFrom(ip, uint16(n))
+}
+
+// encodeProxyHeader PROXY protocol header of tcp conn, v1 or v2. tlvs of v1 ignored.
+// protocol unknown if either address invalid, so addresses of conn used by receiver.
+func encodeProxyHeader(version int, src, dst netip.AddrPort, tlvs []ProxyTLV) []byte {
+	known := src.IsValid() && dst.IsValid()
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	ipv4 := srcIP.Is4() && dstIP.Is4()
+	if !ipv4 {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port(), dst.Port())
+	}
+
+	var body []byte
+	family := byte(0x00)
+	if known {
+		family = 0x21
+		if ipv4 {
+			family = 0x11
+		}
+		body = append(body, srcIP.AsSlice()...)
+		body = append(body, dstIP.AsSlice()...)
+		body = binary.BigEndian.AppendUint16(body, src.Port())
+		body = binary.BigEndian.AppendUint16(body, dst.Port())
+	}
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, 0x20|proxyV2CmdProxy, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
@@ -0,0 +1,292 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// proxyHeaderV2 v2 header of tcp, with tlvs
+func proxyHeaderV2(src, dst string, tlvs ...ProxyTLV) []byte {
+	return encodeProxyHeader(2, netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst), tlvs)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	require := require.New(t)
+
+	read := func(s string) (*ProxyHeader, string, error) {
+		br := bufio.NewReader(strings.NewReader(s))
+		header, err := readProxyHeader(br)
+		rest, _ := io.ReadAll(br)
+		return header, string(rest), err
+	}
+
+	header, rest, err := read("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET / HTTP/1.1\r\n")
+	require.Nil(err)
+	require.Equal(1, header.Version)
+	require.Equal("192.0.2.1:56324", header.Source.String())
+	require.Equal("192.0.2.2:443", header.Destination.String())
+	require.Equal("GET / HTTP/1.1\r\n", rest)
+
+	header, _, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")
+	require.Nil(err)
+	require.Equal("[2001:db8::1]:56324", header.Source.String())
+
+	header, rest, err = read("PROXY UNKNOWN\r\nhello")
+	require.Nil(err)
+	require.Nil(header.Source)
+	require.Equal("hello", rest)
+
+	// not PROXY protocol, nothing read
+	header, rest, err = read("POST / HTTP/1.1\r\n")
+	require.Nil(err)
+	require.Nil(header)
+	require.Equal("POST / HTTP/1.1\r\n", rest)
+
+	for _, s := range []string{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 056324 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n",
+		"PROXY " + strings.Repeat("x", 120) + "\r\n",
+	} {
+		_, _, err := read(s)
+		require.ErrorIs(err, errProxyHeader, s)
+	}
+
+	ssl := append([]byte{0x01, 0, 0, 0, 0}, ProxyTLVSSLVersion, 0, 7)
+	ssl = append(ssl, "TLSv1.3"...)
+	v2 := proxyHeaderV2("192.0.2.1:56324", "192.0.2.2:443",
+		ProxyTLV{Type: ProxyTLVALPN, Value: []byte("h2")},
+		ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("proxy.example.com")},
+		ProxyTLV{Type: ProxyTLVSSL, Value: ssl},
+	)
+	header, rest, err = read(string(v2) + "hello")
+	require.Nil(err)
+	require.Equal(2, header.Version)
+	require.Equal("192.0.2.1:56324", header.Source.String())
+	require.Equal("192.0.2.2:443", header.Destination.String())
+	require.Equal("h2", header.ALPN())
+	require.Equal("proxy.example.com", header.Authority())
+	sslTLV, ok := header.SSL()
+	require.True(ok)
+	require.Equal(byte(0x01), sslTLV.Client)
+	version, _ := sslTLV.TLV(ProxyTLVSSLVersion)
+	require.Equal("TLSv1.3", string(version))
+	require.Equal("hello", rest)
+
+	// LOCAL command, addresses of conn kept
+	local := append([]byte{}, proxyV2Sig...)
+	local = append(local, 0x20, 0x00, 0, 0)
+	header, _, err = read(string(local))
+	require.Nil(err)
+	require.Nil(header.Source)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	acl, err := NewACL([]string{"192.0.2.0/24"}, nil, nil)
+	require.Nil(err)
+	server := startProxy(require, WithListenAddress(":8080"), WithSOCKS(true), WithACL(acl),
+		WithProxyProtocol(ProxyProtocolConfig{Trusted: []string{"127.0.0.1"}}))
+	defer server.Shutdown(context.Background())
+
+	connect := func(header string) *http.Response {
+		conn, err := net.Dial("tcp", "127.0.0.1:8080")
+		require.Nil(err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(header + "CONNECT " + echoLn.Addr().String() + " HTTP/1.1\r\n\r\n"))
+		require.Nil(err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.Nil(err)
+		return resp
+	}
+
+	// client address of header checked by acl
+	require.Equal(http.StatusOK, connect("PROXY TCP4 192.0.2.1 127.0.0.1 56324 8080\r\n").StatusCode)
+	require.Equal(http.StatusForbidden, connect("PROXY TCP4 198.51.100.1 127.0.0.1 56324 8080\r\n").StatusCode)
+	require.Equal(http.StatusForbidden, connect("").StatusCode)
+
+	// socks after v2 header
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write(proxyHeaderV2("192.0.2.1:56324", "127.0.0.1:8080"))
+	require.Nil(err)
+	dialer, err := proxy.SOCKS5("tcp", "", nil, fixedDialer{conn})
+	require.Nil(err)
+	socksConn, err := dialer.Dial("tcp", echoLn.Addr().String())
+	require.Nil(err)
+	echo(require, socksConn, "hello")
+
+	// header of untrusted client not parsed
+	server.Reload(WithListenAddress(":8080"), WithSOCKS(true), WithACL(acl),
+		WithProxyProtocol(ProxyProtocolConfig{Trusted: []string{"10.0.0.0/8"}}))
+	require.Equal(http.StatusBadRequest, connect("PROXY TCP4 192.0.2.1 127.0.0.1 56324 8080\r\n").StatusCode)
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	require := require.New(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For") + "|" + r.Header.Get("Forwarded")))
+	}))
+	defer origin.Close()
+
+	opts := []ServerOption{WithListenAddress(":8080"), WithProxyProtocol(ProxyProtocolConfig{Trusted: []string{"127.0.0.1"}})}
+	server := startProxy(require, append(opts, WithForwardedHeaders(true))...)
+	defer server.Shutdown(context.Background())
+
+	get := func(header string) string {
+		conn, err := net.Dial("tcp", "127.0.0.1:8080")
+		require.Nil(err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(header + "GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() +
+			"\r\nX-Forwarded-For: 198.51.100.1\r\n\r\n"))
+		require.Nil(err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.Nil(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(err)
+		return string(body)
+	}
+
+	// client address of PROXY header appended
+	require.Equal("198.51.100.1, 192.0.2.1|for=192.0.2.1", get("PROXY TCP4 192.0.2.1 127.0.0.1 56324 8080\r\n"))
+	require.Equal(`198.51.100.1, 2001:db8::1|for="[2001:db8::1]"`, get("PROXY TCP6 2001:db8::1 ::1 56324 8080\r\n"))
+	require.Equal("198.51.100.1, 127.0.0.1|for=127.0.0.1", get(""))
+
+	// each request of keep-alive conn, remote conn not reused
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for range 2 {
+		_, err = conn.Write([]byte("GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() + "\r\n\r\n"))
+		require.Nil(err)
+		resp, err := http.ReadResponse(reader, nil)
+		require.Nil(err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(err)
+		require.Equal("127.0.0.1|for=127.0.0.1", string(body))
+	}
+
+	// disabled by default
+	require.Nil(server.Reload(opts...))
+	require.Equal("198.51.100.1|", get("PROXY TCP4 192.0.2.1 127.0.0.1 56324 8080\r\n"))
+}
+
+// fixedDialer dial returns conn already connected
+type fixedDialer struct {
+	conn net.Conn
+}
+
+func (d fixedDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func TestEncodeProxyHeader(t *testing.T) {
+	require := require.New(t)
+
+	read := func(b []byte) *ProxyHeader {
+		header, err := readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+		require.Nil(err)
+		return header
+	}
+
+	src, dst := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("192.0.2.2:443")
+	require.Equal("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", string(encodeProxyHeader(1, src, dst, nil)))
+	require.Equal("PROXY UNKNOWN\r\n", string(encodeProxyHeader(1, netip.AddrPort{}, dst, nil)))
+
+	// mixed families as ipv6
+	require.Equal("PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n", string(encodeProxyHeader(1, src, netip.MustParseAddrPort("[2001:db8::2]:443"), nil)))
+
+	header := read(encodeProxyHeader(2, src, dst, []ProxyTLV{{Type: 0xe0, Value: []byte("foo")}}))
+	require.Equal("192.0.2.1:56324", header.Source.String())
+	require.Equal("192.0.2.2:443", header.Destination.String())
+	user, _ := header.TLV(0xe0)
+	require.Equal("foo", string(user))
+
+	header = read(encodeProxyHeader(2, netip.AddrPort{}, dst, nil))
+	require.Equal(2, header.Version)
+	require.Nil(header.Source)
+
+	_, err := newRule(0, RuleConfig{Outbound: OutboundDirect, ProxyProtocol: "v3"})
+	require.NotNil(err)
+	_, err = newRule(0, RuleConfig{Outbound: OutboundDirect, ProxyProtocol: "v1", ProxyProtocolUserTLV: 0xe0})
+	require.NotNil(err)
+	_, err = newRule(0, RuleConfig{Outbound: OutboundDirect, ProxyProtocol: "v2", ProxyProtocolUserTLV: 0x05})
+	require.NotNil(err)
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	require := require.New(t)
+
+	// remote reads header, then echo
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer ln.Close()
+	headers := make(chan *ProxyHeader, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				header, _ := readProxyHeader(br)
+				headers <- header
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+
+	server := startProxy(require, WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "bar"}), WithRules([]RuleConfig{
+		{IPCIDR: []string{"127.0.0.1"}, ProxyProtocol: "v2", ProxyProtocolUserTLV: 0xe0, Outbound: OutboundDirect},
+	}))
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT " + ln.Addr().String() + " HTTP/1.1\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n\r\n"))
+	require.Nil(err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	header := <-headers
+	require.NotNil(header)
+	require.Equal(conn.LocalAddr().String(), header.Source.String())
+	require.Equal(ln.Addr().String(), header.Destination.String())
+	user, _ := header.TLV(0xe0)
+	require.Equal("foo", string(user))
+
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(br, buf)
+	require.Nil(err)
+	require.Equal("hello", string(buf))
+}
@@ -0,0 +1,444 @@
+package httpproxy
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isayme/go-logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaults of dns config
+const (
+	defaultDNSTimeout     = time.Second * 5
+	defaultDNSCacheSize   = 4096
+	defaultDNSMaxTTL      = time.Hour
+	defaultDNSNegativeTTL = time.Second * 30
+)
+
+// min time of dialing an address, if more addresses to try within connect timeout
+const minDialAddressTimeout = time.Second * 2
+
+// DNSConfig resolver of domains dialed direct, and of upstream and dns server hosts.
+// system resolver used if no servers.
+type DNSConfig struct {
+	// 'udp://1.1.1.1:53', 'tcp://1.1.1.1:53', 'tls://1.1.1.1:853' or 'https://1.1.1.1/dns-query',
+	// tried in order
+	Servers []string `yaml:"servers" toml:"servers"`
+	// split dns, servers of first rule matched
+	Rules []DNSRuleConfig `yaml:"rules" toml:"rules"`
+	// static domain to ips, over hosts file
+	Hosts map[string][]string `yaml:"hosts" toml:"hosts"`
+	// '/etc/hosts' style file
+	HostsFile string `yaml:"hosts-file" toml:"hosts-file"`
+	// tls of tls and https servers
+	TLS UpstreamTLSConfig `yaml:"tls" toml:"tls"`
+
+	// timeout of a query to a server, default 5s
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// max cached answers, default 4096, negative disables cache
+	CacheSize int `yaml:"cache-size" toml:"cache-size"`
+	// ttl of answers clamped to range, max default 1h
+	MinTTL time.Duration `yaml:"min-ttl" toml:"min-ttl"`
+	MaxTTL time.Duration `yaml:"max-ttl" toml:"max-ttl"`
+	// max ttl of not found answers, default 30s, ttl of soa used if less
+	NegativeTTL time.Duration `yaml:"negative-ttl" toml:"negative-ttl"`
+}
+
+// DNSRuleConfig servers of domains
+type DNSRuleConfig struct {
+	// 'example.com', '+.example.com', '.example.com' or '*.example.com', see domainTrie
+	Domains []string `yaml:"domains" toml:"domains"`
+	// system resolver if empty
+	Servers []string `yaml:"servers" toml:"servers"`
+}
+
+func (c DNSConfig) validate() error {
+	conf, err := c.TLS.tlsConfig()
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	for _, address := range c.Servers {
+		if _, err := newDNSServer(address, conf); err != nil {
+			return err
+		}
+	}
+	for i, rule := range c.Rules {
+		if len(rule.Domains) == 0 {
+			return fmt.Errorf("rules.%d: domains required", i)
+		}
+		for _, address := range rule.Servers {
+			if _, err := newDNSServer(address, conf); err != nil {
+				return fmt.Errorf("rules.%d: %w", i, err)
+			}
+		}
+	}
+	for name, ips := range c.Hosts {
+		if len(ips) == 0 {
+			return fmt.Errorf("hosts: ips of '%s' required", name)
+		}
+		for _, ip := range ips {
+			if _, err := netip.ParseAddr(ip); err != nil {
+				return fmt.Errorf("hosts: ip '%s' of '%s' invalid", ip, name)
+			}
+		}
+	}
+	if c.Timeout < 0 || c.MinTTL < 0 || c.MaxTTL < 0 || c.NegativeTTL < 0 {
+		return errors.New("durations must not be negative")
+	}
+	return nil
+}
+
+// dnsRule servers of matched domains, nil servers for system resolver
+type dnsRule struct {
+	domains *domainTrie
+	servers []dnsServer
+}
+
+// resolver resolve domains by static hosts, then servers of split dns rules or default ones,
+// answers cached by ttl. implements proxy.Dialer, dials resolved addresses in order.
+type resolver struct {
+	// normalized domain to ips
+	hosts   map[string][]netip.Addr
+	rules   []dnsRule
+	servers []dnsServer
+
+	timeout     time.Duration
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+
+	// nil if disabled
+	cache *dnsCache
+}
+
+func newResolver(c DNSConfig) (*resolver, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	r := &resolver{
+		hosts:       map[string][]netip.Addr{},
+		timeout:     c.Timeout,
+		minTTL:      c.MinTTL,
+		maxTTL:      c.MaxTTL,
+		negativeTTL: c.NegativeTTL,
+	}
+	if r.timeout == 0 {
+		r.timeout = defaultDNSTimeout
+	}
+	if r.maxTTL == 0 {
+		r.maxTTL = defaultDNSMaxTTL
+	}
+	if r.negativeTTL == 0 {
+		r.negativeTTL = defaultDNSNegativeTTL
+	}
+	switch {
+	case c.CacheSize == 0:
+		r.cache = newDNSCache(defaultDNSCacheSize)
+	case c.CacheSize > 0:
+		r.cache = newDNSCache(c.CacheSize)
+	}
+
+	if c.HostsFile != "" {
+		hosts, err := readHostsFile(c.HostsFile)
+		if err != nil {
+			return nil, err
+		}
+		r.hosts = hosts
+	}
+	for name, ips := range c.Hosts {
+		name = normalizeDomain(name)
+		r.hosts[name] = nil
+		for _, ip := range ips {
+			r.hosts[name] = append(r.hosts[name], netip.MustParseAddr(ip).Unmap())
+		}
+	}
+
+	conf, _ := c.TLS.tlsConfig()
+	newServers := func(addresses []string) []dnsServer {
+		var servers []dnsServer
+		for _, address := range addresses {
+			// validated
+			s, _ := newDNSServer(address, conf)
+			servers = append(servers, s)
+		}
+		return servers
+	}
+	r.servers = newServers(c.Servers)
+	for _, rc := range c.Rules {
+		rule := dnsRule{domains: newDomainTrie(), servers: newServers(rc.Servers)}
+		for _, domain := range rc.Domains {
+			rule.domains.insert(domain)
+		}
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+// readHostsFile domain to ips of lines like '10.0.0.1 a.example.com b.example.com'
+func readHostsFile(file string) (map[string][]netip.Addr, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("read hosts file fail: %w", err)
+	}
+	defer f.Close()
+
+	hosts := map[string][]netip.Addr{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// zone of link local address not supported
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil || ip.Zone() != "" {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = normalizeDomain(name)
+			hosts[name] = append(hosts[name], ip.Unmap())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read hosts file fail: %w", err)
+	}
+
+	return hosts, nil
+}
+
+// system whether only system resolver used, dialing by go as is
+func (r *resolver) system() bool {
+	return len(r.hosts) == 0 && len(r.rules) == 0 && len(r.servers) == 0
+}
+
+// serversOf servers of first matched rule, default ones otherwise
+func (r *resolver) serversOf(name string) []dnsServer {
+	for _, rule := range r.rules {
+		if rule.domains.match(name) {
+			return rule.servers
+		}
+	}
+	return r.servers
+}
+
+// lookup ips of host, ipv4 first
+func (r *resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+
+	name := normalizeDomain(host)
+	if ips, ok := r.hosts[name]; ok {
+		return ips, nil
+	}
+
+	servers := r.serversOf(name)
+	if len(servers) == 0 {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		for i := range ips {
+			ips[i] = ips[i].Unmap()
+		}
+		return ips, err
+	}
+
+	var wg sync.WaitGroup
+	var answers [2]*dnsAnswer
+	var errs [2]error
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers[i], errs[i] = r.query(ctx, servers, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var ips []netip.Addr
+	for _, answer := range answers {
+		if answer != nil {
+			ips = append(ips, answer.ips...)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err := errors.Join(errs[:]...); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: servers[0].String()}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// query answer of name and type from cache, or from servers in order until one answered
+func (r *resolver) query(ctx context.Context, servers []dnsServer, name string, qtype dnsmessage.Type) (*dnsAnswer, error) {
+	key := name + "/" + qtype.String()
+	if answer := r.cache.get(key); answer != nil {
+		return answer, nil
+	}
+
+	var lastErr error
+	for _, s := range servers {
+		answer, err := r.exchange(ctx, s, name, qtype)
+		if err != nil {
+			logger.Debugw("dns query fail", "name", name, "type", qtype.String(), "server", s.String(), "err", err)
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		if len(answer.ips) > 0 {
+			answer.ttl = min(max(answer.ttl, r.minTTL), r.maxTTL)
+		} else if answer.ttl < 0 || answer.ttl > r.negativeTTL {
+			answer.ttl = r.negativeTTL
+		}
+		r.cache.set(key, answer)
+		logger.Debugw("dns query", "name", name, "type", qtype.String(), "server", s.String(), "ips", answer.ips, "ttl", answer.ttl)
+		return answer, nil
+	}
+
+	return nil, lastErr
+}
+
+func (r *resolver) exchange(ctx context.Context, s dnsServer, name string, qtype dnsmessage.Type) (*dnsAnswer, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	query, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSResponse(query, resp, qtype)
+}
+
+func (r *resolver) Dial(network, address string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, address)
+}
+
+// DialContext dial resolved addresses in order until one connected, each within its share
+// of time left
+func (r *resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || r.system() {
+		return d.DialContext(ctx, network, address)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.DialContext(ctx, network, address)
+	}
+
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for i, ip := range ips {
+		dialCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := time.Until(deadline) / time.Duration(len(ips)-i)
+			timeout = max(timeout, min(minDialAddressTimeout, time.Until(deadline)))
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		conn, err := d.DialContext(dialCtx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dnsCache answers by key until expired, least recently used evicted if full
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// front most recently used
+	lru *list.List
+}
+
+type dnsCacheEntry struct {
+	key     string
+	answer  *dnsAnswer
+	expires time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get answer of key, nil if not cached or expired
+func (c *dnsCache) get(key string) *dnsAnswer {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*dnsCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.answer
+}
+
+func (c *dnsCache) set(key string, answer *dnsAnswer) {
+	if c == nil || answer.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &dnsCacheEntry{key: key, answer: answer, expires: time.Now().Add(answer.ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*dnsCacheEntry).key)
+	}
+}
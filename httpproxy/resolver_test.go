@@ -0,0 +1,288 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers of records, NXDOMAIN for others
+type fakeDNS struct {
+	// name with trailing dot
+	records map[string][]netip.Addr
+	// udp responses truncated without answers
+	truncate atomic.Bool
+	queries  atomic.Int64
+}
+
+func (f *fakeDNS) answer(require *require.Assertions, query []byte, udp bool) []byte {
+	f.queries.Add(1)
+
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	require.Nil(err)
+	q, err := p.Question()
+	require.Nil(err)
+
+	ips, ok := f.records[strings.ToLower(q.Name.String())]
+	rh := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true}
+	if !ok {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	if udp && f.truncate.Load() {
+		rh.Truncated = true
+	}
+
+	b := dnsmessage.NewBuilder(nil, rh)
+	require.Nil(b.StartQuestions())
+	require.Nil(b.Question(q))
+	require.Nil(b.StartAnswers())
+	if !rh.Truncated {
+		for _, ip := range ips {
+			header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			if ip.Is4() && q.Type == dnsmessage.TypeA {
+				require.Nil(b.AResource(header, dnsmessage.AResource{A: ip.As4()}))
+			}
+			if ip.Is6() && q.Type == dnsmessage.TypeAAAA {
+				require.Nil(b.AAAAResource(header, dnsmessage.AAAAResource{AAAA: ip.As16()}))
+			}
+		}
+	}
+	require.Nil(b.StartAuthorities())
+	if !ok {
+		header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: 300}
+		require.Nil(b.SOAResource(header, dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example.com."),
+			MBox:   dnsmessage.MustNewName("admin.example.com."),
+			MinTTL: 10,
+		}))
+	}
+
+	msg, err := b.Finish()
+	require.Nil(err)
+	return msg
+}
+
+// serve udp and tcp on same port, return address and stop
+func (f *fakeDNS) serve(require *require.Assertions) (string, func()) {
+	// same port of udp and tcp, retried if tcp one taken
+	var pc net.PacketConn
+	var ln net.Listener
+	var err error
+	for range 10 {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		require.Nil(err)
+		ln, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		pc.Close()
+	}
+	require.Nil(err)
+
+	go func() {
+		buf := make([]byte, dnsUDPSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(f.answer(require, buf[:n], true), addr)
+		}
+	}()
+	go f.serveStream(require, ln)
+
+	return pc.LocalAddr().String(), func() {
+		pc.Close()
+		ln.Close()
+	}
+}
+
+func (f *fakeDNS) serveStream(require *require.Assertions, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				msg := f.answer(require, query, false)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+			}
+		}()
+	}
+}
+
+func TestResolverServers(t *testing.T) {
+	require := require.New(t)
+
+	f := &fakeDNS{records: map[string][]netip.Addr{
+		"a.example.com.": {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+	}}
+	addr, stop := f.serve(require)
+	defer stop()
+
+	cert := newSelfSignedCert(require)
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.Nil(err)
+	defer tlsLn.Close()
+	go f.serveStream(require, tlsLn)
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("application/dns-message", r.Header.Get("Content-Type"))
+		query, err := io.ReadAll(r.Body)
+		require.Nil(err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(f.answer(require, query, false))
+	}))
+	defer doh.Close()
+
+	want := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}
+	for _, server := range []string{addr, "tcp://" + addr, "tls://" + tlsLn.Addr().String(), doh.URL + "/dns-query"} {
+		r, err := newResolver(DNSConfig{Servers: []string{server}, TLS: UpstreamTLSConfig{Insecure: true}})
+		require.Nil(err)
+
+		ips, err := r.lookup(context.Background(), "A.example.com.")
+		require.Nil(err, server)
+		require.Equal(want, ips, server)
+	}
+
+	// truncated udp retried by tcp
+	f.truncate.Store(true)
+	r, err := newResolver(DNSConfig{Servers: []string{"udp://" + addr}})
+	require.Nil(err)
+	ips, err := r.lookup(context.Background(), "a.example.com")
+	require.Nil(err)
+	require.Equal(want, ips)
+
+	_, err = newResolver(DNSConfig{Servers: []string{"quic://1.1.1.1"}})
+	require.ErrorContains(err, "scheme")
+}
+
+func TestResolverCache(t *testing.T) {
+	require := require.New(t)
+
+	f := &fakeDNS{records: map[string][]netip.Addr{
+		"a.example.com.": {netip.MustParseAddr("10.0.0.1")},
+	}}
+	addr, stop := f.serve(require)
+	defer stop()
+
+	r, err := newResolver(DNSConfig{Servers: []string{addr}, MaxTTL: time.Minute})
+	require.Nil(err)
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.lookup(context.Background(), "a.example.com")
+		require.Nil(err)
+		require.Equal([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, ips)
+	}
+	// A and AAAA, no data of AAAA cached too
+	require.Equal(int64(2), f.queries.Load())
+
+	for i := 0; i < 2; i++ {
+		_, err = r.lookup(context.Background(), "missing.example.com")
+		var dnsErr *net.DNSError
+		require.ErrorAs(err, &dnsErr)
+		require.True(dnsErr.IsNotFound)
+	}
+	require.Equal(int64(4), f.queries.Load())
+
+	// ttl of soa
+	answer := r.cache.get("missing.example.com/" + dnsmessage.TypeA.String())
+	require.NotNil(answer)
+	require.True(answer.notFound)
+	require.Equal(time.Second*10, answer.ttl)
+
+	// least recently used evicted
+	cache := newDNSCache(2)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		cache.set(key, &dnsAnswer{ttl: time.Minute})
+	}
+	require.NotNil(cache.get("a"))
+	require.Nil(cache.get("b"))
+	require.NotNil(cache.get("c"))
+}
+
+func TestResolverHostsAndRules(t *testing.T) {
+	require := require.New(t)
+
+	public := &fakeDNS{records: map[string][]netip.Addr{
+		"www.example.com.": {netip.MustParseAddr("10.0.0.1")},
+	}}
+	publicAddr, stop := public.serve(require)
+	defer stop()
+	corp := &fakeDNS{records: map[string][]netip.Addr{
+		"git.corp.example.com.": {netip.MustParseAddr("10.9.0.1")},
+	}}
+	corpAddr, stop := corp.serve(require)
+	defer stop()
+
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	require.Nil(os.WriteFile(hostsFile, []byte("# comment\n10.1.0.1 file.example.com\n10.1.0.2 static.example.com # overridden\n"), 0600))
+
+	r, err := newResolver(DNSConfig{
+		Servers:   []string{publicAddr},
+		Rules:     []DNSRuleConfig{{Domains: []string{"+.corp.example.com"}, Servers: []string{corpAddr}}},
+		Hosts:     map[string][]string{"Static.example.com": {"10.2.0.1"}},
+		HostsFile: hostsFile,
+	})
+	require.Nil(err)
+
+	for host, want := range map[string]string{
+		"www.example.com":      "10.0.0.1",
+		"git.corp.example.com": "10.9.0.1",
+		"file.example.com":     "10.1.0.1",
+		"static.example.com":   "10.2.0.1",
+		"10.3.0.1":             "10.3.0.1",
+	} {
+		ips, err := r.lookup(context.Background(), host)
+		require.Nil(err, host)
+		require.Equal([]netip.Addr{netip.MustParseAddr(want)}, ips, host)
+	}
+	require.Equal(int64(2), public.queries.Load())
+	require.Equal(int64(2), corp.queries.Load())
+
+	require.ErrorContains(DNSConfig{Hosts: map[string][]string{"a.example.com": {"x"}}}.validate(), "invalid")
+	require.ErrorContains(DNSConfig{Rules: []DNSRuleConfig{{Servers: []string{corpAddr}}}}.validate(), "domains required")
+}
+
+func TestDialByResolver(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+	_, port, err := net.SplitHostPort(echoLn.Addr().String())
+	require.Nil(err)
+
+	server := startProxy(require, WithListenAddress(":8080"), WithDNS(DNSConfig{
+		Hosts: map[string][]string{"echo.test": {"127.0.0.1"}},
+	}))
+	defer server.Shutdown(context.Background())
+
+	conn := dialTunnel(require, "127.0.0.1:8080", net.JoinHostPort("echo.test", port))
+	defer conn.Close()
+	echo(require, conn, "hello")
+}
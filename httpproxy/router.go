@@ -0,0 +1,364 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/isayme/go-logger"
+)
+
+const (
+	// dial destination directly
+	OutboundDirect = "direct"
+	// refuse tunnel
+	OutboundReject = "reject"
+	// pick from all upstreams by upstream strategy
+	OutboundUpstreams = "upstreams"
+)
+
+// RuleConfig routing rule. all set matchers must match, a matcher matches if any of its values does.
+type RuleConfig struct {
+	// 'example.com' matches example.com and its sub domains
+	DomainSuffix  []string `yaml:"domain-suffix" toml:"domain-suffix"`
+	DomainKeyword []string `yaml:"domain-keyword" toml:"domain-keyword"`
+	DomainRegex   []string `yaml:"domain-regex" toml:"domain-regex"`
+	// destination ip, only matches if destination is an ip
+	IPCIDR []string `yaml:"ip-cidr" toml:"ip-cidr"`
+	// destination port like '443' or range like '8000-9000'
+	Port       []string `yaml:"port" toml:"port"`
+	ClientCIDR []string `yaml:"client-cidr" toml:"client-cidr"`
+	// authenticated username
+	User []string `yaml:"user" toml:"user"`
+	// names of rule sets
+	RuleSet []string `yaml:"rule-set" toml:"rule-set"`
+
+	// direct, reject, upstreams or name of an upstream
+	Outbound string `yaml:"outbound" toml:"outbound"`
+
+	// PROXY protocol header sent to remote of tcp tunnels, 'v1' or 'v2', empty for none
+	ProxyProtocol string `yaml:"proxy-protocol" toml:"proxy-protocol"`
+	// v2 tlv type of authenticated username, custom types 0xe0-0xef, 0 for none
+	ProxyProtocolUserTLV uint8 `yaml:"proxy-protocol-user-tlv" toml:"proxy-protocol-user-tlv"`
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type rule struct {
+	index int
+
+	domainSuffixes []string
+	domainKeywords []string
+	domainRegexps  []*regexp.Regexp
+	ipCIDRs        []netip.Prefix
+	ports          []portRange
+	clientCIDRs    []netip.Prefix
+	users          []string
+	ruleSets       []*ruleSet
+
+	outbound string
+
+	// PROXY protocol version sent to remote, 0 for none
+	proxyProtocol        int
+	proxyProtocolUserTLV byte
+}
+
+// router pick outbound of tunnel by rules, first matched rule wins
+type router struct {
+	rules           []*rule
+	defaultOutbound string
+}
+
+// routeTarget destination and client of tunnel, parsed for matching
+type routeTarget struct {
+	host     string
+	ip       netip.Addr
+	port     uint16
+	clientIP netip.Addr
+	user     string
+}
+
+func newRouter(configs []RuleConfig, defaultOutbound string, upstreams *upstreamPool, ruleSets map[string]*ruleSet) (*router, error) {
+	rt := &router{
+		defaultOutbound: defaultOutbound,
+	}
+
+	if rt.defaultOutbound == "" {
+		rt.defaultOutbound = OutboundDirect
+		if upstreams != nil {
+			rt.defaultOutbound = OutboundUpstreams
+		}
+	}
+	if err := checkOutbound(rt.defaultOutbound, upstreams); err != nil {
+		return nil, fmt.Errorf("default outbound: %w", err)
+	}
+
+	for i, c := range configs {
+		r, err := newRule(i, c)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if err := checkOutbound(r.outbound, upstreams); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		for _, name := range c.RuleSet {
+			rs, ok := ruleSets[name]
+			if !ok {
+				return nil, fmt.Errorf("rule %d: rule-set '%s' not found", i, name)
+			}
+			r.ruleSets = append(r.ruleSets, rs)
+		}
+		rt.rules = append(rt.rules, r)
+	}
+
+	return rt, nil
+}
+
+func checkOutbound(outbound string, upstreams *upstreamPool) error {
+	switch outbound {
+	case OutboundDirect, OutboundReject:
+		return nil
+	case "":
+		return fmt.Errorf("outbound required")
+	}
+
+	if upstreams == nil {
+		return fmt.Errorf("outbound '%s' invalid, no upstreams", outbound)
+	}
+	if outbound == OutboundUpstreams {
+		return nil
+	}
+	if upstreams.get(outbound) == nil {
+		return fmt.Errorf("outbound '%s' not found", outbound)
+	}
+
+	return nil
+}
+
+func newRule(index int, c RuleConfig) (*rule, error) {
+	r := &rule{
+		index:    index,
+		outbound: c.Outbound,
+		users:    c.User,
+	}
+
+	for _, suffix := range c.DomainSuffix {
+		r.domainSuffixes = append(r.domainSuffixes, normalizeDomain(suffix))
+	}
+
+	for _, keyword := range c.DomainKeyword {
+		r.domainKeywords = append(r.domainKeywords, strings.ToLower(keyword))
+	}
+
+	for _, expr := range c.DomainRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("domain-regex '%s' invalid: %w", expr, err)
+		}
+		r.domainRegexps = append(r.domainRegexps, re)
+	}
+
+	var err error
+	r.ipCIDRs, err = parsePrefixes(c.IPCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("ip-cidr invalid: %w", err)
+	}
+
+	r.clientCIDRs, err = parsePrefixes(c.ClientCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("client-cidr invalid: %w", err)
+	}
+
+	for _, port := range c.Port {
+		pr, err := parsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	switch c.ProxyProtocol {
+	case "":
+	case "v1":
+		r.proxyProtocol = 1
+	case "v2":
+		r.proxyProtocol = 2
+	default:
+		return nil, fmt.Errorf("proxy-protocol '%s' invalid, must be v1 or v2", c.ProxyProtocol)
+	}
+
+	if c.ProxyProtocolUserTLV != 0 {
+		if r.proxyProtocol != 2 {
+			return nil, fmt.Errorf("proxy-protocol-user-tlv requires proxy-protocol v2")
+		}
+		if c.ProxyProtocolUserTLV < 0xe0 || c.ProxyProtocolUserTLV > 0xef {
+			return nil, fmt.Errorf("proxy-protocol-user-tlv %#x invalid, must be 0xe0-0xef", c.ProxyProtocolUserTLV)
+		}
+		r.proxyProtocolUserTLV = c.ProxyProtocolUserTLV
+	}
+
+	return r, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+
+	from, err := strconv.ParseUint(strings.TrimSpace(fromStr), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("port '%s' invalid", s)
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(toStr), 10, 16)
+	if err != nil || to < from {
+		return portRange{}, fmt.Errorf("port '%s' invalid", s)
+	}
+
+	return portRange{from: uint16(from), to: uint16(to)}, nil
+}
+
+// normalizeDomain lower case, without leading or trailing dot
+func normalizeDomain(domain string) string {
+	return strings.Trim(strings.ToLower(domain), ".")
+}
+
+func newRouteTarget(req *tunnelRequest) *routeTarget {
+	t := &routeTarget{
+		user: req.user,
+	}
+
+	host, portStr, err := net.SplitHostPort(req.dest)
+	if err != nil {
+		host = req.dest
+	}
+	if port, err := strconv.ParseUint(portStr, 10, 16); err == nil {
+		t.port = uint16(port)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		t.ip = ip.Unmap()
+	} else {
+		t.host = normalizeDomain(host)
+	}
+
+	t.clientIP, _ = addrIP(req.client)
+
+	return t
+}
+
+// route outbound of tunnel
+func (rt *router) route(req *tunnelRequest) string {
+	outbound, _ := rt.routeRule(req)
+	return outbound
+}
+
+// routeRule outbound of tunnel and the rule matched, nil rule if default outbound
+func (rt *router) routeRule(req *tunnelRequest) (string, *rule) {
+	t := newRouteTarget(req)
+
+	for _, r := range rt.rules {
+		if r.match(t) {
+			logger.Debugw("route rule matched", "rule", r.index, "addr", req.dest, "outbound", r.outbound, "seqId", req.seqId)
+			return r.outbound, r
+		}
+		logger.Tracew("route rule not matched", "rule", r.index, "addr", req.dest, "seqId", req.seqId)
+	}
+
+	logger.Debugw("route default", "addr", req.dest, "outbound", rt.defaultOutbound, "seqId", req.seqId)
+	return rt.defaultOutbound, nil
+}
+
+func (r *rule) match(t *routeTarget) bool {
+	hasDomain := len(r.domainSuffixes) > 0 || len(r.domainKeywords) > 0 || len(r.domainRegexps) > 0
+	if hasDomain && !r.matchDomain(t.host) {
+		return false
+	}
+
+	if len(r.ipCIDRs) > 0 && !matchPrefixes(r.ipCIDRs, t.ip) {
+		return false
+	}
+
+	if len(r.ports) > 0 && !r.matchPort(t.port) {
+		return false
+	}
+
+	if len(r.clientCIDRs) > 0 && !matchPrefixes(r.clientCIDRs, t.clientIP) {
+		return false
+	}
+
+	if len(r.users) > 0 && (t.user == "" || !slices.Contains(r.users, t.user)) {
+		return false
+	}
+
+	if len(r.ruleSets) > 0 && !r.matchRuleSets(t) {
+		return false
+	}
+
+	return true
+}
+
+// matchDomain any of domain suffixes, keywords and regexps
+func (r *rule) matchDomain(host string) bool {
+	if host == "" {
+		return false
+	}
+
+	for _, suffix := range r.domainSuffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+
+	for _, keyword := range r.domainKeywords {
+		if strings.Contains(host, keyword) {
+			return true
+		}
+	}
+
+	for _, re := range r.domainRegexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *rule) matchRuleSets(t *routeTarget) bool {
+	for _, rs := range r.ruleSets {
+		if rs.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(port uint16) bool {
+	for _, pr := range r.ports {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPrefixes(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package httpproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(require, StrategyRoundRobin, 1, 1)
+	rt, err := newRouter([]RuleConfig{
+		{DomainSuffix: []string{"Example.com."}, Outbound: "u0"},
+		{DomainKeyword: []string{"ads"}, Outbound: OutboundReject},
+		{DomainRegex: []string{`^api\d+\.test$`}, Port: []string{"8000-9000"}, Outbound: "u1"},
+		{IPCIDR: []string{"10.0.0.0/8", "::1"}, Outbound: OutboundDirect},
+		{ClientCIDR: []string{"192.168.1.0/24"}, User: []string{"alice"}, Outbound: OutboundReject},
+	}, "", pool, nil)
+	require.Nil(err)
+
+	route := func(dest string, client string, user string) string {
+		return rt.route(&tunnelRequest{dest: dest, client: client, user: user})
+	}
+
+	require.Equal("u0", route("example.com:443", "127.0.0.1:1234", ""))
+	require.Equal("u0", route("WWW.example.com:443", "127.0.0.1:1234", ""))
+	require.Equal(OutboundUpstreams, route("notexample.com:443", "127.0.0.1:1234", ""))
+	require.Equal(OutboundReject, route("ads.tracker.net:80", "127.0.0.1:1234", ""))
+	require.Equal("u1", route("api1.test:8080", "127.0.0.1:1234", ""))
+	require.Equal(OutboundUpstreams, route("api1.test:443", "127.0.0.1:1234", ""))
+	require.Equal(OutboundDirect, route("10.1.2.3:22", "127.0.0.1:1234", ""))
+	require.Equal(OutboundDirect, route("[::1]:22", "127.0.0.1:1234", ""))
+	require.Equal(OutboundReject, route("github.com:443", "192.168.1.10:1234", "alice"))
+	require.Equal(OutboundUpstreams, route("github.com:443", "192.168.1.10:1234", "bob"))
+	require.Equal(OutboundUpstreams, route("github.com:443", "192.168.2.10:1234", "alice"))
+}
+
+func TestRouterInvalid(t *testing.T) {
+	require := require.New(t)
+
+	rt, err := newRouter(nil, "", nil, nil)
+	require.Nil(err)
+	require.Equal(OutboundDirect, rt.defaultOutbound)
+
+	_, err = newRouter(nil, OutboundUpstreams, nil, nil)
+	require.ErrorContains(err, "no upstreams")
+
+	_, err = newRouter([]RuleConfig{{Port: []string{"9000-8000"}, Outbound: OutboundDirect}}, "", nil, nil)
+	require.ErrorContains(err, "port '9000-8000' invalid")
+
+	_, err = newRouter([]RuleConfig{{DomainRegex: []string{"("}, Outbound: OutboundDirect}}, "", nil, nil)
+	require.ErrorContains(err, "domain-regex")
+
+	_, err = newRouter([]RuleConfig{{DomainSuffix: []string{"a.com"}}}, "", nil, nil)
+	require.ErrorContains(err, "outbound required")
+
+	pool := newTestPool(require, StrategyRoundRobin, 1)
+	_, err = newRouter([]RuleConfig{{DomainSuffix: []string{"a.com"}, Outbound: "unknown"}}, "", pool, nil)
+	require.ErrorContains(err, "outbound 'unknown' not found")
+}
+
+func TestRouteReject(t *testing.T) {
+	require := require.New(t)
+
+	proxy := startProxy(require, WithListenAddress(":8080"), WithRules([]RuleConfig{
+		{DomainSuffix: []string{"blocked.test"}, Outbound: OutboundReject},
+	}))
+	defer proxy.Shutdown(context.Background())
+
+	proxyUrl, err := url.Parse("http://127.0.0.1:8080")
+	require.Nil(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             http.ProxyURL(proxyUrl),
+		},
+	}
+
+	resp, err := client.Get("http://www.blocked.test/")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(403, resp.StatusCode)
+}
@@ -0,0 +1,414 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/isayme/go-logger"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// clash rule provider, yaml with payload or one rule per line.
+	// rules like 'DOMAIN-SUFFIX,example.com' or domains like '+.example.com' or cidrs.
+	RuleSetFormatClash = "clash"
+	// gfwlist or autoproxy, base64 encoded or not
+	RuleSetFormatGFWList = "gfwlist"
+	// alias of gfwlist
+	RuleSetFormatAutoProxy = "autoproxy"
+)
+
+var ruleSetFormats = []string{
+	RuleSetFormatClash,
+	RuleSetFormatGFWList,
+	RuleSetFormatAutoProxy,
+}
+
+// default interval of checking rule set file change
+const defaultRuleSetInterval = time.Second * 10
+
+// RuleSetConfig rule set loaded from file, referred by name in rules
+type RuleSetConfig struct {
+	Name   string `yaml:"name" toml:"name"`
+	File   string `yaml:"file" toml:"file"`
+	Format string `yaml:"format" toml:"format"`
+	// interval of checking file change, default 10s
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+}
+
+// ruleSetMatcher compiled rule set
+type ruleSetMatcher struct {
+	domains  *domainTrie
+	keywords []string
+	regexps  []*regexp.Regexp
+	ips      *ipSet
+	// matched against url like 'https://example.com/', proxy only sees host of tunnels
+	urlRegexps []*regexp.Regexp
+
+	// gfwlist '@@' rules, checked first
+	exceptions *ruleSetMatcher
+
+	// lines not supported
+	skipped int
+	rules   int
+}
+
+func newRuleSetMatcher() *ruleSetMatcher {
+	return &ruleSetMatcher{
+		domains: newDomainTrie(),
+	}
+}
+
+func (m *ruleSetMatcher) match(t *routeTarget) bool {
+	if m.exceptions != nil && m.exceptions.match(t) {
+		return false
+	}
+
+	host := t.host
+	if host == "" && t.ip.IsValid() {
+		host = t.ip.String()
+	}
+
+	if m.domains.match(host) {
+		return true
+	}
+
+	for _, keyword := range m.keywords {
+		if strings.Contains(host, keyword) {
+			return true
+		}
+	}
+
+	for _, re := range m.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	if m.ips != nil && m.ips.contains(t.ip) {
+		return true
+	}
+
+	if len(m.urlRegexps) > 0 {
+		u := targetURL(t)
+		for _, re := range m.urlRegexps {
+			if re.MatchString(u) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// targetURL url of tunnel destination, https if port 443
+func targetURL(t *routeTarget) string {
+	host := t.host
+	if host == "" && t.ip.IsValid() {
+		host = t.ip.String()
+		if t.ip.Is6() {
+			host = "[" + host + "]"
+		}
+	}
+
+	switch t.port {
+	case 443:
+		return "https://" + host + "/"
+	case 80, 0:
+		return "http://" + host + "/"
+	default:
+		return fmt.Sprintf("http://%s:%d/", host, t.port)
+	}
+}
+
+// ruleSet rule set reloaded on file change
+type ruleSet struct {
+	config  RuleSetConfig
+	matcher atomic.Pointer[ruleSetMatcher]
+
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+}
+
+func newRuleSet(c RuleSetConfig) (*ruleSet, error) {
+	rs := &ruleSet{config: c}
+	if rs.config.Interval <= 0 {
+		rs.config.Interval = defaultRuleSetInterval
+	}
+
+	info, err := os.Stat(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("rule set '%s': %w", c.Name, err)
+	}
+
+	m, err := loadRuleSet(c.File, c.Format)
+	if err != nil {
+		return nil, fmt.Errorf("rule set '%s': %w", c.Name, err)
+	}
+
+	rs.modTime = info.ModTime()
+	rs.size = info.Size()
+	rs.matcher.Store(m)
+	logger.Infow("rule set loaded", "name", c.Name, "file", c.File, "rules", m.rules, "skipped", m.skipped)
+
+	return rs, nil
+}
+
+func (rs *ruleSet) match(t *routeTarget) bool {
+	return rs.matcher.Load().match(t)
+}
+
+// start checking file change until stop
+func (rs *ruleSet) start() {
+	rs.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(rs.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-rs.stop:
+				return
+			case <-ticker.C:
+			}
+
+			rs.reloadIfChanged()
+		}
+	}()
+}
+
+func (rs *ruleSet) stopWatch() {
+	if rs.stop != nil {
+		close(rs.stop)
+	}
+}
+
+// reloadIfChanged reload if modify time or size of file changed, keep old rules if fail
+func (rs *ruleSet) reloadIfChanged() {
+	info, err := os.Stat(rs.config.File)
+	if err != nil {
+		logger.Warnw("rule set stat fail", "name", rs.config.Name, "file", rs.config.File, "err", err)
+		return
+	}
+	if info.ModTime().Equal(rs.modTime) && info.Size() == rs.size {
+		return
+	}
+	rs.modTime = info.ModTime()
+	rs.size = info.Size()
+
+	m, err := loadRuleSet(rs.config.File, rs.config.Format)
+	if err != nil {
+		logger.Warnw("rule set reload fail, keep old rules", "name", rs.config.Name, "file", rs.config.File, "err", err)
+		return
+	}
+
+	rs.matcher.Store(m)
+	logger.Infow("rule set reloaded", "name", rs.config.Name, "file", rs.config.File, "rules", m.rules, "skipped", m.skipped)
+}
+
+func loadRuleSet(file string, format string) (*ruleSetMatcher, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(format) {
+	case RuleSetFormatClash, "":
+		return parseClashRuleSet(data)
+	case RuleSetFormatGFWList, RuleSetFormatAutoProxy:
+		return parseGFWList(data)
+	default:
+		return nil, fmt.Errorf("format '%s' invalid", format)
+	}
+}
+
+// parseClashRuleSet yaml with payload list, or one rule per line
+func parseClashRuleSet(data []byte) (*ruleSetMatcher, error) {
+	var provider struct {
+		Payload []string `yaml:"payload"`
+	}
+
+	var lines []string
+	if err := yaml.Unmarshal(data, &provider); err == nil && provider.Payload != nil {
+		lines = provider.Payload
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	m := newRuleSetMatcher()
+	var prefixes []netip.Prefix
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain or cidr
+		if !strings.Contains(line, ",") {
+			if prefix, err := parsePrefix(line); err == nil {
+				prefixes = append(prefixes, prefix)
+			} else {
+				m.domains.insert(line)
+			}
+			m.rules++
+			continue
+		}
+
+		// TYPE,VALUE[,POLICY][,no-resolve], policy ignored
+		fields := strings.Split(line, ",")
+		value := strings.TrimSpace(fields[1])
+		switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+		case "DOMAIN":
+			m.domains.insert(strings.TrimLeft(value, "+."))
+		case "DOMAIN-SUFFIX":
+			m.domains.insert("+." + strings.TrimLeft(value, "+."))
+		case "DOMAIN-KEYWORD":
+			m.keywords = append(m.keywords, strings.ToLower(value))
+		case "DOMAIN-REGEX":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: regex '%s' invalid: %w", i+1, value, err)
+			}
+			m.regexps = append(m.regexps, re)
+		case "IP-CIDR", "IP-CIDR6":
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: cidr '%s' invalid", i+1, value)
+			}
+			prefixes = append(prefixes, prefix)
+		default:
+			m.skipped++
+			continue
+		}
+		m.rules++
+	}
+
+	m.ips = newIPSet(prefixes)
+	return m, nil
+}
+
+// parseGFWList autoproxy rules, decoded first if base64 encoded
+func parseGFWList(data []byte) (*ruleSetMatcher, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("[")) && !bytes.HasPrefix(data, []byte("!")) {
+		compact := bytes.Join(bytes.Fields(data), nil)
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+		n, err := base64.StdEncoding.Decode(decoded, compact)
+		if err == nil {
+			data = decoded[:n]
+		}
+	}
+
+	m := newRuleSetMatcher()
+	m.exceptions = newRuleSetMatcher()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		target := m
+		if strings.HasPrefix(line, "@@") {
+			target = m.exceptions
+			line = line[2:]
+		}
+
+		if err := target.addAutoProxyRule(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// addAutoProxyRule add rule like '||example.com', '|http://example.com/path', '/regexp/' or 'keyword'.
+// paths are dropped as proxy only sees host of tunnels.
+func (m *ruleSetMatcher) addAutoProxyRule(line string) error {
+	switch {
+	case strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") && len(line) > 1:
+		re, err := regexp.Compile(line[1 : len(line)-1])
+		if err != nil {
+			return fmt.Errorf("regexp '%s' invalid: %w", line, err)
+		}
+		m.urlRegexps = append(m.urlRegexps, re)
+	case strings.HasPrefix(line, "||"):
+		host := autoProxyHost(line[2:])
+		if host == "" {
+			m.skipped++
+			return nil
+		}
+		if strings.Contains(host, "*") {
+			m.urlRegexps = append(m.urlRegexps, wildcardRegexp(`^https?://([^/]+\.)?`, host))
+		} else {
+			m.domains.insert("+." + host)
+		}
+	case strings.HasPrefix(line, "|"):
+		u, err := url.Parse(strings.TrimSuffix(line[1:], "|"))
+		if err != nil || u.Hostname() == "" {
+			m.skipped++
+			return nil
+		}
+		if strings.Contains(u.Hostname(), "*") {
+			m.urlRegexps = append(m.urlRegexps, wildcardRegexp(`^https?://`, u.Hostname()))
+		} else {
+			m.domains.insert(u.Hostname())
+		}
+	default:
+		host := autoProxyHost(line)
+		if host == "" {
+			m.skipped++
+			return nil
+		}
+		if strings.Contains(host, "*") {
+			m.urlRegexps = append(m.urlRegexps, wildcardRegexp(`^https?://[^/]*`, host))
+		} else {
+			m.keywords = append(m.keywords, host)
+		}
+	}
+
+	m.rules++
+	return nil
+}
+
+// autoProxyHost host part of rule without scheme and path
+func autoProxyHost(s string) string {
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	if i := strings.IndexAny(s, "/^|"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.ToLower(s)
+}
+
+// wildcardRegexp regexp of host pattern with '*', after prefix expression
+func wildcardRegexp(prefix string, host string) *regexp.Regexp {
+	parts := strings.Split(host, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile(prefix + strings.Join(parts, `[^/]*`))
+}
@@ -0,0 +1,184 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainTrie(t *testing.T) {
+	require := require.New(t)
+
+	trie := newDomainTrie()
+	trie.insert("exact.com")
+	trie.insert("+.suffix.com")
+	trie.insert(".sub.com")
+	trie.insert("*.wild.com")
+
+	require.True(trie.match("exact.com"))
+	require.False(trie.match("www.exact.com"))
+	require.True(trie.match("suffix.com"))
+	require.True(trie.match("a.b.suffix.com"))
+	require.False(trie.match("notsuffix.com"))
+	require.False(trie.match("sub.com"))
+	require.True(trie.match("a.b.sub.com"))
+	require.True(trie.match("a.wild.com"))
+	require.False(trie.match("a.b.wild.com"))
+	require.False(trie.match("wild.com"))
+	require.False(trie.match(""))
+}
+
+func TestIPSet(t *testing.T) {
+	require := require.New(t)
+
+	prefixes, err := parsePrefixes([]string{"10.0.0.0/9", "10.128.0.0/9", "192.168.1.1", "fd00::/8"})
+	require.Nil(err)
+	set := newIPSet(prefixes)
+	// adjacent ranges merged
+	require.Len(set.ranges, 3)
+
+	for ip, contains := range map[string]bool{
+		"10.0.0.0":        true,
+		"10.255.255.255":  true,
+		"11.0.0.0":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"fd12::1":         true,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		require.Equal(contains, set.contains(netip.MustParseAddr(ip)), ip)
+	}
+}
+
+func writeTempFile(require *require.Assertions, content string) string {
+	f, err := os.CreateTemp("", "httpproxy-test-*")
+	require.Nil(err)
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	require.Nil(err)
+	return f.Name()
+}
+
+func matchRuleSet(m *ruleSetMatcher, dest string) bool {
+	return m.match(newRouteTarget(&tunnelRequest{dest: dest}))
+}
+
+func TestClashRuleSet(t *testing.T) {
+	require := require.New(t)
+
+	m, err := parseClashRuleSet([]byte(`
+payload:
+  - '+.google.com'
+  - 'twitter.com'
+  - '91.108.4.0/22'
+`))
+	require.Nil(err)
+	require.True(matchRuleSet(m, "www.google.com:443"))
+	require.True(matchRuleSet(m, "twitter.com:443"))
+	require.False(matchRuleSet(m, "api.twitter.com:443"))
+	require.True(matchRuleSet(m, "91.108.5.1:443"))
+
+	m, err = parseClashRuleSet([]byte(`
+# classical
+DOMAIN,example.com
+DOMAIN-SUFFIX,github.com,Proxy
+DOMAIN-KEYWORD,youtube
+DOMAIN-REGEX,^api\d+\.test$
+IP-CIDR,1.1.1.0/24,no-resolve
+IP-CIDR6,2001:db8::/32
+PROCESS-NAME,curl
+`))
+	require.Nil(err)
+	require.Equal(6, m.rules)
+	require.Equal(1, m.skipped)
+	require.True(matchRuleSet(m, "example.com:80"))
+	require.False(matchRuleSet(m, "www.example.com:80"))
+	require.True(matchRuleSet(m, "api.github.com:443"))
+	require.True(matchRuleSet(m, "m.youtube.com:443"))
+	require.True(matchRuleSet(m, "api1.test:443"))
+	require.True(matchRuleSet(m, "1.1.1.1:53"))
+	require.True(matchRuleSet(m, "[2001:db8::1]:443"))
+	require.False(matchRuleSet(m, "8.8.8.8:53"))
+
+	_, err = parseClashRuleSet([]byte("IP-CIDR,not-a-cidr"))
+	require.ErrorContains(err, "line 1: cidr 'not-a-cidr' invalid")
+}
+
+func TestGFWListRuleSet(t *testing.T) {
+	require := require.New(t)
+
+	list := `[AutoProxy 0.2.9]
+! comment
+||google.com
+|http://blogspot.com/path
+.twimg.com
+/^https?:\/\/[^\/]+\.wikipedia\.org/
+||*.appspot.com
+@@||cn.google.com
+`
+
+	for _, data := range []string{list, base64.StdEncoding.EncodeToString([]byte(list))} {
+		m, err := parseGFWList([]byte(data))
+		require.Nil(err)
+		require.True(matchRuleSet(m, "google.com:443"))
+		require.True(matchRuleSet(m, "www.google.com:443"))
+		require.False(matchRuleSet(m, "cn.google.com:443"))
+		require.False(matchRuleSet(m, "www.cn.google.com:443"))
+		require.True(matchRuleSet(m, "blogspot.com:80"))
+		require.True(matchRuleSet(m, "pbs.twimg.com:443"))
+		require.True(matchRuleSet(m, "zh.wikipedia.org:443"))
+		require.True(matchRuleSet(m, "foo.appspot.com:443"))
+		require.False(matchRuleSet(m, "example.com:443"))
+	}
+}
+
+func TestRuleSetReload(t *testing.T) {
+	require := require.New(t)
+
+	file := writeTempFile(require, "DOMAIN-SUFFIX,a.com\n")
+	defer os.Remove(file)
+
+	rs, err := newRuleSet(RuleSetConfig{Name: "test", File: file, Interval: time.Millisecond * 10})
+	require.Nil(err)
+	rs.start()
+	defer rs.stopWatch()
+
+	target := newRouteTarget(&tunnelRequest{dest: "www.b.com:443"})
+	require.False(rs.match(target))
+
+	require.Nil(os.WriteFile(file, []byte("DOMAIN-SUFFIX,a.com\nDOMAIN-SUFFIX,b.com\n"), 0644))
+	require.Eventually(func() bool {
+		return rs.match(target)
+	}, time.Second, time.Millisecond*10)
+
+	// invalid file keeps old rules
+	require.Nil(os.WriteFile(file, []byte("IP-CIDR,invalid\n"), 0644))
+	time.Sleep(time.Millisecond * 50)
+	require.True(rs.match(target))
+}
+
+func TestRouterRuleSet(t *testing.T) {
+	require := require.New(t)
+
+	file := writeTempFile(require, "||blocked.test\n")
+	defer os.Remove(file)
+
+	rs, err := newRuleSet(RuleSetConfig{Name: "gfw", File: file, Format: RuleSetFormatGFWList})
+	require.Nil(err)
+
+	rt, err := newRouter([]RuleConfig{
+		{RuleSet: []string{"gfw"}, Outbound: OutboundReject},
+	}, "", nil, map[string]*ruleSet{"gfw": rs})
+	require.Nil(err)
+	require.Equal(OutboundReject, rt.route(&tunnelRequest{dest: "www.blocked.test:443"}))
+	require.Equal(OutboundDirect, rt.route(&tunnelRequest{dest: "example.com:443"}))
+
+	_, err = newRouter([]RuleConfig{{RuleSet: []string{"unknown"}, Outbound: OutboundReject}}, "", nil, nil)
+	require.ErrorContains(err, "rule-set 'unknown' not found")
+}
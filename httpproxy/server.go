@@ -1,101 +1,299 @@
 package httpproxy
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"net/url"
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/isayme/go-logger"
-	"golang.org/x/net/proxy"
+	"golang.org/x/net/http/httpguts"
 )
 
 var responseConnectionEstablished = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
 
 type Server struct {
-	dialer proxy.ContextDialer
-
+	// options at start, listener related ones can not reload
 	options serverOptions
 
-	httpServer *http.Server
+	state atomic.Pointer[serverState]
+	// one Reload at a time, by SIGHUP and admin api both
+	reloadMu sync.Mutex
+
+	// main listener of listen address first
+	listeners   []*listener
+	adminServer *http.Server
+	adminLn     net.Listener
+
+	// closed when all listeners bound
+	listening chan struct{}
+	// sockets passed to new process
+	upgraded atomic.Bool
+
+	// hijacked tunnels, ignored by http.Server.Shutdown
+	sessionsMu sync.Mutex
+	sessions   map[*session]struct{}
+
+	tunnelsTotal atomic.Int64
+	bytesUp      atomic.Int64
+	bytesDown    atomic.Int64
 }
 
+const shutdownPollInterval = time.Millisecond * 100
+
 func NewServer(opts ...ServerOption) (*Server, error) {
 	s := &Server{
-		dialer: proxy.Direct,
+		sessions:  map[*session]struct{}{},
+		listening: make(chan struct{}),
 	}
 
-	if len(opts) > 0 {
-		for _, opt := range opts {
-			opt.apply(&s.options)
-		}
+	st, err := newServerState(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("NewServer: %w", err)
 	}
+	s.options = st.options
+	s.state.Store(st)
+	st.start()
 
-	proxyAddress := s.options.proxy
-	if proxyAddress != "" {
-		url, err := url.Parse(proxyAddress)
-		if err != nil {
-			return nil, fmt.Errorf("NewServer: parse proxy address fail: %w", err)
-		}
+	return s, nil
+}
 
-		dialer, err := proxy.FromURL(url, proxy.Direct)
-		if err != nil {
-			return nil, fmt.Errorf("NewServer: create proxy dialer fail: %w", err)
-		}
+// Reload apply new options, existing tunnels keep running with old ones.
+// old options are kept if new ones invalid. concurrent calls run one by one.
+func (s *Server) Reload(opts ...ServerOption) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
 
-		s.dialer = NewProxyContextDialer(dialer)
+	st, err := newServerState(opts...)
+	if err != nil {
+		return fmt.Errorf("Reload: %w", err)
 	}
 
-	return s, nil
+	// not applied, rejected so that config in use is what was loaded
+	if st.options.listenAddress != s.options.listenAddress || st.options.listenPort != s.options.listenPort {
+		return errors.New("Reload: listen address changed, restart required")
+	}
+	if err := st.listenersChanged(s.state.Load()); err != nil {
+		return fmt.Errorf("Reload: %w, restart required", err)
+	}
+	if st.options.adminAddress != s.options.adminAddress {
+		return errors.New("Reload: admin address changed, restart required")
+	}
+
+	st.reuse(s.state.Load())
+	st.start()
+	s.state.Swap(st).stop()
+	logger.Info("reload ok")
+	return nil
 }
 
-func (s *Server) dial(network, addr string) (c net.Conn, err error) {
-	ctx := context.Background()
-	if s.options.connectTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, s.options.connectTimeout)
-		defer cancel()
+func (s *Server) listenAddress() string {
+	if s.options.listenAddress != "" {
+		return s.options.listenAddress
 	}
-
-	return s.dialer.DialContext(ctx, network, addr)
+	return fmt.Sprintf(":%d", s.options.listenPort)
 }
 
+// ListenAndServe listen on listen address and addresses of listeners, sockets passed by
+// systemd socket activation (LISTEN_FDS) or upgrading process used instead if any
 func (s *Server) ListenAndServe() error {
-	address := s.options.listenAddress
-	if address == "" {
-		address = fmt.Sprintf(":%d", s.options.listenPort)
+	return s.serveAll(nil, inheritSockets())
+}
+
+// Serve serve main listener on ln instead of listen address, other listeners as ListenAndServe
+func (s *Server) Serve(ln net.Listener) error {
+	return s.serveAll(ln, inheritSockets())
+}
+
+func (s *Server) serveAll(ln net.Listener, inherited *inheritedSockets) error {
+	if err := s.bind(ln, inherited); err != nil {
+		return err
+	}
+	close(s.listening)
+	notifyReady()
+
+	if s.adminServer != nil {
+		go func() {
+			logger.Infow("start admin listen ...", "addr", s.adminLn.Addr().String())
+			if err := s.adminServer.Serve(s.adminLn); err != nil && err != http.ErrServerClosed {
+				logger.Errorw("admin listen fail", "err", err)
+			}
+		}()
 	}
 
-	s.httpServer = &http.Server{
-		Addr:    address,
-		Handler: s,
+	for _, l := range s.listeners[1:] {
+		go func() {
+			if err := s.serve(l); err != nil && err != http.ErrServerClosed {
+				logger.Errorw("listen fail", "err", err, "name", l.name)
+			}
+		}()
 	}
 
-	certFile := s.options.certFile
-	keyFile := s.options.keyFile
-	if certFile != "" && keyFile != "" {
-		logger.Infow("start listen with tls ...", "addr", address)
-		return s.httpServer.ListenAndServeTLS(certFile, keyFile)
-	} else {
-		logger.Infow("start listen ...", "addr", address)
-		return s.httpServer.ListenAndServe()
+	return s.serve(s.listeners[0])
+}
+
+// bind listeners and admin, all or none. main listener on ln if not nil.
+func (s *Server) bind(ln net.Listener, inherited *inheritedSockets) error {
+	defer inherited.close()
+
+	s.listeners = []*listener{s.newListener("", s.listenAddress())}
+	s.listeners[0].ln = ln
+	for _, c := range s.options.listeners {
+		s.listeners = append(s.listeners, s.newListener(c.Name, c.Address))
+	}
+
+	closeAll := func() {
+		for _, l := range s.listeners {
+			if l.ln != nil {
+				l.ln.Close()
+			}
+			s.shutdownHTTP3(context.Background(), l)
+		}
+	}
+
+	for _, l := range s.listeners {
+		if err := s.listen(l, inherited); err != nil {
+			closeAll()
+			return fmt.Errorf("listen '%s' fail: %w", l.address, err)
+		}
 	}
+
+	if s.options.adminAddress != "" {
+		s.adminServer = s.newAdminServer(s.options.adminAddress)
+		s.adminLn = inherited.listener(adminFDName)
+		if s.adminLn == nil {
+			adminLn, err := net.Listen("tcp", s.options.adminAddress)
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("listen admin '%s' fail: %w", s.options.adminAddress, err)
+			}
+			s.adminLn = adminLn
+		}
+	}
+
+	return nil
 }
 
+// Shutdown stop accepting, wait tunnels finish until ctx done, then force close the left
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	if s.adminServer != nil {
+		s.adminServer.Shutdown(ctx)
+	}
+	s.state.Load().stop()
+
+	var err error
+	for _, l := range s.listeners {
+		http3Done := s.shutdownHTTP3(ctx, l)
+		defer func() { <-http3Done }()
+
+		if e := l.httpServer.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if n := s.sessionCount(); n > 0 {
+		logger.Infow("shutdown wait tunnels", "count", n)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.sessionCount() == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			dropped := s.closeSessions()
+			logger.Warnw("shutdown drop tunnels", "count", dropped)
+			return fmt.Errorf("Shutdown: drop %d tunnels: %w", dropped, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) addSession(sess *session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	s.sessions[sess] = struct{}{}
+	s.tunnelsTotal.Add(1)
+}
+
+func (s *Server) removeSession(sess *session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	delete(s.sessions, sess)
+}
+
+func (s *Server) sessionCount() int {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	return len(s.sessions)
+}
+
+// closeSessions close all tunnels, return count closed
+func (s *Server) closeSessions() int {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	for sess := range s.sessions {
+		sess.close()
+	}
+
+	return len(s.sessions)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	seqId := randSeqId()
+	st := s.state.Load()
+
+	// listener removed by reload serves nothing
+	l := listenerFromContext(r.Context())
+	pol := st.policy(l)
+	if pol == nil || (r.ProtoMajor < 3 && !pol.http) || (r.ProtoMajor == 3 && !pol.http3) {
+		w.WriteHeader(404)
+		w.Write([]byte("404 page not found\n"))
+		return
+	}
 
-	if r.Method == http.MethodConnect {
+	// http-01 challenge of ca, origin form, before acl and auth of any listener
+	if st.acme != nil && r.Method == http.MethodGet && r.URL.Host == "" && isACMEChallengePath(r.URL.Path) {
+		st.acme.httpHandler.ServeHTTP(w, r)
+		return
+	}
+
+	// advertise http/3 to clients of tcp listener
+	if l != nil && l.http3Server != nil && r.ProtoMajor < 3 {
+		l.http3Server.SetQUICHeaders(w.Header())
+	}
+
+	udp := isConnectUDP(r)
+	if udp {
+		// target in path of uri template
+		target, err := udpTarget(r.URL.Path)
+		if err != nil {
+			logger.Infow("connect-udp target invalid", "err", err, "client", r.RemoteAddr, "seqId", seqId)
+			w.WriteHeader(400)
+			return
+		}
+		r.URL.Host = target
+	} else if isExtendedConnect(r) {
+		// url of extended CONNECT has only path, target is :authority
+		r.URL.Host = extendedConnectHost(r)
+	} else if r.Method == http.MethodConnect {
 		if r.URL.Port() == "" {
 			r.URL.Host = fmt.Sprintf("%s:%d", r.URL.Host, 443)
 		}
@@ -105,9 +303,14 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// not proxy request, response version
+	// not proxy request, response pac file or version
 	if r.URL.Hostname() == "" {
-		if s.options.pretendAsWeb {
+		if st.pac != nil && isPACPath(r.URL.Path) && pol.acl.AllowClient(r.RemoteAddr) {
+			s.servePAC(st, w, r, seqId)
+			return
+		}
+
+		if pol.pretendAsWeb {
 			w.WriteHeader(404)
 			w.Write([]byte("404 page not found\n"))
 			return
@@ -119,12 +322,26 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// acl
+	if !pol.acl.AllowClient(r.RemoteAddr) || !pol.acl.AllowDestination(r.URL.Host) {
+		logger.Infow("acl deny", "url", r.URL.String(), "client", r.RemoteAddr, "seqId", seqId)
+		if pol.pretendAsWeb {
+			w.WriteHeader(404)
+			w.Write([]byte("404 page not found\n"))
+			return
+		}
+
+		w.WriteHeader(403)
+		return
+	}
+
 	// auth
-	if s.options.username != "" && s.options.password != "" {
-		authorization := r.Header.Get("Proxy-Authorization")
-		username, password, ok := parseBasicAuth(authorization)
-		if !ok || username != s.options.username || password != s.options.password {
-			if s.options.pretendAsWeb {
+	var user string
+	if pol.authRequired() {
+		var ok bool
+		user, ok = s.authenticate(pol, r.Header.Get("Proxy-Authorization"))
+		if !ok {
+			if pol.pretendAsWeb {
 				w.WriteHeader(404)
 				w.Write([]byte("404 page not found\n"))
 				return
@@ -139,43 +356,125 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logger.Infow("newRequest", "url", r.URL.String(), "client", r.RemoteAddr, "seqId", seqId, "host", r.Host)
+	if header := ProxyHeaderFromContext(r.Context()); header != nil {
+		logger.Debugw("PROXY protocol", "version", header.Version, "authority", header.Authority(), "alpn", header.ALPN(), "seqId", seqId)
+	}
 	start := time.Now()
 	defer func() {
 		logger.Infow("handleRequest", "url", r.URL.String(), "duration", time.Since(start).String(), "seqId", seqId)
 	}()
 
-	remoteConn, err := s.dial("tcp", r.URL.Host)
+	if udp {
+		s.serveUDP(st, w, r, user, seqId)
+		return
+	}
+
+	tr := &tunnelRequest{
+		seqId:  seqId,
+		dest:   r.URL.Host,
+		client: r.RemoteAddr,
+		user:   user,
+	}
+	remoteConn, release, err := s.dial(st, tr)
+	if err == errRouteRejected {
+		logger.Infow("route reject", "addr", r.URL.Host, "seqId", seqId)
+		w.WriteHeader(403)
+		return
+	}
 	if err != nil {
 		logger.Warnw("dial remote fail", "err", err, "addr", r.URL.Host, "seqId", seqId)
 		return
 	}
+	defer release()
 	logger.Debugw("dial remote ok", "addr", r.URL.Host, "remote", remoteConn.RemoteAddr().String(), "seqId", seqId)
 
 	defer remoteConn.Close()
-	tcpRemoteConn, _ := remoteConn.(*net.TCPConn)
-	remoteConn = NewTimeoutConn(remoteConn, s.options.timeout)
 
-	whj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+	// track before hijack, http.Server.Shutdown waits for us until then
+	sess := newSession(st.options.idleTimeout, st.options.maxSessionDuration)
+	sess.attach(remoteConn)
+	s.addSession(sess)
+	defer s.removeSession(sess)
+
+	// extended CONNECT, handshake with origin first, then frames relayed like CONNECT
+	if isExtendedConnect(r) {
+		ctx := r.Context()
+		if st.options.handshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, st.options.handshakeTimeout)
+			defer cancel()
+		}
+
+		// origin on h2 without extended CONNECT, retried on a new conn
+		var redialed net.Conn
+		var redialRelease func()
+		redial := func() (net.Conn, error) {
+			conn, release, err := s.dial(st, tr)
+			if err != nil {
+				return nil, err
+			}
+			sess.attach(conn)
+			redialed, redialRelease = conn, release
+			return conn, nil
+		}
+		wsConn, header, err := dialWebSocket(ctx, r, remoteConn, websocketTLSConfig(r.URL.Host, r.TLS != nil), redial)
+		if redialed != nil {
+			defer redialRelease()
+			defer redialed.Close()
+		}
+		if err != nil {
+			logger.Warnw("websocket handshake fail", "err", err, "addr", r.URL.Host, "protocol", r.Header.Get(":protocol"), "seqId", seqId)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer wsConn.Close()
+		sess.attach(wsConn)
+		remoteConn = wsConn
+
+		for k, values := range header {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+		logger.Debugw("websocket handshake ok", "addr", r.URL.Host, "seqId", seqId)
+	}
+
+	// http/2 and http/3 have no hijacker, plain requests are forwarded, tunnels are the streams.
+	// http/1 ones forwarded too if forwarded headers on, so each request of keep-alive conn
+	// gets them, not only the first one. upgrades relayed, their conn is no http after response.
+	if r.Method != http.MethodConnect && (r.ProtoMajor >= 2 || st.options.forwardedHeaders && !isUpgrade(r)) {
+		s.forward(st, w, r, remoteConn, seqId)
 		return
 	}
-	conn, _, err := whj.Hijack()
+
+	conn, err := takeOverConn(w, r)
 	if err != nil {
-		logger.Warnw("hijack fail", "err", err, "seqId", seqId)
+		logger.Warnw("take over client conn fail", "err", err, "seqId", seqId)
 		return
 	}
+	defer conn.Close()
+	sess.attach(conn)
+
+	if st.options.handshakeTimeout > 0 {
+		deadline := time.Now().Add(st.options.handshakeTimeout)
+		conn.SetWriteDeadline(deadline)
+		remoteConn.SetWriteDeadline(deadline)
+	}
 
 	if r.Method == http.MethodConnect {
 		// response ok
-		_, err := conn.Write(responseConnectionEstablished)
+		err := writeEstablished(w, r, conn)
 		if err != nil {
 			logger.Warnw("https resopnse 200 fail", "err", err, "seqId", seqId)
 			return
 		}
 		logger.Debugw("write to client connection established ok", "addr", r.URL.Host, "seqId", seqId)
 	} else {
-		// write request data to remote
+		// write request data to remote, later ones of keep-alive conn relayed as is.
+		// forwarded headers here only of upgrades, others forwarded above
+		if st.options.forwardedHeaders {
+			addForwardedHeaders(r.Header, r.RemoteAddr)
+		}
 		err = r.Write(remoteConn)
 		if err != nil {
 			logger.Warnw("remote write line fail", "err", err, "seqId", seqId)
@@ -184,34 +483,156 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		logger.Debugw("write req to remote ok", "addr", r.URL.Host, "seqId", seqId)
 	}
 
-	closeWriter := mustGetWriteCloser(conn)
-	conn = NewTimeoutConn(conn, s.options.timeout)
+	up, down := relay(sess, conn, remoteConn, st.options.rateLimit)
+	s.bytesUp.Add(up)
+	s.bytesDown.Add(down)
+	logger.Debugw("relay end", "addr", r.URL.Host, "up", up, "down", down, "seqId", seqId)
+}
 
-	// see https://stackoverflow.com/a/75418345/1918831
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+// authenticate check basic auth, return username if ok
+func (s *Server) authenticate(pol *listenerPolicy, authorization string) (string, bool) {
+	username, password, ok := parseBasicAuth(authorization)
+	if !ok || !pol.checkUser(username, password) {
+		return "", false
+	}
 
-	go func() {
-		defer wg.Done()
+	return username, true
+}
 
-		var err error
-		var n int64
-		n, err = io.Copy(remoteConn, conn)
-		logger.Debugw("copy from client end", "addr", r.URL.Host, "n", n, "err", err, "seqId", seqId)
-		tcpRemoteConn.CloseWrite()
-	}()
+// takeOverConn conn of tunnel with client, hijacked for http/1, the stream for http/2 and http/3
+func takeOverConn(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor >= 2 {
+		localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		return newStreamConn(r.Body, newResponseWriter(w), nil, localAddr, streamAddr(r.RemoteAddr)), nil
+	}
 
-	go func() {
-		defer wg.Done()
+	whj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return nil, errors.New("hijack not supported")
+	}
 
-		var err error
-		var n int64
-		n, err = io.Copy(conn, remoteConn)
-		logger.Debugw("copy from remote end", "addr", r.URL.Host, "n", n, "err", err, "seqId", seqId)
-		closeWriter.CloseWrite()
-	}()
+	conn, brw, err := whj.Hijack()
+	if err != nil {
+		return nil, err
+	}
 
-	wg.Wait()
+	// bytes client sent without waiting response
+	return withBuffered(conn, brw.Reader), nil
+}
+
+// withBuffered conn reading bytes buffered by br first.
+// conns of listener unwrapped once sniffed bytes read, so raw conns keep splice.
+func withBuffered(conn net.Conn, br *bufio.Reader) net.Conn {
+	if pc, ok := conn.(*prefixConn); ok && len(pc.prefix) == 0 {
+		conn = pc.Conn
+	}
+	if pc, ok := conn.(*proxyProtoConn); ok {
+		conn = pc.Conn
+	}
+
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		return &prefixConn{Conn: conn, prefix: bytes.Clone(buffered)}
+	}
+	return conn
+}
+
+func writeEstablished(w http.ResponseWriter, r *http.Request, conn net.Conn) error {
+	if r.ProtoMajor >= 2 {
+		w.WriteHeader(http.StatusOK)
+		return http.NewResponseController(w).Flush()
+	}
+
+	_, err := conn.Write(responseConnectionEstablished)
+	return err
+}
+
+// hop-by-hop headers, not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forward plain http request of client to remote, and response back, remote conn closed after it
+func (s *Server) forward(st *serverState, w http.ResponseWriter, r *http.Request, remoteConn net.Conn, seqId string) {
+	req := r.Clone(r.Context())
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	req.Close = true
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	if st.options.forwardedHeaders {
+		addForwardedHeaders(req.Header, r.RemoteAddr)
+	}
+
+	if err := req.Write(remoteConn); err != nil {
+		logger.Warnw("remote write request fail", "err", err, "seqId", seqId)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(remoteConn), req)
+	if err != nil {
+		logger.Warnw("remote read response fail", "err", err, "seqId", seqId)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	n, err := CopyBuffer(newResponseWriter(w), resp.Body)
+	s.bytesDown.Add(n)
+	logger.Debugw("forward end", "addr", r.URL.Host, "status", resp.StatusCode, "down", n, "err", err, "seqId", seqId)
+}
+
+// isUpgrade request to switch protocol, like websocket of http/1
+func isUpgrade(r *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// addForwardedHeaders append client address, from PROXY header if any, to X-Forwarded-For and
+// Forwarded (RFC 7239) of header, skipped if not ip, like unix socket clients
+func addForwardedHeaders(header http.Header, remoteAddr string) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return
+	}
+	ip = ip.Unmap()
+
+	appendValue := func(key, value string) {
+		if prior := header.Values(key); len(prior) > 0 {
+			value = strings.Join(prior, ", ") + ", " + value
+		}
+		header.Set(key, value)
+	}
+
+	appendValue("X-Forwarded-For", ip.String())
+	if ip.Is6() {
+		appendValue("Forwarded", fmt.Sprintf(`for="[%s]"`, ip))
+	} else {
+		appendValue("Forwarded", "for="+ip.String())
+	}
 }
 
 // from package http
@@ -0,0 +1,111 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errIdleTimeout = errors.New("tunnel idle timeout")
+var errSessionExpired = errors.New("tunnel max session duration exceeded")
+
+// session tracks the activity of one tunnel, shared by both directions,
+// so a stalled direction does not kill a tunnel still active in the other.
+type session struct {
+	idleTimeout time.Duration
+	expireAt    time.Time
+
+	// unix nano of last time bytes moved in either direction
+	lastActive atomic.Int64
+
+	mu     sync.Mutex
+	conns  []io.Closer
+	closed bool
+}
+
+func newSession(idleTimeout, maxDuration time.Duration) *session {
+	now := time.Now()
+
+	s := &session{
+		idleTimeout: idleTimeout,
+	}
+	if maxDuration > 0 {
+		s.expireAt = now.Add(maxDuration)
+	}
+	s.lastActive.Store(now.UnixNano())
+
+	return s
+}
+
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// check return error if session idle too long or expired
+func (s *session) check(now time.Time) error {
+	if !s.expireAt.IsZero() && !now.Before(s.expireAt) {
+		return errSessionExpired
+	}
+
+	if s.idleTimeout > 0 && now.Sub(time.Unix(0, s.lastActive.Load())) >= s.idleTimeout {
+		return errIdleTimeout
+	}
+
+	return nil
+}
+
+// deadline the earliest time session may end, zero if never
+func (s *session) deadline() time.Time {
+	var deadline time.Time
+
+	if s.idleTimeout > 0 {
+		deadline = time.Unix(0, s.lastActive.Load()).Add(s.idleTimeout)
+	}
+
+	if !s.expireAt.IsZero() && (deadline.IsZero() || s.expireAt.Before(deadline)) {
+		deadline = s.expireAt
+	}
+
+	return deadline
+}
+
+// roundDeadline deadline of one copy round. with idle timeout, rounds end often enough
+// that an active direction marks session active before the other direction checks it.
+func (s *session) roundDeadline(now time.Time) time.Time {
+	deadline := s.deadline()
+
+	if s.idleTimeout > 0 {
+		round := now.Add(s.idleTimeout / 4)
+		if round.Before(deadline) {
+			deadline = round
+		}
+	}
+
+	return deadline
+}
+
+// attach conn to session, closed immediately if session already closed
+func (s *session) attach(conn io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return
+	}
+
+	s.conns = append(s.conns, conn)
+}
+
+// close all conns of session
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,187 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/isayme/go-logger"
+)
+
+// sniffListener peek first byte of accepted conns, socks handshakes are served by
+// socks server, others returned by Accept for http server.
+// PROXY protocol headers of trusted load balancers are read before.
+type sniffListener struct {
+	net.Listener
+	s *Server
+	// listener ln of, for policy in state
+	l *listener
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+
+	closeOnce sync.Once
+
+	// conns being sniffed, closed with listener
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+}
+
+func newSniffListener(ln net.Listener, s *Server, lst *listener) *sniffListener {
+	l := &sniffListener{
+		Listener: ln,
+		s:        s,
+		l:        lst,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+		pending:  map[net.Conn]struct{}{},
+	}
+
+	go l.acceptLoop()
+
+	return l
+}
+
+func (l *sniffListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+
+			// http server retries temporary errors only, as net/http does
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go l.sniff(conn)
+	}
+}
+
+// sniff read PROXY protocol header of trusted load balancers, then dispatch conn by
+// its first byte, socks version or start of http request or tls handshake
+func (l *sniffListener) sniff(conn net.Conn) {
+	st := l.s.state.Load()
+	pol := st.policy(l.l)
+	if pol == nil {
+		conn.Close()
+		return
+	}
+
+	trusted := st.trustProxyHeader(conn.RemoteAddr())
+	if pol.http && !pol.socks && !trusted {
+		l.push(conn)
+		return
+	}
+
+	if !l.track(conn) {
+		conn.Close()
+		return
+	}
+	defer l.untrack(conn)
+
+	if st.options.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(st.options.handshakeTimeout))
+	}
+
+	br := bufio.NewReader(conn)
+	if trusted {
+		header, err := readProxyHeader(br)
+		if err != nil {
+			logger.Infow("read PROXY protocol header fail", "err", err, "client", conn.RemoteAddr().String())
+			conn.Close()
+			return
+		}
+		if header != nil {
+			conn = &proxyProtoConn{Conn: conn, header: header}
+			logger.Debugw("PROXY protocol header", "version", header.Version, "client", conn.RemoteAddr().String(), "authority", header.Authority())
+		}
+	}
+
+	b, err := br.Peek(1)
+	if err != nil {
+		logger.Debugw("sniff conn fail", "err", err, "client", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// bytes peeked are read first
+	first := b[0]
+	buffered, _ := br.Peek(br.Buffered())
+	conn = &prefixConn{Conn: conn, prefix: bytes.Clone(buffered)}
+	// never on tls listener, socks would skip handshake
+	if pol.socks && pol.tlsConfig == nil && (first == socks4Version || first == socks5Version) {
+		go l.s.serveSOCKS(l.l, conn)
+		return
+	}
+	if !pol.http {
+		conn.Close()
+		return
+	}
+	l.push(conn)
+}
+
+func (l *sniffListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniffListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending == nil {
+		return false
+	}
+	l.pending[conn] = struct{}{}
+	return true
+}
+
+func (l *sniffListener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.pending, conn)
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stop accepting, conns being sniffed closed too
+func (l *sniffListener) Close() error {
+	err := l.Listener.Close()
+
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for conn := range l.pending {
+			conn.Close()
+		}
+		l.pending = nil
+	})
+
+	return err
+}
@@ -0,0 +1,699 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/isayme/go-logger"
+)
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	// version of username/password subnegotiation, RFC 1929
+	socks5UserPassVersion = 0x01
+)
+
+// socks5 auth methods
+const (
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+)
+
+// socks commands, same in socks4 and socks5
+const (
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+)
+
+// socks5 address types
+const (
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// socks5 replies
+const (
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5ConnectionRefused   = 0x05
+	socks5CommandNotSupported = 0x07
+	socks5AddrNotSupported    = 0x08
+)
+
+// socks4 replies
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// max destinations of an udp association cached, cache reset if exceeded
+const maxSOCKSUDPDests = 1024
+
+var errSOCKSAddrType = errors.New("address type not supported")
+
+// socksReply reply of request, by socks5 reply code, bind address may be nil
+type socksReply func(rep byte, bind net.Addr) error
+
+// serveSOCKS serve socks conn sniffed by listener, first byte is version
+func (s *Server) serveSOCKS(l *listener, conn net.Conn) {
+	seqId := randSeqId()
+	st := s.state.Load()
+	defer conn.Close()
+
+	pol := st.policy(l)
+	if pol == nil {
+		return
+	}
+
+	client := conn.RemoteAddr().String()
+	if !pol.acl.AllowClient(client) {
+		logger.Infow("acl deny", "client", client, "seqId", seqId)
+		return
+	}
+
+	if st.options.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(st.options.handshakeTimeout))
+	}
+
+	br := bufio.NewReader(conn)
+	version, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch version {
+	case socks4Version:
+		err = s.serveSOCKS4(st, pol, conn, br, seqId)
+	case socks5Version:
+		err = s.serveSOCKS5(st, pol, conn, br, seqId)
+	}
+	if err != nil {
+		logger.Infow("socks handshake fail", "err", err, "version", version, "client", client, "seqId", seqId)
+	}
+}
+
+// serveSOCKS4 socks4 and socks4a, which have no password, so refused if auth required
+func (s *Server) serveSOCKS4(st *serverState, pol *listenerPolicy, conn net.Conn, br *bufio.Reader, seqId string) error {
+	var head [7]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return err
+	}
+	userID, err := readNullTerminated(br)
+	if err != nil {
+		return err
+	}
+
+	cmd := head[0]
+	port := binary.BigEndian.Uint16(head[1:3])
+	host := net.IP(head[3:7]).String()
+	// socks4a, ip 0.0.0.x with domain after user id
+	if head[3] == 0 && head[4] == 0 && head[5] == 0 && head[6] != 0 {
+		if host, err = readNullTerminated(br); err != nil {
+			return err
+		}
+	}
+
+	reply := func(rep byte, bind net.Addr) error {
+		b := []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}
+		if rep != socks5Succeeded {
+			b[1] = socks4Rejected
+		}
+		_, err := conn.Write(b)
+		return err
+	}
+
+	if pol.authRequired() {
+		reply(socks5NotAllowed, nil)
+		return fmt.Errorf("auth required, user id '%s'", userID)
+	}
+	if cmd != socksCmdConnect {
+		reply(socks5CommandNotSupported, nil)
+		return fmt.Errorf("command %d not supported", cmd)
+	}
+
+	s.socksConnect(st, pol, conn, br, &tunnelRequest{
+		seqId:  seqId,
+		dest:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+		client: conn.RemoteAddr().String(),
+	}, "socks4", reply)
+	return nil
+}
+
+func (s *Server) serveSOCKS5(st *serverState, pol *listenerPolicy, conn net.Conn, br *bufio.Reader, seqId string) error {
+	user, err := s.socks5Auth(pol, conn, br)
+	if err != nil {
+		return err
+	}
+
+	var head [3]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return fmt.Errorf("version %d of request invalid", head[0])
+	}
+
+	reply := func(rep byte, bind net.Addr) error {
+		b := []byte{socks5Version, rep, 0}
+		b = appendSOCKS5Addr(b, addrPort(bind))
+		_, err := conn.Write(b)
+		return err
+	}
+
+	dest, err := readSOCKS5Addr(br)
+	if err != nil {
+		if err == errSOCKSAddrType {
+			reply(socks5AddrNotSupported, nil)
+		}
+		return err
+	}
+
+	req := &tunnelRequest{
+		seqId:  seqId,
+		dest:   dest,
+		client: conn.RemoteAddr().String(),
+		user:   user,
+	}
+
+	switch head[1] {
+	case socksCmdConnect:
+		s.socksConnect(st, pol, conn, br, req, "socks5", reply)
+	case socksCmdUDPAssociate:
+		s.socksUDPAssociate(st, pol, conn, br, req, reply)
+	default:
+		reply(socks5CommandNotSupported, nil)
+		return fmt.Errorf("command %d not supported", head[1])
+	}
+
+	return nil
+}
+
+// socks5Auth negotiate auth method, username/password if users configured, return username
+func (s *Server) socks5Auth(pol *listenerPolicy, conn net.Conn, br *bufio.Reader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5MethodNoAcceptable)
+	switch {
+	case pol.authRequired():
+		if bytes.IndexByte(methods, socks5MethodUserPass) >= 0 {
+			method = socks5MethodUserPass
+		}
+	case bytes.IndexByte(methods, socks5MethodNoAuth) >= 0:
+		method = socks5MethodNoAuth
+	case bytes.IndexByte(methods, socks5MethodUserPass) >= 0:
+		// no users, any credential accepted
+		method = socks5MethodUserPass
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	switch method {
+	case socks5MethodNoAcceptable:
+		return "", errors.New("no acceptable auth method")
+	case socks5MethodNoAuth:
+		return "", nil
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if version != socks5UserPassVersion {
+		return "", fmt.Errorf("version %d of auth invalid", version)
+	}
+	username, err := readSOCKSString(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSOCKSString(br)
+	if err != nil {
+		return "", err
+	}
+
+	if pol.authRequired() && !pol.checkUser(username, password) {
+		conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return "", fmt.Errorf("auth fail, username '%s'", username)
+	}
+	if _, err := conn.Write([]byte{socks5UserPassVersion, 0x00}); err != nil {
+		return "", err
+	}
+
+	if !pol.authRequired() {
+		return "", nil
+	}
+	return username, nil
+}
+
+// socksConnect tunnel of connect command, the same as http CONNECT
+func (s *Server) socksConnect(st *serverState, pol *listenerPolicy, conn net.Conn, br *bufio.Reader, req *tunnelRequest, scheme string, reply socksReply) {
+	seqId := req.seqId
+	url := fmt.Sprintf("%s://%s", scheme, req.dest)
+
+	if !pol.acl.AllowDestination(req.dest) {
+		logger.Infow("acl deny", "url", url, "client", req.client, "seqId", seqId)
+		reply(socks5NotAllowed, nil)
+		return
+	}
+
+	logger.Infow("newRequest", "url", url, "client", req.client, "seqId", seqId)
+	start := time.Now()
+	defer func() {
+		logger.Infow("handleRequest", "url", url, "duration", time.Since(start).String(), "seqId", seqId)
+	}()
+
+	remoteConn, release, err := s.dial(st, req)
+	if err == errRouteRejected {
+		logger.Infow("route reject", "addr", req.dest, "seqId", seqId)
+		reply(socks5NotAllowed, nil)
+		return
+	}
+	if err != nil {
+		logger.Warnw("dial remote fail", "err", err, "addr", req.dest, "seqId", seqId)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			reply(socks5ConnectionRefused, nil)
+		} else {
+			reply(socks5HostUnreachable, nil)
+		}
+		return
+	}
+	defer release()
+	defer remoteConn.Close()
+	logger.Debugw("dial remote ok", "addr", req.dest, "remote", remoteConn.RemoteAddr().String(), "seqId", seqId)
+
+	sess := newSession(st.options.idleTimeout, st.options.maxSessionDuration)
+	sess.attach(remoteConn)
+	sess.attach(conn)
+	s.addSession(sess)
+	defer s.removeSession(sess)
+
+	if err := reply(socks5Succeeded, remoteConn.LocalAddr()); err != nil {
+		logger.Warnw("socks reply fail", "err", err, "seqId", seqId)
+		return
+	}
+	logger.Debugw("write to client socks reply ok", "addr", req.dest, "seqId", seqId)
+
+	up, down := relay(sess, withBuffered(conn, br), remoteConn, st.options.rateLimit)
+	s.bytesUp.Add(up)
+	s.bytesDown.Add(down)
+	logger.Debugw("relay end", "addr", req.dest, "up", up, "down", down, "seqId", seqId)
+}
+
+// socksUDPAssociate relay udp datagrams of client until control conn closed or idle.
+// dest of request is where client sends from, unspecified if unknown.
+func (s *Server) socksUDPAssociate(st *serverState, pol *listenerPolicy, conn net.Conn, br *bufio.Reader, req *tunnelRequest, reply socksReply) {
+	seqId := req.seqId
+	clientIP, _ := addrIP(req.client)
+
+	logger.Infow("newRequest", "url", "socks5-udp://"+req.dest, "client", req.client, "seqId", seqId)
+	start := time.Now()
+	defer func() {
+		logger.Infow("handleRequest", "url", "socks5-udp://"+req.dest, "duration", time.Since(start).String(), "seqId", seqId)
+	}()
+
+	// relay socket on local address client connected to
+	var localIP net.IP
+	if addr, ok := socketLocalAddr(conn).(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		logger.Warnw("listen udp fail", "err", err, "seqId", seqId)
+		reply(socks5GeneralFailure, nil)
+		return
+	}
+	defer clientConn.Close()
+
+	remoteConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.Warnw("listen udp fail", "err", err, "seqId", seqId)
+		reply(socks5GeneralFailure, nil)
+		return
+	}
+	defer remoteConn.Close()
+
+	sess := newSession(st.options.udpIdleTimeout, st.options.maxSessionDuration)
+	sess.attach(conn)
+	sess.attach(clientConn)
+	sess.attach(remoteConn)
+	s.addSession(sess)
+	defer s.removeSession(sess)
+
+	if err := reply(socks5Succeeded, clientConn.LocalAddr()); err != nil {
+		logger.Warnw("socks reply fail", "err", err, "seqId", seqId)
+		return
+	}
+	logger.Debugw("udp associate ok", "bind", clientConn.LocalAddr().String(), "seqId", seqId)
+
+	// association ends with control conn
+	conn.SetDeadline(time.Time{})
+	go func() {
+		io.Copy(io.Discard, br)
+		sess.close()
+	}()
+
+	a := &socksAssociation{
+		s:          s,
+		st:         st,
+		pol:        pol,
+		req:        req,
+		sess:       sess,
+		clientConn: clientConn,
+		remoteConn: remoteConn,
+		dests:      map[string]netip.AddrPort{},
+		peers:      map[netip.AddrPort]struct{}{},
+	}
+	// datagrams accepted from ip of control conn, and port of request if given
+	a.clientIP = clientIP.Unmap()
+	if ap, err := netip.ParseAddrPort(req.dest); err == nil {
+		a.clientPort = ap.Port()
+	}
+
+	up, down := a.relay()
+	s.bytesUp.Add(up)
+	s.bytesDown.Add(down)
+	logger.Debugw("udp relay end", "up", up, "down", down, "seqId", seqId)
+}
+
+// socksAssociation udp relay of socks5 udp associate
+type socksAssociation struct {
+	s    *Server
+	st   *serverState
+	pol  *listenerPolicy
+	req  *tunnelRequest
+	sess *session
+
+	clientIP   netip.Addr
+	clientPort uint16
+	// where client sends from, set by its first datagram
+	client atomic.Pointer[netip.AddrPort]
+
+	clientConn *net.UDPConn
+	remoteConn *net.UDPConn
+
+	// destination to resolved address, invalid if denied, used by up direction only
+	dests map[string]netip.AddrPort
+
+	// remote addresses datagrams sent to, only replies of them relayed
+	mu    sync.Mutex
+	peers map[netip.AddrPort]struct{}
+}
+
+// relay datagrams until session closed, return payload bytes client -> remote and remote -> client
+func (a *socksAssociation) relay() (up, down int64) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer a.sess.close()
+
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, from, err := readUDP(a.sess, a.clientConn, buf)
+			if err != nil {
+				return
+			}
+			if n < 0 || from.Addr() != a.clientIP || (a.clientPort != 0 && from.Port() != a.clientPort) {
+				continue
+			}
+
+			dest, payload, err := parseSOCKS5UDP(buf[:n])
+			if err != nil {
+				continue
+			}
+			addr := a.resolve(dest)
+			if !addr.IsValid() {
+				continue
+			}
+
+			a.client.Store(&from)
+			a.addPeer(addr)
+			// lost like udp, unless conn closed
+			if _, err := a.remoteConn.WriteToUDPAddrPort(payload, addr); errors.Is(err, net.ErrClosed) {
+				return
+			}
+			up += int64(len(payload))
+			a.sess.touch()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer a.sess.close()
+
+		buf := make([]byte, maxUDPPayload)
+		var wbuf []byte
+		for {
+			n, from, err := readUDP(a.sess, a.remoteConn, buf)
+			if err != nil {
+				return
+			}
+			client := a.client.Load()
+			if n < 0 || client == nil || !a.isPeer(from) {
+				continue
+			}
+
+			wbuf = appendSOCKS5Addr(append(wbuf[:0], 0, 0, 0), from)
+			wbuf = append(wbuf, buf[:n]...)
+			if _, err := a.clientConn.WriteToUDPAddrPort(wbuf, *client); errors.Is(err, net.ErrClosed) {
+				return
+			}
+			down += int64(n)
+			a.sess.touch()
+		}
+	}()
+
+	wg.Wait()
+
+	return up, down
+}
+
+// resolve address of destination if allowed by acl and routed to direct, invalid otherwise
+func (a *socksAssociation) resolve(dest string) netip.AddrPort {
+	if addr, ok := a.dests[dest]; ok {
+		return addr
+	}
+	if len(a.dests) >= maxSOCKSUDPDests {
+		clear(a.dests)
+		a.mu.Lock()
+		clear(a.peers)
+		a.mu.Unlock()
+	}
+
+	st, seqId := a.st, a.req.seqId
+	req := *a.req
+	req.dest = dest
+
+	var addr netip.AddrPort
+	if !a.pol.acl.AllowDestination(dest) {
+		logger.Infow("acl deny", "url", "socks5-udp://"+dest, "client", req.client, "seqId", seqId)
+	} else if err := a.s.routeUDP(st, &req); err != nil {
+		logger.Infow("udp route fail", "err", err, "addr", dest, "seqId", seqId)
+	} else if resolved, err := resolveAddrPort(st, dest); err != nil {
+		logger.Warnw("resolve udp destination fail", "err", err, "addr", dest, "seqId", seqId)
+	} else {
+		addr = resolved
+		logger.Debugw("udp destination ok", "addr", dest, "remote", addr.String(), "seqId", seqId)
+	}
+
+	a.dests[dest] = addr
+	return addr
+}
+
+func (a *socksAssociation) addPeer(addr netip.AddrPort) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.peers[addr] = struct{}{}
+}
+
+func (a *socksAssociation) isPeer(addr netip.AddrPort) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.peers[addr]
+	return ok
+}
+
+// readUDP read a datagram in rounds of session deadline, n is -1 if round done without one
+func readUDP(sess *session, conn *net.UDPConn, buf []byte) (int, netip.AddrPort, error) {
+	now := time.Now()
+	if err := sess.check(now); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	if err := conn.SetReadDeadline(sess.roundDeadline(now)); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	n, from, err := conn.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		if isTimeout(err) {
+			return -1, from, nil
+		}
+		return 0, from, err
+	}
+
+	return n, netip.AddrPortFrom(from.Addr().Unmap(), from.Port()), nil
+}
+
+// resolveAddrPort address of host:port, domain resolved within connect timeout
+func resolveAddrPort(st *serverState, hostport string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(ip.Unmap(), uint16(portNum)), nil
+	}
+
+	ctx := context.Background()
+	if st.options.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.options.connectTimeout)
+		defer cancel()
+	}
+
+	ips, err := st.resolver.lookup(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(portNum)), nil
+}
+
+// parseSOCKS5UDP destination and payload of udp request datagram, fragments not supported
+func parseSOCKS5UDP(b []byte) (string, []byte, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return "", nil, errors.New("udp header invalid")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("udp fragment not supported")
+	}
+
+	r := bytes.NewReader(b[3:])
+	dest, err := readSOCKS5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return dest, b[len(b)-r.Len():], nil
+}
+
+// readSOCKS5Addr host:port of address type, address and port
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		domain, err := readSOCKSString(r)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		return "", errSOCKSAddrType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKS5Addr append address type, address and port, ipv4 zeros if addr invalid
+func appendSOCKS5Addr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	switch {
+	case ip.Is4():
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip.AsSlice()...)
+	case ip.Is6():
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.AsSlice()...)
+	default:
+		b = append(b, socks5AddrIPv4, 0, 0, 0, 0)
+	}
+
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// addrPort address of tcp or udp addr, invalid otherwise
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.AddrPort()
+	case *net.UDPAddr:
+		return addr.AddrPort()
+	default:
+		return netip.AddrPort{}
+	}
+}
+
+// readSOCKSString string prefixed by length byte
+func readSOCKSString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readNullTerminated string of socks4 request
+func readNullTerminated(br *bufio.Reader) (string, error) {
+	b, err := br.ReadSlice(0)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:len(b)-1]), nil
+}
@@ -0,0 +1,168 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func socks5Dialer(auth *proxy.Auth) proxy.Dialer {
+	dialer, _ := proxy.SOCKS5("tcp", "127.0.0.1:8080", auth, proxy.Direct)
+	return dialer
+}
+
+func TestSOCKS5(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+	echoPort := uint16(echoLn.Addr().(*net.TCPAddr).Port)
+
+	acl, err := NewACL(nil, nil, []uint16{echoPort})
+	require.Nil(err)
+	server := startProxy(require, WithListenAddress(":8080"), WithSOCKS(true), WithUsers(map[string]string{"foo": "bar"}), WithACL(acl))
+	defer server.Shutdown(context.Background())
+
+	conn, err := socks5Dialer(&proxy.Auth{User: "foo", Password: "bar"}).Dial("tcp", echoLn.Addr().String())
+	require.Nil(err)
+	echo(require, conn, "hello")
+	echo(require, conn, "world")
+	require.Equal(1, server.sessionCount())
+	conn.Close()
+
+	// wrong password
+	_, err = socks5Dialer(&proxy.Auth{User: "foo", Password: "baz"}).Dial("tcp", echoLn.Addr().String())
+	require.NotNil(err)
+
+	// no auth
+	_, err = socks5Dialer(nil).Dial("tcp", echoLn.Addr().String())
+	require.NotNil(err)
+
+	// acl of destination port
+	_, err = socks5Dialer(&proxy.Auth{User: "foo", Password: "bar"}).Dial("tcp", "127.0.0.1:1")
+	require.ErrorContains(err, "not allowed")
+
+	// http on the same port
+	resp, err := http.Get("http://127.0.0.1:8080/")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	require.Eventually(func() bool {
+		return server.sessionCount() == 0
+	}, time.Second, time.Millisecond*10)
+
+	// not with tls, sniffed before handshake
+	certFile, keyFile := writeCertFiles(require, newSelfSignedCert(require))
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	_, err = NewServer(WithSOCKS(true), WithCertFile(certFile), WithKeyFile(keyFile))
+	require.ErrorContains(err, "socks not supported on tls listener")
+}
+
+func TestSOCKS4(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+	port := binary.BigEndian.AppendUint16(nil, uint16(echoLn.Addr().(*net.TCPAddr).Port))
+
+	server := startProxy(require, WithListenAddress(":8080"), WithSOCKS(true))
+	defer server.Shutdown(context.Background())
+
+	socks4 := append(append([]byte{4, 1}, port...), 127, 0, 0, 1)
+	socks4 = append(socks4, "user\x00"...)
+	socks4a := append(append([]byte{4, 1}, port...), 0, 0, 0, 1)
+	socks4a = append(socks4a, "user\x00localhost\x00"...)
+
+	for _, req := range [][]byte{socks4, socks4a} {
+		conn, err := net.Dial("tcp", "127.0.0.1:8080")
+		require.Nil(err)
+
+		// data sent before reply
+		_, err = conn.Write(append(req, "hello"...))
+		require.Nil(err)
+
+		reply := make([]byte, 8)
+		_, err = io.ReadFull(conn, reply)
+		require.Nil(err)
+		require.Equal(byte(socks4Granted), reply[1])
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(err)
+		require.Equal("hello", string(buf))
+		echo(require, conn, "world")
+		conn.Close()
+	}
+
+	// bind not supported
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write(append(append([]byte{4, 2}, port...), 127, 0, 0, 1, 0))
+	require.Nil(err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.Nil(err)
+	require.Equal(byte(socks4Rejected), reply[1])
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	require := require.New(t)
+
+	echo := startUDPEchoServer(require)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	server := startProxy(require, WithListenAddress(":8080"), WithSOCKS(true))
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+	defer conn.Close()
+
+	// no auth, udp associate from unknown address
+	_, err = conn.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	require.Nil(err)
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(conn, reply)
+	require.Nil(err)
+	require.Equal([]byte{5, 0}, reply[:2])
+	require.Equal(byte(socks5Succeeded), reply[3])
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(binary.BigEndian.Uint16(reply[10:]))}
+
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	require.Nil(err)
+	defer udpConn.Close()
+
+	// by domain type and by ip type, reply from ip
+	domain := append([]byte{0, 0, 0, socks5AddrDomain, 9}, "127.0.0.1"...)
+	domain = binary.BigEndian.AppendUint16(domain, echoAddr.Port())
+	for _, b := range [][]byte{domain, appendSOCKS5Addr([]byte{0, 0, 0}, echoAddr)} {
+		_, err = udpConn.Write(append(b, "hello"...))
+		require.Nil(err)
+
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		n, err := udpConn.Read(buf)
+		require.Nil(err)
+		header := appendSOCKS5Addr([]byte{0, 0, 0}, echoAddr)
+		require.Equal(append(header, "hello"...), buf[:n])
+	}
+	require.Equal(1, server.sessionCount())
+
+	// association ends with control conn
+	conn.Close()
+	require.Eventually(func() bool {
+		return server.sessionCount() == 0
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,205 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+)
+
+// serverState options and what derived from them, swapped as a whole on reload.
+// a request loads state once, so running tunnels keep the state they started with.
+type serverState struct {
+	options serverOptions
+
+	// username to password
+	users map[string]string
+
+	// resolver of direct dials and upstream hosts
+	resolver *resolver
+
+	// nil if no upstreams
+	upstreams *upstreamPool
+
+	// rule set name to rule set
+	ruleSets map[string]*ruleSet
+	router   *router
+
+	// nil if pac disabled
+	pac *pacGenerator
+
+	// load balancers sending PROXY protocol header
+	proxyProtocolTrusted []netip.Prefix
+
+	// nil if acme not set
+	acme *acmeManager
+
+	// listener name to its policy, main listener of listen address has empty name
+	listeners map[string]*listenerPolicy
+}
+
+func newServerState(opts ...ServerOption) (*serverState, error) {
+	st := &serverState{}
+
+	for _, opt := range opts {
+		opt.apply(&st.options)
+	}
+
+	st.users = map[string]string{}
+	for username, password := range st.options.users {
+		st.users[username] = password
+	}
+	if st.options.username != "" && st.options.password != "" {
+		st.users[st.options.username] = st.options.password
+	}
+
+	resolver, err := newResolver(st.options.dns)
+	if err != nil {
+		return nil, fmt.Errorf("dns: %w", err)
+	}
+	st.resolver = resolver
+
+	upstreams := st.options.upstreams
+	if st.options.proxy != "" {
+		upstreams = append([]UpstreamConfig{{Name: "proxy", URL: st.options.proxy, TLS: st.options.proxyTLS}}, upstreams...)
+	}
+	if len(upstreams) > 0 {
+		pool, err := newUpstreamPool(st.options.upstreamStrategy, upstreams, st.options.healthCheck, st.resolver)
+		if err != nil {
+			return nil, err
+		}
+		st.upstreams = pool
+	}
+
+	st.ruleSets = map[string]*ruleSet{}
+	for _, c := range st.options.ruleSets {
+		rs, err := newRuleSet(c)
+		if err != nil {
+			return nil, err
+		}
+		st.ruleSets[c.Name] = rs
+	}
+
+	router, err := newRouter(st.options.rules, st.options.defaultOutbound, st.upstreams, st.ruleSets)
+	if err != nil {
+		return nil, fmt.Errorf("create router fail: %w", err)
+	}
+	st.router = router
+
+	trusted, err := parsePrefixes(st.options.proxyProtocol.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy-protocol trusted fail: %w", err)
+	}
+	st.proxyProtocolTrusted = trusted
+
+	if st.options.acme.enabled() {
+		acm, err := newACMEManager(st.options.acme)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %w", err)
+		}
+		st.acme = acm
+	}
+
+	main, err := st.mainListenerPolicy()
+	if err != nil {
+		return nil, err
+	}
+	st.listeners = map[string]*listenerPolicy{"": main}
+	for _, c := range st.options.listeners {
+		if _, ok := st.listeners[c.Name]; ok {
+			return nil, fmt.Errorf("listener name '%s' duplicated", c.Name)
+		}
+		pol, err := newListenerPolicy(c, st.acme)
+		if err != nil {
+			return nil, fmt.Errorf("create listener '%s' fail: %w", c.Name, err)
+		}
+		st.listeners[c.Name] = pol
+	}
+
+	if st.options.pac.Enabled {
+		pac, err := newPACGenerator(st.options.pac, main.tlsConfig != nil)
+		if err != nil {
+			return nil, err
+		}
+		st.pac = pac
+	}
+
+	return st, nil
+}
+
+// mainListenerPolicy policy of listen address, by top level options
+func (st *serverState) mainListenerPolicy() (*listenerPolicy, error) {
+	pol := &listenerPolicy{
+		users:        st.users,
+		acl:          st.options.acl,
+		pretendAsWeb: st.options.pretendAsWeb,
+		http:         true,
+		socks:        st.options.socks,
+		http3:        st.options.http3,
+		acme:         st.acme,
+	}
+
+	certFile, keyFile := st.options.certFile, st.options.keyFile
+	if certFile == "" || keyFile == "" {
+		certFile, keyFile = "", ""
+	}
+	if certFile != "" || st.options.tls.CertDir != "" || pol.acme != nil {
+		if err := pol.setTLS(certFile, keyFile, st.options.tls); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	// sniffed before tls handshake, socks would skip tls
+	if pol.socks && pol.tlsConfig != nil {
+		return nil, errors.New("socks not supported on tls listener")
+	}
+	return pol, nil
+}
+
+// reuse acme manager and dns cache of old state if their config not changed, so certificates,
+// renewals and cached answers kept. called before state used.
+func (st *serverState) reuse(old *serverState) {
+	if reflect.DeepEqual(st.options.dns, old.options.dns) {
+		st.resolver.cache = old.resolver.cache
+	}
+
+	if st.acme == nil || old.acme == nil || !reflect.DeepEqual(st.options.acme, old.options.acme) {
+		return
+	}
+
+	st.acme = old.acme
+	for _, pol := range st.listeners {
+		if pol.acme != nil {
+			pol.acme = old.acme
+		}
+	}
+}
+
+// start background jobs of state
+func (st *serverState) start() {
+	if st.upstreams != nil {
+		st.upstreams.startHealthCheck()
+	}
+	for _, rs := range st.ruleSets {
+		rs.start()
+	}
+	for _, pol := range st.listeners {
+		if pol.certs != nil {
+			pol.certs.start()
+		}
+	}
+}
+
+// stop background jobs of state, running tunnels not affected
+func (st *serverState) stop() {
+	if st.upstreams != nil {
+		st.upstreams.stopHealthCheck()
+	}
+	for _, rs := range st.ruleSets {
+		rs.stopWatch()
+	}
+	for _, pol := range st.listeners {
+		if pol.certs != nil {
+			pol.certs.stopWatch()
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// streamConn net.Conn of a full-duplex http stream, reading body and writing w.
+// deadlines and half close are supported for relay.
+type streamConn struct {
+	body   io.ReadCloser
+	w      io.WriteCloser
+	cancel func()
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	reads   chan readResult
+	pending []byte
+	readErr error
+	// pending consumed, buffer of readLoop free to reuse
+	drained chan struct{}
+
+	readDeadline  *pipeDeadline
+	writeDeadline *pipeDeadline
+	writeTimer    *time.Timer
+	writing       atomic.Int32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "stream" }
+func (a streamAddr) String() string  { return string(a) }
+
+func newStreamConn(body io.ReadCloser, w io.WriteCloser, cancel func(), localAddr, remoteAddr net.Addr) *streamConn {
+	if localAddr == nil {
+		localAddr = streamAddr("local")
+	}
+	if remoteAddr == nil {
+		remoteAddr = streamAddr("remote")
+	}
+	if cancel == nil {
+		cancel = func() {}
+	}
+
+	c := &streamConn{
+		body:          body,
+		w:             w,
+		cancel:        cancel,
+		localAddr:     localAddr,
+		remoteAddr:    remoteAddr,
+		reads:         make(chan readResult),
+		drained:       make(chan struct{}, 1),
+		readDeadline:  newPipeDeadline(),
+		writeDeadline: newPipeDeadline(),
+		closed:        make(chan struct{}),
+	}
+	go c.readLoop()
+
+	return c
+}
+
+// readLoop read body in background, so reads can be interrupted by deadline
+func (c *streamConn) readLoop() {
+	buf := make([]byte, bufSize)
+	for {
+		n, err := c.body.Read(buf)
+
+		select {
+		case c.reads <- readResult{buf[:n], err}:
+		case <-c.closed:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-c.drained:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		select {
+		case r := <-c.reads:
+			c.pending = r.data
+			c.readErr = r.err
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+
+		if len(c.pending) == 0 {
+			c.drain()
+			return 0, c.readErr
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 {
+		c.drain()
+	}
+	return n, nil
+}
+
+// drain let readLoop read next into its buffer, unless body ended
+func (c *streamConn) drain() {
+	if c.readErr == nil {
+		c.drained <- struct{}{}
+	}
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	c.writing.Add(1)
+	defer c.writing.Add(-1)
+	return c.w.Write(p)
+}
+
+// CloseWrite end stream of write side, close conn if writer can not half close
+func (c *streamConn) CloseWrite() error {
+	cw, ok := c.w.(CloseWriter)
+	if !ok {
+		return c.w.Close()
+	}
+
+	err := cw.CloseWrite()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return c.Close()
+	}
+	return err
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.w.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline by writer if it supports, otherwise a blocked write can only be
+// interrupted by close, so the conn is closed if a write is blocked when deadline exceeded
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if wd, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return wd.SetWriteDeadline(t)
+	}
+
+	c.writeDeadline.set(t)
+	if c.writeTimer != nil {
+		c.writeTimer.Stop()
+		c.writeTimer = nil
+	}
+	if !t.IsZero() {
+		c.writeTimer = time.AfterFunc(time.Until(t), func() {
+			if c.writing.Load() > 0 {
+				c.Close()
+			}
+		})
+	}
+	return nil
+}
+
+// pipeDeadline deadline as a channel closed when exceeded, see net.pipeDeadline
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newPipeDeadline() *pipeDeadline {
+	return &pipeDeadline{cancel: make(chan struct{})}
+}
+
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// responseWriter write and flush response body of a stream, for streamConn of server side
+type responseWriter struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	closed atomic.Bool
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{
+		w:  w,
+		rc: http.NewResponseController(w),
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.closed.Load() {
+		return 0, net.ErrClosed
+	}
+
+	n, err := rw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, rw.rc.Flush()
+}
+
+func (rw *responseWriter) SetWriteDeadline(t time.Time) error {
+	return rw.rc.SetWriteDeadline(t)
+}
+
+// Close stop writing, stream ends when handler returns
+func (rw *responseWriter) Close() error {
+	rw.closed.Store(true)
+	return nil
+}
+
+// CloseWrite end stream of response while request body still read, by http/3 only,
+// as handler of http/2 in package http can not end response before returning
+func (rw *responseWriter) CloseWrite() error {
+	streamer, ok := rw.w.(http3.HTTPStreamer)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if rw.closed.Swap(true) {
+		return nil
+	}
+
+	return streamer.HTTPStream().Close()
+}
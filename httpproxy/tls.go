@@ -0,0 +1,116 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// UpstreamTLSConfig tls to https upstream, certificate verified by system roots by default
+type UpstreamTLSConfig struct {
+	// pem ca bundle, replaces system roots
+	CAFile string `yaml:"ca-file" toml:"ca-file"`
+	// verify certificate for this name instead of host of url
+	ServerName string `yaml:"server-name" toml:"server-name"`
+	// base64 sha256 of subject public key info, any certificate in chain must match one
+	PinSHA256 []string `yaml:"pin-sha256" toml:"pin-sha256"`
+	// skip certificate verification, pins still checked
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+	// client certificate
+	CertFile string `yaml:"cert-file" toml:"cert-file"`
+	KeyFile  string `yaml:"key-file" toml:"key-file"`
+}
+
+func (c UpstreamTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert-file and key-file must be set together")
+	}
+
+	for _, pin := range c.PinSHA256 {
+		if _, err := decodePin(pin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tlsConfig nil if all default
+func (c UpstreamTLSConfig) tlsConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.ServerName == "" && len(c.PinSHA256) == 0 && !c.Insecure && c.CertFile == "" {
+		return nil, nil
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.Insecure,
+	}
+
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file fail: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in ca file '%s'", c.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate fail: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.PinSHA256) > 0 {
+		var pins [][]byte
+		for _, pin := range c.PinSHA256 {
+			hash, _ := decodePin(pin)
+			pins = append(pins, hash)
+		}
+
+		// run after verification, even if insecure. certificates sent by peer are not
+		// proof of anything, so verified chains, or only the leaf if insecure.
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			chains := cs.VerifiedChains
+			if c.Insecure && len(cs.PeerCertificates) > 0 {
+				chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+			}
+			for _, chain := range chains {
+				for _, cert := range chain {
+					hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(hash[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return errors.New("no certificate matches pinned public key")
+		}
+	}
+
+	return conf, nil
+}
+
+func decodePin(pin string) ([]byte, error) {
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("pin-sha256 '%s' invalid, must be base64 of sha256", pin)
+	}
+	return hash, nil
+}
@@ -0,0 +1,187 @@
+package httpproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	server, err := NewServer()
+	require.Nil(err)
+	upstream := httptest.NewTLSServer(server)
+	defer upstream.Close()
+
+	cert := upstream.Certificate()
+	caFile := writeTempFile(require, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	defer os.Remove(caFile)
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	u, err := url.Parse(upstream.URL)
+	require.Nil(err)
+
+	dial := func(c UpstreamTLSConfig) error {
+		conf, err := c.tlsConfig()
+		require.Nil(err)
+		hp, err := NewHttpProxyWithTLS(u, proxy.Direct, conf)
+		require.Nil(err)
+
+		conn, err := hp.Dial("tcp", echoLn.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("ping"))
+		require.Nil(err)
+		buf := make([]byte, 4)
+		_, err = conn.Read(buf)
+		require.Nil(err)
+		require.Equal("ping", string(buf))
+		return nil
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	require.ErrorAs(dial(UpstreamTLSConfig{}), &unknownAuthority)
+	require.Nil(dial(UpstreamTLSConfig{CAFile: caFile}))
+	require.Nil(dial(UpstreamTLSConfig{Insecure: true}))
+	require.Nil(dial(UpstreamTLSConfig{CAFile: caFile, PinSHA256: []string{wrongPin, pin}}))
+	require.ErrorContains(dial(UpstreamTLSConfig{Insecure: true, PinSHA256: []string{wrongPin}}), "pinned")
+
+	// certificate of httptest is for example.com and 127.0.0.1
+	require.Nil(dial(UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com"}))
+	var hostnameErr x509.HostnameError
+	require.ErrorAs(dial(UpstreamTLSConfig{CAFile: caFile, ServerName: "other.com"}), &hostnameErr)
+}
+
+// pinned certificate appended to chain by peer, not signing it, not matched
+func TestUpstreamTLSPinChain(t *testing.T) {
+	require := require.New(t)
+
+	leaf := newSelfSignedCert(require)
+	pinned := newSelfSignedCert(require)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Certificate[0], pinned.Certificate[0]},
+		PrivateKey:  leaf.PrivateKey,
+	}}})
+	require.Nil(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	pin := func(der []byte) string {
+		cert, err := x509.ParseCertificate(der)
+		require.Nil(err)
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(hash[:])
+	}
+	caFile := writeTempFile(require, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Certificate[0]})))
+	defer os.Remove(caFile)
+
+	dial := func(c UpstreamTLSConfig) error {
+		conf, err := c.tlsConfig()
+		require.Nil(err)
+		conn, err := tls.Dial("tcp", ln.Addr().String(), conf)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	require.ErrorContains(dial(UpstreamTLSConfig{Insecure: true, PinSHA256: []string{pin(pinned.Certificate[0])}}), "pinned")
+	require.ErrorContains(dial(UpstreamTLSConfig{CAFile: caFile, PinSHA256: []string{pin(pinned.Certificate[0])}}), "pinned")
+	require.Nil(dial(UpstreamTLSConfig{Insecure: true, PinSHA256: []string{pin(leaf.Certificate[0])}}))
+	require.Nil(dial(UpstreamTLSConfig{CAFile: caFile, PinSHA256: []string{pin(leaf.Certificate[0])}}))
+}
+
+// writeCertFiles write pem files of certificate and key
+func writeCertFiles(require *require.Assertions, cert tls.Certificate) (string, string) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.Nil(err)
+
+	certFile := writeTempFile(require, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+	keyFile := writeTempFile(require, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+// startTLSProxy proxy listening with tls on :8080, certificate of httptest
+func startTLSProxy(require *require.Assertions, opts ...ServerOption) *Server {
+	server := httptest.NewTLSServer(nil)
+	server.Close()
+
+	certFile, keyFile := writeCertFiles(require, server.TLS.Certificates[0])
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	return startProxy(require, append([]ServerOption{WithListenAddress(":8080"), WithCertFile(certFile), WithKeyFile(keyFile)}, opts...)...)
+}
+
+func TestUpstreamTLSClientCert(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	server, err := NewServer()
+	require.Nil(err)
+	upstream := httptest.NewUnstartedServer(server)
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// reuse certificate of server as client certificate
+	certFile, keyFile := writeCertFiles(require, upstream.TLS.Certificates[0])
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	u, err := url.Parse(upstream.URL)
+	require.Nil(err)
+
+	for _, c := range []UpstreamTLSConfig{
+		{Insecure: true},
+		{Insecure: true, CertFile: certFile, KeyFile: keyFile},
+	} {
+		conf, err := c.tlsConfig()
+		require.Nil(err)
+		hp, err := NewHttpProxyWithTLS(u, proxy.Direct, conf)
+		require.Nil(err)
+
+		conn, err := hp.Dial("tcp", echoLn.Addr().String())
+		if c.CertFile == "" {
+			require.NotNil(err)
+			continue
+		}
+		require.Nil(err)
+		conn.Close()
+	}
+
+	_, err = UpstreamTLSConfig{CertFile: certFile}.tlsConfig()
+	require.ErrorContains(err, "set together")
+	_, err = UpstreamTLSConfig{PinSHA256: []string{"abc"}}.tlsConfig()
+	require.ErrorContains(err, "pin-sha256 'abc' invalid")
+}
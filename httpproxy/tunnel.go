@@ -0,0 +1,166 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// relay copy data between client and remote until both directions end,
+// return bytes copied client -> remote and remote -> client.
+//
+// conns are passed to io.Copy unwrapped, so tcp to tcp tunnels use splice(2) on linux.
+// idle timeout, max duration and rate limit are applied per copy round by deadlines.
+func relay(sess *session, conn, remoteConn net.Conn, rateLimit int) (up, down int64) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		up = pipe(sess, remoteConn, conn, newRateLimiter(rateLimit))
+	}()
+
+	go func() {
+		defer wg.Done()
+		down = pipe(sess, conn, remoteConn, newRateLimiter(rateLimit))
+	}()
+
+	wg.Wait()
+
+	return up, down
+}
+
+// pipe copy src to dst, half close dst when src ends, close session on error
+func pipe(sess *session, dst, src net.Conn, limiter *rateLimiter) (written int64) {
+	splice := canSplice(dst, src)
+
+	for {
+		now := time.Now()
+		if err := sess.check(now); err != nil {
+			sess.close()
+			return
+		}
+
+		if err := src.SetReadDeadline(sess.roundDeadline(now)); err != nil {
+			sess.close()
+			return
+		}
+
+		// a write timeout may lose data spliced but not yet written, only stop writing at the hard end
+		if err := dst.SetWriteDeadline(sess.expireAt); err != nil {
+			sess.close()
+			return
+		}
+
+		var reader io.Reader = src
+		var lr *io.LimitedReader
+		if limiter != nil {
+			lr = &io.LimitedReader{R: src, N: limiter.wait()}
+			reader = lr
+		}
+
+		var n int64
+		var err error
+		if splice {
+			n, err = io.Copy(dst, reader)
+		} else {
+			n, err = CopyBuffer(writerOnly{dst}, readerOnly{reader})
+		}
+
+		written += n
+		if n > 0 {
+			sess.touch()
+		}
+		if limiter != nil {
+			limiter.consume(n)
+		}
+
+		switch {
+		case err == nil && lr != nil && lr.N == 0:
+			// chunk done, continue
+		case err == nil:
+			// src eof
+			closeWrite(dst)
+			return
+		case isTimeout(err):
+			// round done, check session
+		default:
+			if !errors.Is(err, net.ErrClosed) {
+				sess.close()
+			}
+			return
+		}
+	}
+}
+
+// canSplice whether io.Copy from src to dst can use splice(2)
+func canSplice(dst, src net.Conn) bool {
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	default:
+		return false
+	}
+}
+
+// rateLimiter token bucket of bytes, used by one direction only
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter bytes per second, nil if unlimited
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait until enough tokens, return bytes allowed to copy now
+func (l *rateLimiter) wait() int64 {
+	min := math.Min(float64(bufSize), l.burst)
+
+	l.refill()
+	if l.tokens < min {
+		time.Sleep(time.Duration((min - l.tokens) / l.rate * float64(time.Second)))
+		l.refill()
+	}
+
+	return int64(l.tokens)
+}
+
+func (l *rateLimiter) consume(n int64) {
+	l.tokens -= float64(n)
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// hide ReadFrom, so io.CopyBuffer use our buffer
+type writerOnly struct {
+	io.Writer
+}
+
+// hide WriteTo, so io.CopyBuffer use our buffer
+type readerOnly struct {
+	io.Reader
+}
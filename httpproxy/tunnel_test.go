@@ -0,0 +1,139 @@
+package httpproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tcpPair(require *require.Assertions) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer ln.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		ch <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(err)
+
+	return conn, <-ch
+}
+
+// hideConn hide concrete conn type like a wrapper does, so relay can not splice
+type hideConn struct {
+	net.Conn
+}
+
+func benchmarkRelay(b *testing.B, wrap func(net.Conn) net.Conn) {
+	require := require.New(b)
+
+	client, proxyIn := tcpPair(require)
+	proxyOut, remote := tcpPair(require)
+	defer client.Close()
+	defer remote.Close()
+
+	sess := newSession(time.Minute, 0)
+	sess.attach(proxyIn)
+	sess.attach(proxyOut)
+	defer sess.close()
+
+	go relay(sess, wrap(proxyIn), wrap(proxyOut), 0)
+
+	buf := make([]byte, 128*1024)
+	done := make(chan struct{})
+	go func() {
+		io.CopyN(io.Discard, remote, int64(len(buf))*int64(b.N))
+		close(done)
+	}()
+
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := client.Write(buf)
+		require.Nil(err)
+	}
+	<-done
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, func(conn net.Conn) net.Conn {
+		return conn
+	})
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, func(conn net.Conn) net.Conn {
+		return hideConn{conn}
+	})
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	require := require.New(t)
+
+	client, proxyIn := tcpPair(require)
+	proxyOut, remote := tcpPair(require)
+	defer client.Close()
+	defer remote.Close()
+
+	sess := newSession(time.Minute, 0)
+	sess.attach(proxyIn)
+	sess.attach(proxyOut)
+	defer sess.close()
+
+	go relay(sess, proxyIn, proxyOut, 32*1024)
+
+	start := time.Now()
+	go client.Write(make([]byte, 64*1024))
+
+	n, err := io.CopyN(io.Discard, remote, 64*1024)
+	require.Nil(err)
+	require.Equal(int64(64*1024), n)
+	require.GreaterOrEqual(time.Since(start), time.Millisecond*900)
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	require := require.New(t)
+
+	client, proxyIn := tcpPair(require)
+	proxyOut, remote := tcpPair(require)
+	defer client.Close()
+	defer remote.Close()
+
+	sess := newSession(time.Minute, 0)
+	sess.attach(proxyIn)
+	sess.attach(proxyOut)
+	defer sess.close()
+
+	done := make(chan int64, 1)
+	go func() {
+		up, _ := relay(sess, proxyIn, proxyOut, 0)
+		done <- up
+	}()
+
+	_, err := client.Write([]byte("hello"))
+	require.Nil(err)
+	client.(*net.TCPConn).CloseWrite()
+
+	data, err := io.ReadAll(remote)
+	require.Nil(err)
+	require.Equal("hello", string(data))
+
+	// remote -> client still open after client half close
+	_, err = remote.Write([]byte("world"))
+	require.Nil(err)
+	remote.(*net.TCPConn).CloseWrite()
+
+	data, err = io.ReadAll(client)
+	require.Nil(err)
+	require.Equal("world", string(data))
+	require.Equal(int64(5), <-done)
+}
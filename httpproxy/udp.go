@@ -0,0 +1,367 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/isayme/go-logger"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// path of default uri template of connect-udp, '/.well-known/masque/udp/{target_host}/{target_port}/'
+const udpPathPrefix = "/.well-known/masque/udp/"
+
+const (
+	// upgrade token and :protocol of connect-udp
+	protocolConnectUDP = "connect-udp"
+	// capsule of http datagram
+	capsuleDatagram http3.CapsuleType = 0x00
+	// udp payload and its context id
+	maxUDPPayload = 65535
+	maxDatagram   = maxUDPPayload + 8
+)
+
+var responseSwitchingToUDP = []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+
+// isConnectUDP request of connect-udp (RFC 9298): http/1.1 upgrade, or extended CONNECT of http/2 and http/3
+func isConnectUDP(r *http.Request) bool {
+	switch r.ProtoMajor {
+	case 1:
+		return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), protocolConnectUDP)
+	case 2:
+		return r.Method == http.MethodConnect && r.Header.Get(":protocol") == protocolConnectUDP
+	default:
+		// protocol of extended CONNECT as proto by http3 server
+		return r.Method == http.MethodConnect && r.Proto == protocolConnectUDP
+	}
+}
+
+// udpTarget host:port of connect-udp path by default uri template
+func udpTarget(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, udpPathPrefix)
+	if !ok {
+		return "", fmt.Errorf("path '%s' not match '%s{target_host}/{target_port}/'", path, udpPathPrefix)
+	}
+
+	host, port, ok := strings.Cut(strings.TrimSuffix(rest, "/"), "/")
+	if !ok || host == "" || strings.Contains(port, "/") {
+		return "", fmt.Errorf("path '%s' invalid", path)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("port '%s' invalid", port)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveUDP proxy udp flow of connect-udp request, auth and acl checked already
+func (s *Server) serveUDP(st *serverState, w http.ResponseWriter, r *http.Request, user string, seqId string) {
+	remoteConn, err := s.dialUDP(st, &tunnelRequest{
+		seqId:  seqId,
+		dest:   r.URL.Host,
+		client: r.RemoteAddr,
+		user:   user,
+	})
+	if err == errRouteRejected {
+		logger.Infow("route reject", "addr", r.URL.Host, "seqId", seqId)
+		w.WriteHeader(403)
+		return
+	}
+	if err != nil {
+		logger.Warnw("dial remote udp fail", "err", err, "addr", r.URL.Host, "seqId", seqId)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer remoteConn.Close()
+	logger.Debugw("dial remote udp ok", "addr", r.URL.Host, "remote", remoteConn.RemoteAddr().String(), "seqId", seqId)
+
+	sess := newSession(st.options.udpIdleTimeout, st.options.maxSessionDuration)
+	sess.attach(remoteConn)
+	s.addSession(sess)
+	defer s.removeSession(sess)
+
+	dc, err := acceptUDP(w, r)
+	if err != nil {
+		logger.Warnw("accept connect-udp fail", "err", err, "seqId", seqId)
+		return
+	}
+	defer dc.Close()
+	sess.attach(dc)
+
+	up, down := relayUDP(sess, dc, remoteConn)
+	s.bytesUp.Add(up)
+	s.bytesDown.Add(down)
+	logger.Debugw("udp relay end", "addr", r.URL.Host, "up", up, "down", down, "seqId", seqId)
+}
+
+// acceptUDP response to connect-udp request, return datagrams of client
+func acceptUDP(w http.ResponseWriter, r *http.Request) (*datagramConn, error) {
+	w.Header().Set("Capsule-Protocol", "?1")
+
+	if r.ProtoMajor == 3 {
+		streamer, ok := w.(http3.HTTPStreamer)
+		if !ok {
+			return nil, errors.New("http3 stream not supported")
+		}
+		settings, _ := w.(http3.Settingser)
+
+		w.WriteHeader(http.StatusOK)
+		str := streamer.HTTPStream()
+		return newDatagramConn(h3Stream{str}, str, settings), nil
+	}
+
+	conn, err := takeOverConn(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ProtoMajor == 2 {
+		err = writeEstablished(w, r, conn)
+	} else {
+		_, err = conn.Write(responseSwitchingToUDP)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newDatagramConn(conn, nil, nil), nil
+}
+
+// h3Stream close both directions of http/3 stream, so blocked reads return
+type h3Stream struct {
+	*http3.Stream
+}
+
+func (s h3Stream) Close() error {
+	s.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return s.Stream.Close()
+}
+
+// datagramConn http datagrams (RFC 9297) of a request, in capsules of stream,
+// and http/3 datagrams if negotiated
+type datagramConn struct {
+	stream io.ReadWriteCloser
+	// nil if not http/3
+	h3 *http3.Stream
+	// settings of peer, datagrams sent only if it enables
+	settings http3.Settingser
+
+	datagrams chan []byte
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+func newDatagramConn(stream io.ReadWriteCloser, h3 *http3.Stream, settings http3.Settingser) *datagramConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &datagramConn{
+		stream:    stream,
+		h3:        h3,
+		settings:  settings,
+		datagrams: make(chan []byte),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	go c.readCapsules()
+	if h3 != nil {
+		go c.readH3Datagrams()
+	}
+
+	return c
+}
+
+// readCapsules until stream ends, which ends the flow. unknown capsules skipped.
+func (c *datagramConn) readCapsules() {
+	defer c.Close()
+
+	br := bufio.NewReader(c.stream)
+	for {
+		ct, r, err := http3.ParseCapsule(br)
+		if err != nil {
+			return
+		}
+
+		if ct != capsuleDatagram {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return
+			}
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(r, maxDatagram+1))
+		if err != nil {
+			return
+		}
+		if len(data) > maxDatagram {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return
+			}
+			continue
+		}
+
+		if !c.push(data) {
+			return
+		}
+	}
+}
+
+func (c *datagramConn) readH3Datagrams() {
+	for {
+		data, err := c.h3.ReceiveDatagram(c.ctx)
+		if err != nil {
+			return
+		}
+		if !c.push(data) {
+			return
+		}
+	}
+}
+
+func (c *datagramConn) push(data []byte) bool {
+	select {
+	case c.datagrams <- data:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// ReadDatagram udp payload of next datagram, datagrams of other context ids dropped
+func (c *datagramConn) ReadDatagram() ([]byte, error) {
+	for {
+		select {
+		case data := <-c.datagrams:
+			contextID, n, err := quicvarint.Parse(data)
+			if err != nil || contextID != 0 {
+				continue
+			}
+			return data[n:], nil
+		case <-c.ctx.Done():
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// WriteDatagram send udp payload, as capsule if too large for http/3 datagram
+func (c *datagramConn) WriteDatagram(payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// payload after context id 0
+	if c.h3Datagrams() {
+		c.wbuf = append(append(c.wbuf[:0], 0), payload...)
+		err := c.h3.SendDatagram(c.wbuf)
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return err
+		}
+	}
+
+	c.wbuf = quicvarint.Append(c.wbuf[:0], uint64(capsuleDatagram))
+	c.wbuf = quicvarint.Append(c.wbuf, uint64(len(payload)+1))
+	c.wbuf = append(c.wbuf, 0)
+	c.wbuf = append(c.wbuf, payload...)
+	_, err := c.stream.Write(c.wbuf)
+	return err
+}
+
+// h3Datagrams whether peer enabled http/3 datagrams, by its settings received
+func (c *datagramConn) h3Datagrams() bool {
+	if c.h3 == nil || c.settings == nil {
+		return false
+	}
+
+	select {
+	case <-c.settings.ReceivedSettings():
+		return c.settings.Settings().EnableDatagrams
+	default:
+		return false
+	}
+}
+
+func (c *datagramConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.stream.Close()
+	})
+	return nil
+}
+
+// relayUDP relay datagrams between client and remote until either ends or session closed,
+// return payload bytes client -> remote and remote -> client.
+func relayUDP(sess *session, dc *datagramConn, remoteConn net.Conn) (up, down int64) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer sess.close()
+
+		for {
+			payload, err := dc.ReadDatagram()
+			if err != nil {
+				return
+			}
+
+			// lost like udp, unless conn closed
+			if _, err := remoteConn.Write(payload); errors.Is(err, net.ErrClosed) {
+				return
+			}
+			up += int64(len(payload))
+			sess.touch()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer sess.close()
+
+		buf := make([]byte, maxUDPPayload)
+		for {
+			now := time.Now()
+			if err := sess.check(now); err != nil {
+				return
+			}
+			if err := remoteConn.SetReadDeadline(sess.roundDeadline(now)); err != nil {
+				return
+			}
+
+			n, err := remoteConn.Read(buf)
+			switch {
+			case err == nil:
+			case isTimeout(err), errors.Is(err, syscall.ECONNREFUSED):
+				// round done, or icmp unreachable of earlier datagram
+				continue
+			default:
+				return
+			}
+
+			if err := dc.WriteDatagram(buf[:n]); err != nil {
+				return
+			}
+			down += int64(n)
+			sess.touch()
+		}
+	}()
+
+	wg.Wait()
+
+	return up, down
+}
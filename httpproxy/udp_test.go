@@ -0,0 +1,202 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPTarget(t *testing.T) {
+	require := require.New(t)
+
+	target, err := udpTarget("/.well-known/masque/udp/192.0.2.6/443/")
+	require.Nil(err)
+	require.Equal("192.0.2.6:443", target)
+
+	// ipv6, already percent decoded in path
+	target, err = udpTarget("/.well-known/masque/udp/2001:db8::42/53/")
+	require.Nil(err)
+	require.Equal("[2001:db8::42]:53", target)
+
+	target, err = udpTarget("/.well-known/masque/udp/example.com/53")
+	require.Nil(err)
+	require.Equal("example.com:53", target)
+
+	for _, path := range []string{
+		"/masque/udp/example.com/53/",
+		"/.well-known/masque/udp/example.com/",
+		"/.well-known/masque/udp//53/",
+		"/.well-known/masque/udp/example.com/0/",
+		"/.well-known/masque/udp/example.com/53/x/",
+	} {
+		_, err := udpTarget(path)
+		require.NotNil(err, path)
+	}
+}
+
+func startUDPEchoServer(require *require.Assertions) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn
+}
+
+func datagramCapsule(payload string) []byte {
+	b := quicvarint.Append(nil, uint64(capsuleDatagram))
+	b = quicvarint.Append(b, uint64(len(payload)+1))
+	b = append(b, 0)
+	return append(b, payload...)
+}
+
+func readDatagramCapsule(require *require.Assertions, br *bufio.Reader) string {
+	ct, r, err := http3.ParseCapsule(br)
+	require.Nil(err)
+	require.Equal(capsuleDatagram, ct)
+	data, err := io.ReadAll(r)
+	require.Nil(err)
+	require.Equal(byte(0), data[0])
+	return string(data[1:])
+}
+
+// dialConnectUDP connect-udp by http/1.1 upgrade, with a datagram sent before response
+func dialConnectUDP(require *require.Assertions, target string, header string, first string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	require.Nil(err)
+
+	host, port, _ := net.SplitHostPort(target)
+	req := fmt.Sprintf("GET /.well-known/masque/udp/%s/%s/ HTTP/1.1\r\nHost: 127.0.0.1:8080\r\n"+
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n%s\r\n", host, port, header)
+	_, err = conn.Write(append([]byte(req), datagramCapsule(first)...))
+	require.Nil(err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.Nil(err)
+	return conn, br, resp
+}
+
+func TestConnectUDP(t *testing.T) {
+	require := require.New(t)
+
+	echo := startUDPEchoServer(require)
+	defer echo.Close()
+
+	acl, err := NewACL(nil, nil, []uint16{53, uint16(echo.LocalAddr().(*net.UDPAddr).Port)})
+	require.Nil(err)
+	proxy := startProxy(require, WithListenAddress(":8080"), WithUsers(map[string]string{"foo": "bar"}), WithACL(acl), WithUDPIdleTimeout(time.Millisecond*300))
+	defer proxy.Shutdown(context.Background())
+
+	auth := "Proxy-Authorization: Basic Zm9vOmJhcg==\r\n"
+
+	conn, br, resp := dialConnectUDP(require, echo.LocalAddr().String(), auth, "early")
+	defer conn.Close()
+	require.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal("connect-udp", resp.Header.Get("Upgrade"))
+
+	require.Equal("early", readDatagramCapsule(require, br))
+	_, err = conn.Write(datagramCapsule("hello"))
+	require.Nil(err)
+	require.Equal("hello", readDatagramCapsule(require, br))
+	require.Equal(1, proxy.sessionCount())
+
+	// flow closed after idle
+	_, err = br.ReadByte()
+	require.Equal(io.EOF, err)
+	require.Eventually(func() bool {
+		return proxy.sessionCount() == 0
+	}, time.Second, time.Millisecond*10)
+
+	// auth required
+	conn, _, resp = dialConnectUDP(require, echo.LocalAddr().String(), "", "hello")
+	conn.Close()
+	require.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// acl of destination port
+	conn, _, resp = dialConnectUDP(require, "127.0.0.1:5353", auth, "hello")
+	conn.Close()
+	require.Equal(http.StatusForbidden, resp.StatusCode)
+}
+
+func TestConnectUDPHTTP3(t *testing.T) {
+	require := require.New(t)
+
+	echo := startUDPEchoServer(require)
+	defer echo.Close()
+
+	proxy := startTLSProxy(require, WithHTTP3(true))
+	defer proxy.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, "127.0.0.1:8080", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, &quic.Config{EnableDatagrams: true})
+	require.Nil(err)
+	defer conn.CloseWithError(0, "")
+
+	cc := (&http3.Transport{EnableDatagrams: true}).NewClientConn(conn)
+	<-cc.ReceivedSettings()
+	require.True(cc.Settings().EnableDatagrams)
+	require.True(cc.Settings().EnableExtendedConnect)
+
+	str, err := cc.OpenRequestStream(ctx)
+	require.Nil(err)
+	defer str.Close()
+
+	addr := echo.LocalAddr().(*net.UDPAddr)
+	err = str.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Proto:  protocolConnectUDP,
+		Host:   "127.0.0.1:8080",
+		URL:    &url.URL{Scheme: "https", Host: "127.0.0.1:8080", Path: fmt.Sprintf("/.well-known/masque/udp/%s/%d/", addr.IP, addr.Port)},
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+	})
+	require.Nil(err)
+
+	resp, err := str.ReadResponse()
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	for _, msg := range []string{"hello", "world"} {
+		require.Nil(str.SendDatagram(append([]byte{0}, msg...)))
+		data, err := str.ReceiveDatagram(ctx)
+		require.Nil(err)
+		require.Equal(append([]byte{0}, msg...), data)
+	}
+
+	// too large for a datagram frame, capsules both ways
+	large := strings.Repeat("x", 1400)
+	_, err = str.Write(datagramCapsule(large))
+	require.Nil(err)
+	require.Equal(large, readDatagramCapsule(require, bufio.NewReader(str)))
+	require.Equal(1, proxy.sessionCount())
+
+	str.CancelRead(0)
+	str.Close()
+	require.Eventually(func() bool {
+		return proxy.sessionCount() == 0
+	}, time.Second, time.Millisecond*10)
+}
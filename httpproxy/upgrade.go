@@ -0,0 +1,289 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isayme/go-logger"
+)
+
+// sockets passed by systemd socket activation, or by upgrading process the same way
+const (
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+	// first passed fd, after stdin, stdout and stderr
+	listenFDsStart = 3
+)
+
+// fd names of main listener and admin listener, others by listener name.
+// sockets without name, 'unknown' of systemd, go to main listener.
+const (
+	mainFDName    = "main"
+	adminFDName   = "admin"
+	unknownFDName = "unknown"
+)
+
+// new process writes to pipe of this fd once listening
+const readyFDEnv = "HTTPPROXY_READY_FD"
+
+// max wait of new process listening on upgrade
+const upgradeTimeout = time.Second * 30
+
+// inheritedSockets sockets passed to process, by fd name.
+// a name has a stream socket for tcp or unix, and a datagram one for http3.
+type inheritedSockets struct {
+	listeners   map[string][]net.Listener
+	packetConns map[string][]net.PacketConn
+}
+
+// inheritSockets sockets of LISTEN_FDS, env cleared so children not inherit again
+func inheritSockets() *inheritedSockets {
+	pid := os.Getenv(listenPIDEnv)
+	n, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	names := strings.Split(os.Getenv(listenFDNamesEnv), ":")
+	os.Unsetenv(listenPIDEnv)
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(listenFDNamesEnv)
+
+	// LISTEN_PID is unset by upgrading process, it can not know pid before exec
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		n = 0
+	}
+
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		files = append(files, os.NewFile(uintptr(listenFDsStart+i), "listen-fd-"+strconv.Itoa(i)))
+	}
+
+	return newInheritedSockets(files, names)
+}
+
+// newInheritedSockets sockets of files named by names, files closed
+func newInheritedSockets(files []*os.File, names []string) *inheritedSockets {
+	sockets := &inheritedSockets{
+		listeners:   map[string][]net.Listener{},
+		packetConns: map[string][]net.PacketConn{},
+	}
+
+	for i, f := range files {
+		name := mainFDName
+		if i < len(names) && names[i] != "" && names[i] != unknownFDName {
+			name = names[i]
+		}
+
+		// fd duplicated by net, the original closed
+		if ln, err := net.FileListener(f); err == nil {
+			sockets.listeners[name] = append(sockets.listeners[name], ln)
+		} else if conn, err := net.FilePacketConn(f); err == nil {
+			sockets.packetConns[name] = append(sockets.packetConns[name], conn)
+		} else {
+			logger.Warnw("inherited fd not a socket", "name", name, "err", err)
+		}
+		f.Close()
+	}
+
+	return sockets
+}
+
+// listener inherited stream socket of name, nil if none
+func (is *inheritedSockets) listener(name string) net.Listener {
+	lns := is.listeners[name]
+	if len(lns) == 0 {
+		return nil
+	}
+	is.listeners[name] = lns[1:]
+	return lns[0]
+}
+
+// packetConn inherited datagram socket of name, nil if none
+func (is *inheritedSockets) packetConn(name string) net.PacketConn {
+	conns := is.packetConns[name]
+	if len(conns) == 0 {
+		return nil
+	}
+	is.packetConns[name] = conns[1:]
+	return conns[0]
+}
+
+// close sockets not taken by any listener
+func (is *inheritedSockets) close() {
+	for name, lns := range is.listeners {
+		for _, ln := range lns {
+			logger.Warnw("inherited socket unused, closed", "name", name, "addr", ln.Addr().String())
+			ln.Close()
+		}
+	}
+	for name, conns := range is.packetConns {
+		for _, conn := range conns {
+			logger.Warnw("inherited socket unused, closed", "name", name, "addr", conn.LocalAddr().String())
+			conn.Close()
+		}
+	}
+}
+
+// notifyReady tell upgrading process we are listening, if started by it
+func notifyReady() {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Warnw("ready fd invalid", "fd", v)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		logger.Warnw("notify ready fail", "err", err)
+	}
+}
+
+// filer sockets with fd, *net.TCPListener, *net.UnixListener and *net.UDPConn
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade start current executable with same args, passing listening sockets to it,
+// return once it is listening. then shut down this server, tunnels drained while the
+// new process accepts, no connection refused.
+//
+// udp socket of http3 is one socket shared by both processes, packets of a conn may be
+// read by the other one, so http3 of this server is closed once new process ready,
+// its tunnels not drained.
+func (s *Server) Upgrade() error {
+	// set at entry, concurrent calls never start two processes
+	if !s.upgraded.CompareAndSwap(false, true) {
+		return errors.New("Upgrade: already upgraded or upgrading")
+	}
+	if err := s.upgrade(); err != nil {
+		s.upgraded.Store(false)
+		return err
+	}
+	return nil
+}
+
+// upgrade work of Upgrade, s.upgraded set by caller and reset on error
+func (s *Server) upgrade() error {
+	select {
+	case <-s.listening:
+	default:
+		return errors.New("Upgrade: not listening yet")
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	add := func(name string, sock any) error {
+		if sock == nil {
+			return nil
+		}
+		fl, ok := sock.(filer)
+		if !ok {
+			logger.Warnw("upgrade: socket can not be passed, skipped", "name", name)
+			return nil
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("Upgrade: %w", err)
+		}
+		files = append(files, f)
+		names = append(names, name)
+		return nil
+	}
+
+	for _, l := range s.listeners {
+		name := l.name
+		if name == "" {
+			name = mainFDName
+		}
+		if err := add(name, l.ln); err != nil {
+			return err
+		}
+		if l.http3Conn != nil {
+			if err := add(name, l.http3Conn); err != nil {
+				return err
+			}
+		}
+	}
+	if s.adminLn != nil {
+		if err := add(adminFDName, s.adminLn); err != nil {
+			return err
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	defer r.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, env := range os.Environ() {
+		switch key, _, _ := strings.Cut(env, "="); key {
+		case listenPIDEnv, listenFDsEnv, listenFDNamesEnv, readyFDEnv:
+		default:
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(files)),
+		fmt.Sprintf("%s=%s", listenFDNamesEnv, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", readyFDEnv, listenFDsStart+len(files)),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("Upgrade: start new process fail: %w", err)
+	}
+	logger.Infow("upgrade: new process started", "pid", cmd.Process.Pid, "sockets", len(files))
+
+	// EOF if new process exits before ready
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("Upgrade: new process not ready: %w", err)
+	}
+	go cmd.Wait()
+
+	// sockets files are used by new process now
+	for _, l := range s.listeners {
+		if ul, ok := l.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		if l.http3Server != nil {
+			l.http3Server.Close()
+			l.http3Conn.Close()
+		}
+	}
+	logger.Infow("upgrade: new process ready", "pid", cmd.Process.Pid)
+
+	return nil
+}
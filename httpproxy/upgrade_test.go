@@ -0,0 +1,187 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+// set for test binary started by Upgrade, value is cert-file and key-file
+const upgradeChildEnv = "HTTPPROXY_TEST_UPGRADE_CHILD"
+
+func TestMain(m *testing.M) {
+	if v := os.Getenv(upgradeChildEnv); v != "" {
+		runUpgradeChild(v)
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// runUpgradeChild serve inherited sockets as new process of TestUpgrade, exit after its tunnels
+func runUpgradeChild(files string) {
+	certFile, keyFile, _ := strings.Cut(files, ":")
+	server, err := NewServer(WithListenAddress("127.0.0.1:1"), WithCertFile(certFile), WithKeyFile(keyFile), WithHTTP3(true))
+	if err != nil {
+		os.Exit(1)
+	}
+	go server.ListenAndServe()
+
+	deadline := time.Now().Add(upgradeTimeout)
+	for time.Now().Before(deadline) && (server.tunnelsTotal.Load() < 2 || server.sessionCount() > 0) {
+		time.Sleep(shutdownPollInterval)
+	}
+	server.Shutdown(context.Background())
+}
+
+func TestInheritSockets(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	socketFile := filepath.Join(t.TempDir(), "httpproxy.sock")
+	unixLn, err := net.Listen("unix", socketFile)
+	require.Nil(err)
+	unixLn.(*net.UnixListener).SetUnlinkOnClose(false)
+	unusedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+
+	// as passed by LISTEN_FDS, original sockets closed
+	var files []*os.File
+	for _, ln := range []net.Listener{tcpLn, unixLn, unusedLn} {
+		f, err := ln.(filer).File()
+		require.Nil(err)
+		files = append(files, f)
+		ln.Close()
+	}
+	inherited := newInheritedSockets(files, []string{unknownFDName, "local", "other"})
+
+	// addresses unusable if bound
+	server, err := NewServer(WithListenAddress("127.0.0.1:1"), WithListeners([]ListenerConfig{
+		{Name: "local", Address: "unix:/nonexistent/httpproxy.sock"},
+	}))
+	require.Nil(err)
+	errs := make(chan error, 1)
+	go func() { errs <- server.serveAll(nil, inherited) }()
+	select {
+	case <-server.listening:
+	case err := <-errs:
+		require.Nil(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	conn := dialTunnel(require, tcpLn.Addr().String(), echoLn.Addr().String())
+	defer conn.Close()
+	echo(require, conn, "hello")
+
+	conn, err = net.Dial("unix", socketFile)
+	require.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT " + echoLn.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	require.Nil(err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	// unused socket closed
+	_, err = net.Dial("tcp", unusedLn.Addr().String())
+	require.NotNil(err)
+}
+
+// new process of test binary takes over sockets, old one drains tunnels
+func TestUpgrade(t *testing.T) {
+	require := require.New(t)
+
+	echoLn := startEchoServer(require)
+	defer echoLn.Close()
+
+	certFile, keyFile := writeCertFiles(require, newSelfSignedCert(require))
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	server, err := NewServer(WithListenAddress("127.0.0.1:0"), WithCertFile(certFile), WithKeyFile(keyFile), WithHTTP3(true))
+	require.Nil(err)
+	require.ErrorContains(server.Upgrade(), "not listening yet")
+
+	go server.ListenAndServe()
+	<-server.listening
+	addr := server.listeners[0].ln.Addr().String()
+	// udp port differs as port 0 listened
+	http3Addr := server.listeners[0].http3Conn.LocalAddr().String()
+
+	hp, err := NewHttpProxyWithTLS(&url.URL{Scheme: "https", Host: addr}, nil, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(err)
+	oldConn, err := hp.Dial("tcp", echoLn.Addr().String())
+	require.Nil(err)
+	defer oldConn.Close()
+	echo(require, oldConn, "hello")
+
+	t.Setenv(upgradeChildEnv, certFile+":"+keyFile)
+	// concurrent calls, one new process only
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() { errs <- server.Upgrade() }()
+	}
+	err1, err2 := <-errs, <-errs
+	if err1 != nil {
+		err1, err2 = err2, err1
+	}
+	require.Nil(err1)
+	require.ErrorContains(err2, "already upgraded")
+	require.ErrorContains(server.Upgrade(), "already upgraded")
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+	// tunnel of old process drained
+	echo(require, oldConn, "old")
+	oldConn.Close()
+	require.Nil(<-shutdown)
+
+	// new process accepts on same sockets, tcp and udp
+	conn, err := hp.Dial("tcp", echoLn.Addr().String())
+	require.Nil(err)
+	echo(require, conn, "new")
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	qconn, err := quic.DialAddr(ctx, http3Addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	require.Nil(err)
+	defer qconn.CloseWithError(0, "")
+	str, err := (&http3.Transport{}).NewClientConn(qconn).OpenRequestStream(ctx)
+	require.Nil(err)
+	err = str.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Host:   echoLn.Addr().String(),
+		URL:    &url.URL{Host: echoLn.Addr().String()},
+		Header: http.Header{},
+	})
+	require.Nil(err)
+	resp, err := str.ReadResponse()
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	_, err = str.Write([]byte("http3"))
+	require.Nil(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(str, buf)
+	require.Nil(err)
+	require.Equal("http3", string(buf))
+	str.Close()
+}
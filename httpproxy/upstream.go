@@ -0,0 +1,324 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	StrategyRoundRobin      = "round-robin"
+	StrategyWeighted        = "weighted"
+	StrategyLeastConn       = "least-conn"
+	StrategyRandom          = "random"
+	StrategyHashDestination = "hash-destination"
+	StrategyHashClient      = "hash-client"
+)
+
+var upstreamStrategies = []string{
+	StrategyRoundRobin,
+	StrategyWeighted,
+	StrategyLeastConn,
+	StrategyRandom,
+	StrategyHashDestination,
+	StrategyHashClient,
+}
+
+// virtual nodes of each weight of upstream in consistent hash ring
+const hashRingReplicas = 64
+
+// UpstreamConfig upstream proxy
+type UpstreamConfig struct {
+	Name string `yaml:"name" toml:"name"`
+	// format: 'socks5://host:port' or 'http://host:port' or 'https://host:port' or 'h2://host:port'
+	URL string `yaml:"url" toml:"url"`
+	// override credentials in url
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	// weight of weighted and hash strategies, default 1
+	Weight int `yaml:"weight" toml:"weight"`
+	// override global connect timeout
+	ConnectTimeout time.Duration `yaml:"connect-timeout" toml:"connect-timeout"`
+	// tls of https upstream
+	TLS UpstreamTLSConfig `yaml:"tls" toml:"tls"`
+}
+
+type upstream struct {
+	name           string
+	address        string
+	weight         int
+	connectTimeout time.Duration
+	dialer         proxy.ContextDialer
+
+	// tunnels using this upstream
+	active       atomic.Int64
+	dials        atomic.Int64
+	dialFailures atomic.Int64
+
+	health upstreamHealth
+}
+
+// newUpstream upstream of config, dialed by forward
+func newUpstream(index int, c UpstreamConfig, forward proxy.Dialer) (*upstream, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream '%s' fail: %w", c.URL, err)
+	}
+
+	if c.Username != "" {
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+
+	var dialer proxy.Dialer
+	switch u.Scheme {
+	case "http", "https":
+		var conf *tls.Config
+		conf, err = c.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream '%s' tls invalid: %w", u.Redacted(), err)
+		}
+		dialer, err = NewHttpProxyWithTLS(u, forward, conf)
+	case "h2":
+		var conf *tls.Config
+		conf, err = c.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream '%s' tls invalid: %w", u.Redacted(), err)
+		}
+		dialer, err = NewH2Proxy(u, forward, conf)
+	default:
+		dialer, err = proxy.FromURL(u, forward)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create upstream '%s' dialer fail: %w", u.Redacted(), err)
+	}
+
+	up := &upstream{
+		name:           c.Name,
+		address:        u.Redacted(),
+		weight:         c.Weight,
+		connectTimeout: c.ConnectTimeout,
+		dialer:         NewProxyContextDialer(dialer),
+	}
+	if up.name == "" {
+		up.name = "upstream-" + strconv.Itoa(index)
+	}
+	if up.weight <= 0 {
+		up.weight = 1
+	}
+
+	return up, nil
+}
+
+func (up *upstream) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if up.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, up.connectTimeout)
+		defer cancel()
+	}
+
+	return up.dialer.DialContext(ctx, network, addr)
+}
+
+// upstreamPool upstreams and the strategy to pick one
+type upstreamPool struct {
+	strategy  string
+	upstreams []*upstream
+
+	healthCheck HealthCheckConfig
+	stop        chan struct{}
+
+	next atomic.Uint64
+
+	// smooth weighted round-robin, see nginx
+	weightedMu     sync.Mutex
+	currentWeights []int
+
+	// sorted hashes of consistent hash ring, and their upstreams
+	hashRing        []uint32
+	hashRingMembers []*upstream
+}
+
+func newUpstreamPool(strategy string, configs []UpstreamConfig, hc HealthCheckConfig, forward proxy.Dialer) (*upstreamPool, error) {
+	strategy = strings.ToLower(strategy)
+	if strategy == "" {
+		strategy = StrategyRoundRobin
+	}
+	if !containsFold(upstreamStrategies, strategy) {
+		return nil, fmt.Errorf("upstream strategy '%s' invalid", strategy)
+	}
+
+	pool := &upstreamPool{
+		strategy:    strategy,
+		healthCheck: hc,
+	}
+
+	names := map[string]bool{}
+	for i, c := range configs {
+		up, err := newUpstream(i, c, forward)
+		if err != nil {
+			return nil, err
+		}
+		if names[up.name] {
+			return nil, fmt.Errorf("upstream name '%s' duplicate", up.name)
+		}
+		names[up.name] = true
+
+		pool.upstreams = append(pool.upstreams, up)
+	}
+	pool.currentWeights = make([]int, len(pool.upstreams))
+
+	// consistent hash ring
+	type point struct {
+		hash uint32
+		up   *upstream
+	}
+	var points []point
+	for _, up := range pool.upstreams {
+		for i := 0; i < hashRingReplicas*up.weight; i++ {
+			points = append(points, point{crc32.ChecksumIEEE([]byte(up.name + "#" + strconv.Itoa(i))), up})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	for _, p := range points {
+		pool.hashRing = append(pool.hashRing, p.hash)
+		pool.hashRingMembers = append(pool.hashRingMembers, p.up)
+	}
+
+	return pool, nil
+}
+
+// pick upstream for tunnel from client to destination host:port, skip tried ones.
+// ejected upstreams are picked only if all untried ones are ejected. nil if all tried.
+func (pool *upstreamPool) pick(dest string, client string, tried []*upstream) *upstream {
+	now := time.Now()
+
+	var candidates []*upstream
+	var ejected []*upstream
+	for _, up := range pool.upstreams {
+		if slices.Contains(tried, up) {
+			continue
+		}
+		if up.available(now) {
+			candidates = append(candidates, up)
+		} else {
+			ejected = append(ejected, up)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch pool.strategy {
+	case StrategyWeighted:
+		return pool.pickWeighted(candidates)
+	case StrategyLeastConn:
+		return pool.pickLeastConn(candidates)
+	case StrategyRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case StrategyHashDestination:
+		host, _, err := net.SplitHostPort(dest)
+		if err != nil {
+			host = dest
+		}
+		return pool.pickHash(host, candidates)
+	case StrategyHashClient:
+		host, _, err := net.SplitHostPort(client)
+		if err != nil {
+			host = client
+		}
+		return pool.pickHash(host, candidates)
+	default:
+		n := pool.next.Add(1) - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+func (pool *upstreamPool) pickWeighted(candidates []*upstream) *upstream {
+	pool.weightedMu.Lock()
+	defer pool.weightedMu.Unlock()
+
+	best := -1
+	total := 0
+	for i, up := range pool.upstreams {
+		if !slices.Contains(candidates, up) {
+			continue
+		}
+
+		total += up.weight
+		pool.currentWeights[i] += up.weight
+		if best < 0 || pool.currentWeights[i] > pool.currentWeights[best] {
+			best = i
+		}
+	}
+	pool.currentWeights[best] -= total
+
+	return pool.upstreams[best]
+}
+
+func (pool *upstreamPool) pickLeastConn(candidates []*upstream) *upstream {
+	// start from round-robin position, so ties are spread
+	start := pool.next.Add(1) - 1
+
+	var best *upstream
+	var bestActive int64
+	for i := range candidates {
+		up := candidates[(start+uint64(i))%uint64(len(candidates))]
+		active := up.active.Load()
+		if best == nil || active < bestActive {
+			best = up
+			bestActive = active
+		}
+	}
+
+	return best
+}
+
+// pickHash first candidate clockwise on hash ring
+func (pool *upstreamPool) pickHash(key string, candidates []*upstream) *upstream {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(pool.hashRing), func(i int) bool {
+		return pool.hashRing[i] >= hash
+	})
+
+	for i := range pool.hashRing {
+		up := pool.hashRingMembers[(start+i)%len(pool.hashRing)]
+		if slices.Contains(candidates, up) {
+			return up
+		}
+	}
+
+	return candidates[0]
+}
+
+// get upstream by name, nil if not found
+func (pool *upstreamPool) get(name string) *upstream {
+	for _, up := range pool.upstreams {
+		if up.name == name {
+			return up
+		}
+	}
+
+	return nil
+}
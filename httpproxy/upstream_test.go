@@ -0,0 +1,304 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func newTestPool(require *require.Assertions, strategy string, weights ...int) *upstreamPool {
+	var configs []UpstreamConfig
+	for i, weight := range weights {
+		configs = append(configs, UpstreamConfig{
+			Name:   fmt.Sprintf("u%d", i),
+			URL:    fmt.Sprintf("socks5://127.0.0.1:%d", 1080+i),
+			Weight: weight,
+		})
+	}
+
+	pool, err := newUpstreamPool(strategy, configs, HealthCheckConfig{}, proxy.Direct)
+	require.Nil(err)
+	return pool
+}
+
+func pickNames(pool *upstreamPool, n int, dest string, client string) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, pool.pick(dest, client, nil).name)
+	}
+	return names
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(require, StrategyRoundRobin, 1, 1, 1)
+	require.Equal([]string{"u0", "u1", "u2", "u0"}, pickNames(pool, 4, "example.com:443", "127.0.0.1:1234"))
+}
+
+func TestUpstreamPoolWeighted(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(require, StrategyWeighted, 5, 1, 1)
+	require.Equal([]string{"u0", "u0", "u1", "u0", "u2", "u0", "u0"}, pickNames(pool, 7, "example.com:443", "127.0.0.1:1234"))
+}
+
+func TestUpstreamPoolLeastConn(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(require, StrategyLeastConn, 1, 1, 1)
+	pool.upstreams[0].active.Store(3)
+	pool.upstreams[1].active.Store(1)
+	pool.upstreams[2].active.Store(2)
+	require.Equal([]string{"u1", "u1"}, pickNames(pool, 2, "example.com:443", "127.0.0.1:1234"))
+}
+
+func TestUpstreamPoolHash(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(require, StrategyHashDestination, 1, 1, 1)
+	first := pool.pick("example.com:443", "127.0.0.1:1", nil)
+	for i := 0; i < 10; i++ {
+		require.Equal(first, pool.pick(fmt.Sprintf("example.com:%d", i), fmt.Sprintf("127.0.0.%d:1", i), nil))
+	}
+
+	// removing an upstream only moves its own keys
+	smaller := newTestPool(require, StrategyHashDestination, 1, 1)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		dest := fmt.Sprintf("host-%d.com:443", i)
+		before := pool.pick(dest, "", nil).name
+		after := smaller.pick(dest, "", nil).name
+		if before != "u2" {
+			require.Equal(before, after)
+		} else {
+			moved++
+		}
+	}
+	require.Greater(moved, 0)
+
+	pool = newTestPool(require, StrategyHashClient, 1, 1, 1)
+	first = pool.pick("a.com:443", "10.0.0.1:1000", nil)
+	require.Equal(first, pool.pick("b.com:443", "10.0.0.1:2000", nil))
+}
+
+func TestUpstreamPoolInvalid(t *testing.T) {
+	require := require.New(t)
+
+	_, err := newUpstreamPool("fastest", nil, HealthCheckConfig{}, proxy.Direct)
+	require.ErrorContains(err, "strategy 'fastest' invalid")
+
+	_, err = newUpstreamPool(StrategyRandom, []UpstreamConfig{
+		{Name: "a", URL: "socks5://127.0.0.1:1080"},
+		{Name: "a", URL: "socks5://127.0.0.1:1081"},
+	}, HealthCheckConfig{}, proxy.Direct)
+	require.ErrorContains(err, "duplicate")
+}
+
+func TestUpstreams(t *testing.T) {
+	require := require.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello upstream"))
+	}))
+	defer upstream.Close()
+
+	// upstream proxies count requests passing them
+	var counts [2]atomic.Int64
+	var configs []UpstreamConfig
+	for i := range counts {
+		server, err := NewServer()
+		require.Nil(err)
+
+		count := &counts[i]
+		proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count.Add(1)
+			server.ServeHTTP(w, r)
+		}))
+		defer proxyServer.Close()
+
+		configs = append(configs, UpstreamConfig{URL: proxyServer.URL})
+	}
+
+	ch, stop := createProxy(require, WithListenAddress(":8080"), WithUpstreams(configs), WithUpstreamStrategy(StrategyRoundRobin))
+	defer stop()
+	<-ch
+
+	proxyUrl, err := url.Parse("http://127.0.0.1:8080")
+	require.Nil(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             http.ProxyURL(proxyUrl),
+		},
+	}
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(upstream.URL)
+		require.Nil(err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal("hello upstream", string(body))
+	}
+
+	require.Equal(int64(2), counts[0].Load())
+	require.Equal(int64(2), counts[1].Load())
+}
+
+func deadAddress(require *require.Assertions) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	require := require.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello upstream"))
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer()
+	require.Nil(err)
+	alive := httptest.NewServer(server)
+	defer alive.Close()
+
+	hc := HealthCheckConfig{MaxFails: 2, Backoff: time.Minute}
+	configs := []UpstreamConfig{
+		{Name: "dead", URL: "http://" + deadAddress(require)},
+		{Name: "alive", URL: alive.URL},
+	}
+	proxy := startProxy(require, WithListenAddress(":8080"), WithUpstreams(configs), WithUpstreamStrategy(StrategyRoundRobin), WithHealthCheck(hc))
+	defer proxy.Shutdown(context.Background())
+
+	proxyUrl, err := url.Parse("http://127.0.0.1:8080")
+	require.Nil(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             http.ProxyURL(proxyUrl),
+		},
+	}
+
+	for i := 0; i < 6; i++ {
+		resp, err := client.Get(upstream.URL)
+		require.Nil(err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal("hello upstream", string(body))
+	}
+
+	statuses := proxy.upstreamStatuses()
+	require.Equal("dead", statuses[0].Name)
+	require.False(statuses[0].Healthy)
+	require.Equal(int64(2), statuses[0].DialFailures)
+	require.True(statuses[1].Healthy)
+	require.Equal(int64(6), statuses[1].Dials)
+
+	var metrics strings.Builder
+	proxy.writeMetrics(&metrics)
+	require.Contains(metrics.String(), `httpproxy_upstream_healthy{upstream="dead"} 0`)
+	require.Contains(metrics.String(), `httpproxy_upstream_healthy{upstream="alive"} 1`)
+	require.Contains(metrics.String(), `httpproxy_tunnels_total 6`)
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	require := require.New(t)
+
+	target := startEchoServer(require)
+	defer target.Close()
+
+	server, err := NewServer()
+	require.Nil(err)
+	alive := httptest.NewServer(server)
+	defer alive.Close()
+
+	hc := HealthCheckConfig{
+		Interval: time.Millisecond * 20,
+		Target:   target.Addr().String(),
+		Timeout:  time.Second,
+		MaxFails: 1,
+		Backoff:  time.Millisecond * 100,
+	}
+	pool, err := newUpstreamPool(StrategyRoundRobin, []UpstreamConfig{
+		{Name: "dead", URL: "http://" + deadAddress(require)},
+		{Name: "alive", URL: alive.URL},
+	}, hc, proxy.Direct)
+	require.Nil(err)
+
+	pool.startHealthCheck()
+	defer pool.stopHealthCheck()
+
+	time.Sleep(time.Millisecond * 100)
+	require.False(pool.upstreams[0].available(time.Now()))
+	require.True(pool.upstreams[1].available(time.Now()))
+	require.Equal("alive", pool.pick("example.com:443", "", nil).name)
+	require.Equal("dead", pool.pick("example.com:443", "", []*upstream{pool.upstreams[1]}).name)
+
+	// failed probes keep ejecting it
+	up := pool.upstreams[0]
+	up.health.mu.Lock()
+	ejections := up.health.ejections
+	up.health.mu.Unlock()
+	require.Greater(ejections, 1)
+}
+
+func TestUpstreamFailureCounted(t *testing.T) {
+	require := require.New(t)
+
+	server, err := NewServer()
+	require.Nil(err)
+	alive := httptest.NewServer(server)
+	defer alive.Close()
+
+	hc := HealthCheckConfig{MaxFails: 1, Backoff: time.Minute}
+	configs := []UpstreamConfig{{Name: "alive", URL: alive.URL}}
+	proxy := startProxy(require, WithListenAddress(":8080"), WithUpstreams(configs), WithHealthCheck(hc))
+	defer proxy.Shutdown(context.Background())
+
+	proxyUrl, err := url.Parse("http://127.0.0.1:8080")
+	require.Nil(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             http.ProxyURL(proxyUrl),
+		},
+	}
+
+	// destination refused by upstream, not upstream's fault
+	dead := "http://" + deadAddress(require)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(dead)
+		require.Nil(err)
+		resp.Body.Close()
+	}
+
+	statuses := proxy.upstreamStatuses()
+	require.True(statuses[0].Healthy)
+	require.Equal(int64(0), statuses[0].DialFailures)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.False(upstreamFailed(ctx, context.Canceled))
+	require.False(upstreamFailed(context.Background(), &ConnectStatusError{StatusCode: http.StatusBadGateway}))
+	require.True(upstreamFailed(context.Background(), &ConnectStatusError{StatusCode: http.StatusProxyAuthRequired}))
+	require.False(upstreamFailed(context.Background(), errors.New("socks connect tcp 127.0.0.1:1080->a.com:443: unknown error host unreachable")))
+	require.True(upstreamFailed(context.Background(), errors.New("dial tcp 127.0.0.1:1080: connect: connection refused")))
+}
@@ -0,0 +1,200 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errExtendedConnectNotSupported = errors.New("h2 server not support extended connect")
+
+// headers of extended CONNECT not sent to origin as http/1.1 upgrade
+var websocketDropHeaders = []string{
+	":protocol",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Accept",
+}
+
+// isExtendedConnect http/2 CONNECT with :protocol (RFC 8441), like websocket.
+// clients only send it if server advertises it, by GODEBUG http2xconnect=1 set before start.
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") != ""
+}
+
+// websocketTLSConfig tls of origin if useTLS, nil for plain http.
+// h2 server sets r.TLS only if :scheme is https, so r.TLS != nil tells it.
+func websocketTLSConfig(host string, useTLS bool) *tls.Config {
+	if !useTLS {
+		return nil
+	}
+
+	hostname, _, _ := net.SplitHostPort(host)
+
+	return &tls.Config{
+		ServerName: hostname,
+		NextProtos: []string{http2.NextProtoTLS, "http/1.1"},
+	}
+}
+
+// dialWebSocket open websocket of extended CONNECT r to origin over conn,
+// by h2 extended CONNECT if origin supports, http/1.1 upgrade otherwise.
+// h2 origin without extended CONNECT retried by http/1.1 on conn of redial.
+// return conn of websocket frames and response headers for client.
+// ctx covers tls and websocket handshakes.
+func dialWebSocket(ctx context.Context, r *http.Request, conn net.Conn, conf *tls.Config, redial func() (net.Conn, error)) (net.Conn, http.Header, error) {
+	c, header, err := dialWebSocketConn(ctx, r, conn, conf)
+	if !errors.Is(err, errExtendedConnectNotSupported) || redial == nil {
+		return c, header, err
+	}
+
+	conn.Close()
+	conn, err = redial()
+	if err != nil {
+		return nil, nil, err
+	}
+	conf = conf.Clone()
+	conf.NextProtos = []string{"http/1.1"}
+	return dialWebSocketConn(ctx, r, conn, conf)
+}
+
+func dialWebSocketConn(ctx context.Context, r *http.Request, conn net.Conn, conf *tls.Config) (net.Conn, http.Header, error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	var c net.Conn
+	var header http.Header
+	var err error
+	if conf == nil {
+		c, header, err = dialWebSocketH1(r, conn, "http")
+	} else {
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, nil, contextErr(ctx, err)
+		}
+
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			c, header, err = dialWebSocketH2(r, tlsConn)
+		} else {
+			c, header, err = dialWebSocketH1(r, tlsConn, "https")
+		}
+	}
+	if err != nil {
+		return nil, nil, contextErr(ctx, err)
+	}
+
+	// deadline may be set already
+	if !stop() {
+		c.Close()
+		return nil, nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, header, nil
+}
+
+// dialWebSocketH1 http/1.1 upgrade, key of handshake generated as h2 has none
+func dialWebSocketH1(r *http.Request, conn net.Conn, scheme string) (net.Conn, http.Header, error) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	secKey := base64.StdEncoding.EncodeToString(key)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     r.Header.Clone(),
+		Host:       r.Host,
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	for _, h := range websocketDropHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", r.Header.Get(":protocol"))
+	req.Header.Set("Sec-WebSocket-Key", secKey)
+
+	if err := req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("websocket upgrade get statusCode %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(secKey) {
+		return nil, nil, errors.New("websocket accept key invalid")
+	}
+
+	header := resp.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	for _, h := range websocketDropHeaders {
+		header.Del(h)
+	}
+
+	// frames read together with response
+	if br.Buffered() > 0 {
+		buffered, _ := br.Peek(br.Buffered())
+		conn = &prefixConn{Conn: conn, prefix: bytes.Clone(buffered)}
+	}
+
+	return conn, header, nil
+}
+
+// dialWebSocketH2 extended CONNECT stream on a new h2 conn to origin, conn closed with the stream
+func dialWebSocketH2(r *http.Request, conn *tls.Conn) (net.Conn, http.Header, error) {
+	stream, resp, err := dialH2Stream(conn, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("websocket connect get statusCode %d", resp.StatusCode)
+	}
+
+	closeConn := func() { conn.Close() }
+	return newStreamConn(resp.Body, stream, closeConn, conn.LocalAddr(), conn.RemoteAddr()), resp.Header, nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// extendedConnectHost host:port of extended CONNECT target, 443 if no port
+func extendedConnectHost(r *http.Request) string {
+	if _, _, err := net.SplitHostPort(r.Host); err == nil {
+		return r.Host
+	}
+	return net.JoinHostPort(strings.Trim(r.Host, "[]"), "443")
+}
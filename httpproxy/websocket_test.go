@@ -0,0 +1,282 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+
+	// advertise SETTINGS_ENABLE_CONNECT_PROTOCOL on http/2
+	_ "github.com/isayme/go-httpproxy/internal/xconnect"
+)
+
+// extendedConnectRequest request of websocket extended CONNECT as h2 server gives
+func extendedConnectRequest(host string) *http.Request {
+	return &http.Request{
+		Method:     http.MethodConnect,
+		ProtoMajor: 2,
+		Host:       host,
+		URL:        &url.URL{Path: "/chat"},
+		Header: http.Header{
+			":protocol":             {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+}
+
+// startWebSocketH1Origin plain origin accepting websocket by http/1.1 upgrade, "hi" then echo frames
+func startWebSocketH1Origin() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat" || r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-Websocket-Version") != "13" {
+			w.WriteHeader(400)
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// frame sent together with response
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-Websocket-Key")) + "\r\n\r\nhi"))
+		io.Copy(conn, conn)
+	}))
+}
+
+func TestWebSocketH1(t *testing.T) {
+	require := require.New(t)
+
+	origin := startWebSocketH1Origin()
+	defer origin.Close()
+
+	conn, err := net.Dial("tcp", origin.Listener.Addr().String())
+	require.Nil(err)
+
+	wsConn, header, err := dialWebSocket(context.Background(), extendedConnectRequest(origin.Listener.Addr().String()), conn, nil, nil)
+	require.Nil(err)
+	defer wsConn.Close()
+	require.Empty(header.Get("Sec-Websocket-Accept"))
+	require.Empty(header.Get("Upgrade"))
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(wsConn, buf)
+	require.Nil(err)
+	require.Equal("hi", string(buf))
+	echo(require, wsConn, "hello")
+
+	// origin refuses upgrade
+	conn, err = net.Dial("tcp", origin.Listener.Addr().String())
+	require.Nil(err)
+	defer conn.Close()
+	r := extendedConnectRequest(origin.Listener.Addr().String())
+	r.URL.Path = "/other"
+	_, _, err = dialWebSocket(context.Background(), r, conn, nil, nil)
+	require.ErrorContains(err, "statusCode 400")
+}
+
+// startWebSocketH2Origin tls origin accepting websocket by h2 extended CONNECT, echo frames
+func startWebSocketH2Origin() *httptest.Server {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isExtendedConnect(r) || r.Header.Get(":protocol") != "websocket" || r.URL.Path != "/chat" {
+			w.WriteHeader(400)
+			return
+		}
+
+		w.Header().Set("Sec-Websocket-Protocol", "chat")
+		w.WriteHeader(200)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+
+	return origin
+}
+
+func TestWebSocketH2(t *testing.T) {
+	require := require.New(t)
+
+	origin := startWebSocketH2Origin()
+	defer origin.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+
+	conn, err := net.Dial("tcp", origin.Listener.Addr().String())
+	require.Nil(err)
+
+	conf := websocketTLSConfig(origin.Listener.Addr().String(), true)
+	conf.RootCAs = roots
+	wsConn, header, err := dialWebSocket(context.Background(), extendedConnectRequest(origin.Listener.Addr().String()), conn, conf, nil)
+	require.Nil(err)
+	require.Equal("chat", header.Get("Sec-Websocket-Protocol"))
+
+	echo(require, wsConn, "hello")
+	echo(require, wsConn, "world")
+
+	// larger than flow control windows
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	go wsConn.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(wsConn, got)
+	require.Nil(err)
+	require.Equal(data, got)
+	wsConn.Close()
+}
+
+func TestExtendedConnect(t *testing.T) {
+	require := require.New(t)
+
+	origin := startWebSocketH2Origin()
+	defer origin.Close()
+
+	proxy := startTLSProxy(require)
+	defer proxy.Shutdown(context.Background())
+
+	conn, err := tls.Dial("tcp", "127.0.0.1:8080", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}})
+	require.Nil(err)
+	defer conn.Close()
+
+	// proxy advertises extended CONNECT, origin with untrusted certificate refused
+	_, resp, err := dialH2Stream(conn, extendedConnectRequest(origin.Listener.Addr().String()))
+	require.Nil(err)
+	require.Equal(http.StatusBadGateway, resp.StatusCode)
+
+	// scheme http, plain origin not on port 80
+	plain := startWebSocketH1Origin()
+	defer plain.Close()
+
+	conn, err = tls.Dial("tcp", "127.0.0.1:8080", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}})
+	require.Nil(err)
+	defer conn.Close()
+
+	r := extendedConnectRequest(plain.Listener.Addr().String())
+	r.URL.Scheme = "http"
+	stream, resp, err := dialH2Stream(conn, r)
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	wsConn := newStreamConn(resp.Body, stream, nil, nil, nil)
+	defer wsConn.Close()
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(wsConn, buf)
+	require.Nil(err)
+	require.Equal("hi", string(buf))
+	echo(require, wsConn, "hello")
+}
+
+// origin negotiating h2 without extended CONNECT, websocket by http/1.1 upgrade on a new conn
+func TestWebSocketH2Fallback(t *testing.T) {
+	require := require.New(t)
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-Websocket-Key")) + "\r\n\r\n"))
+		io.Copy(conn, conn)
+	}))
+	origin.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS, "http/1.1"}}
+	origin.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		http2.NextProtoTLS: func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+			http2.NewFramer(conn, conn).WriteSettings()
+			io.Copy(io.Discard, conn)
+		},
+	}
+	origin.StartTLS()
+	defer origin.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+	conf := websocketTLSConfig(origin.Listener.Addr().String(), true)
+	conf.RootCAs = roots
+
+	conn, err := net.Dial("tcp", origin.Listener.Addr().String())
+	require.Nil(err)
+	redials := 0
+	redial := func() (net.Conn, error) {
+		redials++
+		return net.Dial("tcp", origin.Listener.Addr().String())
+	}
+
+	wsConn, _, err := dialWebSocket(context.Background(), extendedConnectRequest(origin.Listener.Addr().String()), conn, conf, redial)
+	require.Nil(err)
+	defer wsConn.Close()
+	require.Equal(1, redials)
+	echo(require, wsConn, "hello")
+
+	// no redial, error
+	conn, err = net.Dial("tcp", origin.Listener.Addr().String())
+	require.Nil(err)
+	_, _, err = dialWebSocket(context.Background(), extendedConnectRequest(origin.Listener.Addr().String()), conn, conf, nil)
+	require.ErrorIs(err, errExtendedConnectNotSupported)
+}
+
+// data of origin not read yet, window updates of origin still handled
+func TestWebSocketH2NotRead(t *testing.T) {
+	require := require.New(t)
+
+	// larger than windows of origin
+	const size = 4 * 1024 * 1024
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write(make([]byte, 32*1024))
+		http.NewResponseController(w).Flush()
+
+		n, _ := io.Copy(io.Discard, io.LimitReader(r.Body, size))
+		fmt.Fprintf(w, "%d", n)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+	conf := websocketTLSConfig(origin.Listener.Addr().String(), true)
+	conf.RootCAs = roots
+
+	conn, err := net.Dial("tcp", origin.Listener.Addr().String())
+	require.Nil(err)
+	wsConn, _, err := dialWebSocket(context.Background(), extendedConnectRequest(origin.Listener.Addr().String()), conn, conf, nil)
+	require.Nil(err)
+	defer wsConn.Close()
+
+	wsConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = wsConn.Write(make([]byte, size))
+	require.Nil(err)
+
+	got, err := io.ReadAll(io.LimitReader(wsConn, 32*1024+int64(len(strconv.Itoa(size)))))
+	require.Nil(err)
+	require.Equal(strconv.Itoa(size), string(got[32*1024:]))
+}
@@ -0,0 +1,25 @@
+// Package xconnect enables extended CONNECT (RFC 8441) of http/2 servers,
+// imported by the binary and tests only, libraries should not change env.
+//
+// net/http and x/net/http2 only advertise SETTINGS_ENABLE_CONNECT_PROTOCOL
+// with GODEBUG http2xconnect=1, read once in their init. packages are
+// initialized in import path order when ready, this one only needs os and
+// strings, so it runs before them. http2xconnect=0 set by user is kept.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+func init() {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=") {
+		return
+	}
+
+	if godebug != "" {
+		godebug += ","
+	}
+	os.Setenv("GODEBUG", godebug+"http2xconnect=1")
+}
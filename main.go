@@ -1,6 +1,11 @@
 package main
 
-import "github.com/isayme/go-httpproxy/cmd"
+import (
+	"github.com/isayme/go-httpproxy/cmd"
+
+	// advertise SETTINGS_ENABLE_CONNECT_PROTOCOL on http/2
+	_ "github.com/isayme/go-httpproxy/internal/xconnect"
+)
 
 func main() {
 	cmd.Execute()